@@ -0,0 +1,282 @@
+package relampago
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// SlowConsumerPolicy decides what a Broadcaster does when a subscriber isn't
+// keeping up and its buffer is full.
+type SlowConsumerPolicy int
+
+const (
+	// Block waits until the subscriber takes the event (or goes away), which
+	// holds up every other subscriber and whoever is publishing.
+	Block SlowConsumerPolicy = iota
+	// DropOldest discards the oldest buffered event to make room for the new
+	// one. Without a buffer the new event is the one discarded.
+	DropOldest
+	// Disconnect unsubscribes the subscriber and closes its channel.
+	Disconnect
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// BroadcastOptions configure a Broadcaster. The zero value gives every
+// subscriber an unbuffered channel and blocks on slow ones.
+type BroadcastOptions struct {
+	Buffer int
+	Policy SlowConsumerPolicy
+}
+
+// BroadcastStats are counters kept by a Broadcaster since it was created.
+type BroadcastStats struct {
+	Subscribers  int
+	Published    uint64
+	Dropped      uint64
+	Disconnected uint64
+}
+
+// Broadcaster fans out every published value to all of its subscribers. It is
+// safe for concurrent use and is what the backends use for their invoice and
+// payment streams.
+type Broadcaster[T any] struct {
+	// accessed atomically, kept first so they're aligned on 32-bit platforms
+	published    uint64
+	dropped      uint64
+	disconnected uint64
+
+	options BroadcastOptions
+
+	mu          sync.Mutex
+	closed      bool
+	subscribers []*subscriber[T] // in the order they subscribed
+}
+
+type subscriber[T any] struct {
+	ch   chan T
+	done chan struct{} // closed as soon as it starts being removed
+
+	mu     sync.Mutex // held while sending to ch
+	closed bool
+}
+
+func NewBroadcaster[T any](options BroadcastOptions) *Broadcaster[T] {
+	if options.Buffer < 0 {
+		options.Buffer = 0
+	}
+	return &Broadcaster[T]{options: options}
+}
+
+// Subscribe returns a channel that gets every value published from now on.
+// The subscriber is removed and the channel closed when ctx is done, when it
+// is disconnected for being too slow or when the Broadcaster is closed.
+func (b *Broadcaster[T]) Subscribe(ctx context.Context) (<-chan T, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+	sub := &subscriber[T]{
+		ch:   make(chan T, b.options.Buffer),
+		done: make(chan struct{}),
+	}
+	b.subscribers = append(b.subscribers, sub)
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				b.remove(sub)
+			case <-sub.done:
+			}
+		}()
+	}
+
+	return sub.ch, nil
+}
+
+// Publish sends value to every subscriber according to the SlowConsumerPolicy.
+// It does nothing once the Broadcaster is closed.
+func (b *Broadcaster[T]) Publish(value T) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	subscribers := append([]*subscriber[T](nil), b.subscribers...)
+	b.mu.Unlock()
+
+	atomic.AddUint64(&b.published, 1)
+	for _, sub := range subscribers {
+		b.send(sub, value)
+	}
+}
+
+func (b *Broadcaster[T]) send(sub *subscriber[T], value T) {
+	sub.mu.Lock()
+	if sub.closed {
+		sub.mu.Unlock()
+		return
+	}
+
+	switch b.options.Policy {
+	case DropOldest:
+		for {
+			select {
+			case sub.ch <- value:
+				sub.mu.Unlock()
+				return
+			default:
+			}
+
+			if cap(sub.ch) == 0 {
+				// nothing older to drop
+				atomic.AddUint64(&b.dropped, 1)
+				sub.mu.Unlock()
+				return
+			}
+			select {
+			case <-sub.ch:
+				atomic.AddUint64(&b.dropped, 1)
+			default:
+				// the subscriber took one in the meantime, try again
+			}
+		}
+
+	case Disconnect:
+		select {
+		case sub.ch <- value:
+			sub.mu.Unlock()
+		default:
+			sub.mu.Unlock()
+			atomic.AddUint64(&b.dropped, 1)
+			atomic.AddUint64(&b.disconnected, 1)
+			b.remove(sub)
+		}
+
+	default:
+		select {
+		case sub.ch <- value:
+		case <-sub.done:
+		}
+		sub.mu.Unlock()
+	}
+}
+
+// remove unsubscribes sub and closes its channel. It can be called more than
+// once.
+func (b *Broadcaster[T]) remove(sub *subscriber[T]) {
+	b.mu.Lock()
+	i := 0
+	for i < len(b.subscribers) && b.subscribers[i] != sub {
+		i++
+	}
+	if i == len(b.subscribers) {
+		b.mu.Unlock()
+		return
+	}
+	b.subscribers = append(b.subscribers[:i], b.subscribers[i+1:]...)
+	close(sub.done) // wakes up a Publish blocked on this subscriber
+	b.mu.Unlock()
+
+	sub.mu.Lock()
+	sub.closed = true
+	close(sub.ch)
+	sub.mu.Unlock()
+}
+
+// Close removes every subscriber, closing their channels, and makes further
+// calls to Subscribe fail with ErrClosed. It is safe to call more than once.
+func (b *Broadcaster[T]) Close() {
+	b.mu.Lock()
+	b.closed = true
+	subscribers := append([]*subscriber[T](nil), b.subscribers...)
+	b.mu.Unlock()
+
+	for _, sub := range subscribers {
+		b.remove(sub)
+	}
+}
+
+func (b *Broadcaster[T]) Stats() BroadcastStats {
+	b.mu.Lock()
+	subscribers := len(b.subscribers)
+	b.mu.Unlock()
+
+	return BroadcastStats{
+		Subscribers:  subscribers,
+		Published:    atomic.LoadUint64(&b.published),
+		Dropped:      atomic.LoadUint64(&b.dropped),
+		Disconnected: atomic.LoadUint64(&b.disconnected),
+	}
+}
+
+// DefaultQueueLimit is how many values the backends let Queue keep for the
+// reader of a resumed stream while it replays.
+const DefaultQueueLimit = 1000
+
+// Queue relays everything from ch, a subscription, keeping up to limit values
+// the reader of the returned channel hasn't taken yet, so the Broadcaster
+// doesn't wait on a reader that is busy for a while, like with a replay. Past
+// that Queue stops taking from ch and the Broadcaster treats the subscription
+// by its SlowConsumerPolicy, as it would any slow one. The returned channel
+// is closed once ch is closed and the queue is empty, or when ctx is done,
+// which should also end the subscription.
+func Queue[T any](ctx context.Context, ch <-chan T, limit int) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+
+		var queue []T
+		for ch != nil || len(queue) > 0 {
+			var send chan T // nil, so disabled, while there is nothing to send
+			var next T
+			if len(queue) > 0 {
+				send = out
+				next = queue[0]
+			}
+			recv := ch
+			if len(queue) >= limit {
+				recv = nil // full, until the reader takes one
+			}
+
+			select {
+			case value, ok := <-recv:
+				if !ok {
+					ch = nil
+					continue
+				}
+				queue = append(queue, value)
+			case send <- next:
+				queue = queue[1:]
+			case <-ctx.Done():
+				if ch != nil {
+					for range ch {
+						// until the subscription is removed
+					}
+				}
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// StreamStatsReporter is implemented by wallets whose streams are backed by
+// Broadcasters, so callers can see how many events slow listeners missed.
+type StreamStatsReporter interface {
+	StreamStats() (invoices, payments BroadcastStats)
+}
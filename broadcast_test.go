@@ -0,0 +1,144 @@
+package relampago
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBroadcasterBlock(t *testing.T) {
+	b := NewBroadcaster[int](BroadcastOptions{})
+	first, _ := b.Subscribe(context.Background())
+	second, _ := b.Subscribe(context.Background())
+
+	go b.Publish(1)
+	for _, ch := range []<-chan int{first, second} {
+		if got := <-ch; got != 1 {
+			t.Errorf("got %v, wanted %v", got, 1)
+		}
+	}
+
+	// a blocked Publish is released by Close
+	published := make(chan struct{})
+	go func() {
+		b.Publish(2)
+		close(published)
+	}()
+	b.Close()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Errorf("Publish still blocked after Close")
+	}
+}
+
+func TestBroadcasterDropOldest(t *testing.T) {
+	b := NewBroadcaster[int](BroadcastOptions{Buffer: 2, Policy: DropOldest})
+	ch, _ := b.Subscribe(context.Background())
+
+	for i := 1; i <= 5; i++ {
+		b.Publish(i)
+	}
+	for _, want := range []int{4, 5} {
+		if got := <-ch; got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	}
+
+	want := BroadcastStats{Subscribers: 1, Published: 5, Dropped: 3}
+	if got := b.Stats(); got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestBroadcasterDisconnect(t *testing.T) {
+	b := NewBroadcaster[int](BroadcastOptions{Buffer: 1, Policy: Disconnect})
+	slow, _ := b.Subscribe(context.Background())
+	fast, _ := b.Subscribe(context.Background())
+
+	b.Publish(1)
+	if got := <-fast; got != 1 {
+		t.Errorf("got %v, wanted %v", got, 1)
+	}
+	b.Publish(2)
+	if got := <-fast; got != 2 {
+		t.Errorf("got %v, wanted %v", got, 2)
+	}
+
+	// the slow one still gets what was buffered before being dropped
+	if got := <-slow; got != 1 {
+		t.Errorf("got %v, wanted %v", got, 1)
+	}
+	if _, ok := <-slow; ok {
+		t.Errorf("slow subscriber wasn't disconnected")
+	}
+
+	want := BroadcastStats{Subscribers: 1, Published: 2, Dropped: 1, Disconnected: 1}
+	if got := b.Stats(); got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestBroadcasterUnsubscribe(t *testing.T) {
+	b := NewBroadcaster[int](BroadcastOptions{})
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, _ := b.Subscribe(ctx)
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("stream wasn't closed")
+	}
+
+	// nobody is listening anymore, so this mustn't block
+	b.Publish(1)
+	if got := b.Stats().Subscribers; got != 0 {
+		t.Errorf("got %v subscribers, wanted %v", got, 0)
+	}
+
+	b.Close()
+	if _, err := b.Subscribe(context.Background()); err != ErrClosed {
+		t.Errorf("got %v, wanted %v", err, ErrClosed)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	b := NewBroadcaster[int](BroadcastOptions{})
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, _ := b.Subscribe(ctx)
+	queued := Queue(ctx, sub, 3)
+
+	// nobody reads yet, and Publish doesn't wait for it
+	for i := 1; i <= 3; i++ {
+		b.Publish(i)
+	}
+
+	// past the limit the Block policy applies
+	published := make(chan struct{})
+	go func() {
+		b.Publish(4)
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Errorf("Publish didn't wait with a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for _, want := range []int{1, 2, 3, 4} {
+		if got := <-queued; got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	}
+	<-published
+
+	b.Publish(5)
+	cancel()
+	for range queued {
+	}
+	if got := b.Stats().Subscribers; got != 0 {
+		t.Errorf("got %v subscribers, wanted %v", got, 0)
+	}
+}
@@ -1,10 +1,13 @@
 package cliche
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"time"
 
 	clichelib "github.com/fiatjaf/go-cliche"
 	rp "github.com/lnbits/relampago"
@@ -14,90 +17,133 @@ type Params struct {
 	JARPath    string
 	BinaryPath string
 	DataDir    string
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
 }
 
 type ClicheWallet struct {
-	control *clichelib.Control
+	control *control
+
+	life *rp.Lifecycle // stops the process on Close
 
-	invoiceStatusListeners []chan rp.InvoiceStatus
-	paymentStatusListeners []chan rp.PaymentStatus
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
 }
 
 func Start(params Params) (*ClicheWallet, error) {
 	e := &ClicheWallet{
-		control: &clichelib.Control{
+		control: &control{
 			JARPath:    params.JARPath,
 			BinaryPath: params.BinaryPath,
 			DataDir:    params.DataDir,
 		},
+		life:     rp.NewLifecycle("cliche", nil),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
 	}
 
-	if err := e.control.Start(); err != nil {
+	if err := e.control.start(e.handleEvent); err != nil {
+		e.life.Close()
 		return nil, err
 	}
 
-	go func() {
-		for event := range e.control.PaymentSuccesses {
-			for _, listener := range e.paymentStatusListeners {
-				listener <- rp.PaymentStatus{
-					CheckingID: event.PaymentHash,
-					Status:     rp.Complete,
-					FeePaid:    event.FeeMsatoshi,
-					Preimage:   event.Preimage,
-				}
-			}
-		}
-	}()
-
-	go func() {
-		for event := range e.control.PaymentFailures {
-			for _, listener := range e.paymentStatusListeners {
-				listener <- rp.PaymentStatus{
-					CheckingID: event.PaymentHash,
-					Status:     rp.Failed,
-				}
-			}
-		}
-	}()
-
-	go func() {
-		for event := range e.control.IncomingPayments {
-			for _, listener := range e.invoiceStatusListeners {
-				listener <- rp.InvoiceStatus{
-					CheckingID:       event.PaymentHash,
-					Exists:           true,
-					Paid:             true,
-					MSatoshiReceived: event.Msatoshi,
-				}
-			}
-		}
-	}()
-
 	return e, nil
 }
 
-// Compile time check to ensure that ClicheWallet fully implements rp.Wallet
-var _ rp.Wallet = (*ClicheWallet)(nil)
+func (e *ClicheWallet) handleEvent(event clichelib.JSONRPCNotification) {
+	switch event.Method {
+	case "payment_succeeded":
+		var ps clichelib.PaymentSucceededEvent
+		json.Unmarshal(event.Params, &ps)
+		e.payments.Publish(rp.PaymentStatus{
+			CheckingID: ps.PaymentHash,
+			Status:     rp.Complete,
+			FeePaid:    ps.FeeMsatoshi,
+			Preimage:   ps.Preimage,
+		})
+	case "payment_failed":
+		var pf clichelib.PaymentFailedEvent
+		json.Unmarshal(event.Params, &pf)
+		e.payments.Publish(rp.PaymentStatus{
+			CheckingID: pf.PaymentHash,
+			Status:     rp.Failed,
+		})
+	case "payment_received":
+		var pr clichelib.PaymentReceivedEvent
+		json.Unmarshal(event.Params, &pr)
+		e.invoices.Publish(rp.InvoiceStatus{
+			CheckingID:       pr.PaymentHash,
+			Exists:           true,
+			Paid:             true,
+			MSatoshiReceived: pr.Msatoshi,
+			State:            rp.InvoiceSettled,
+		})
+	}
+}
+
+// Compile time check to ensure that ClicheWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*ClicheWallet)(nil)
+var _ rp.StreamStatsReporter = (*ClicheWallet)(nil)
 
 func (e *ClicheWallet) Kind() string {
 	return "eclair"
 }
 
+func (e *ClicheWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          false, // cliche picks the expiry itself
+		MPP:                   true,
+		InvoicePaymentHashIDs: true,
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Close terminates the cliche process and closes every listener channel. It
+// is safe to call more than once.
+func (e *ClicheWallet) Close() error {
+	// closing the broadcasters also releases the event loop if it's blocked on
+	// slow listeners, otherwise the process couldn't be stopped
+	var err error
+	e.life.Close(e.invoices.Close, e.payments.Close, func() { err = e.control.stop() })
+	return err
+}
+
 func (e *ClicheWallet) GetInfo() (rp.WalletInfo, error) {
-	info, err := e.control.GetInfo()
+	return e.GetInfoCtx(context.Background())
+}
+
+func (e *ClicheWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	var info clichelib.GetInfoResult
+	err := e.control.call(ctx, "get-info", map[string]interface{}{}, &info)
 	if err != nil {
 		return rp.WalletInfo{}, fmt.Errorf("error calling 'get-info': %w", err)
 	}
 
-	var balance int64
+	wallet := rp.WalletInfo{
+		Pubkey:      info.MainPubkey,
+		Network:     rp.Mainnet, // cliche doesn't run anywhere else
+		BlockHeight: uint32(info.BlockHeight),
+		Synced:      true, // it follows the chain through electrum, no syncing
+	}
 	for _, channel := range info.Channels {
-		balance += int64(channel.Balance)
+		wallet.OutboundMsat += int64(channel.Balance)
+		wallet.InboundMsat += channel.CanReceive
+	}
+	for _, w := range info.Wallets {
+		wallet.OnchainMsat += w.Balance * 1000 // these are in satoshis
 	}
+	wallet.Balance = wallet.OutboundMsat
 
-	return rp.WalletInfo{Balance: balance}, nil
+	return wallet, nil
 }
 
 func (e *ClicheWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return e.CreateInvoiceCtx(context.Background(), params)
+}
+
+func (e *ClicheWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
 	preimageB := make([]byte, 32)
 	if _, err := rand.Read(preimageB); err != nil {
 		return rp.InvoiceData{},
@@ -105,12 +151,13 @@ func (e *ClicheWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, e
 	}
 	preimage := hex.EncodeToString(preimageB)
 
-	inv, err := e.control.CreateInvoice(clichelib.CreateInvoiceParams{
+	var inv clichelib.CreateInvoiceResult
+	err := e.control.call(ctx, "create-invoice", clichelib.CreateInvoiceParams{
 		Msatoshi:        params.Msatoshi,
 		Description:     params.Description,
 		DescriptionHash: hex.EncodeToString(params.DescriptionHash),
 		Preimage:        preimage,
-	})
+	}, &inv)
 	if err != nil {
 		return rp.InvoiceData{}, fmt.Errorf("'create-invoice' call failed: %w", err)
 	}
@@ -122,9 +169,13 @@ func (e *ClicheWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, e
 }
 
 func (e *ClicheWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
-	info, err := e.control.CheckPayment(checkingID)
+	return e.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (e *ClicheWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	info, err := e.checkPayment(ctx, checkingID)
 	if err != nil {
-		if strings.Contains(err.Error(), "couldn't get payment") {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
 			return rp.InvoiceStatus{
 				CheckingID: checkingID,
 				Exists:     false,
@@ -143,25 +194,51 @@ func (e *ClicheWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, er
 		}, nil
 	}
 
-	return rp.InvoiceStatus{
+	status := rp.InvoiceStatus{
 		CheckingID:       checkingID,
 		Exists:           true,
 		Paid:             info.Status == "complete",
 		MSatoshiReceived: info.Msatoshi,
-	}, nil
+		Invoice:          info.Invoice,
+	}
+	status.CreatedAt, status.ExpiresAt = rp.InvoiceTimes(info.Invoice)
+	if status.Paid {
+		// cliche times are in milliseconds
+		status.State = rp.InvoiceSettled
+		status.SettledAt = time.UnixMilli(info.UpdatedAt)
+	} else {
+		status.State = rp.UnpaidState(status.ExpiresAt)
+	}
+	return status, nil
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (e *ClicheWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return e.invoices.Stats(), e.payments.Stats()
 }
 
 func (e *ClicheWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
-	listener := make(chan rp.InvoiceStatus)
-	e.invoiceStatusListeners = append(e.invoiceStatusListeners, listener)
-	return listener, nil
+	return e.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (e *ClicheWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return e.invoices.Subscribe(ctx)
 }
 
 func (e *ClicheWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
-	resp, err := e.control.PayInvoice(clichelib.PayInvoiceParams{
+	return e.MakePaymentCtx(context.Background(), params)
+}
+
+func (e *ClicheWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if params.MaxFeeMsat != 0 || params.MaxFeePercent != 0 || params.Timeout != 0 {
+		return rp.PaymentData{}, errors.New("cliche can't limit the fees or time of a payment")
+	}
+
+	var resp clichelib.PayInvoiceResult
+	err := e.control.call(ctx, "pay-invoice", clichelib.PayInvoiceParams{
 		Invoice:  params.Invoice,
 		Msatoshi: params.CustomAmount,
-	})
+	}, &resp)
 	if err != nil {
 		return rp.PaymentData{}, fmt.Errorf("error calling 'pay-invoice' with '%s': %w",
 			params.Invoice, err)
@@ -173,9 +250,13 @@ func (e *ClicheWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, err
 }
 
 func (e *ClicheWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
-	info, err := e.control.CheckPayment(checkingID)
+	return e.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+func (e *ClicheWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	info, err := e.checkPayment(ctx, checkingID)
 	if err != nil {
-		if strings.Contains(err.Error(), "couldn't get payment") {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
 			return rp.PaymentStatus{
 				CheckingID: checkingID,
 				Status:     rp.NeverTried,
@@ -215,7 +296,17 @@ func (e *ClicheWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, er
 }
 
 func (e *ClicheWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
-	listener := make(chan rp.PaymentStatus)
-	e.paymentStatusListeners = append(e.paymentStatusListeners, listener)
-	return listener, nil
+	return e.PaymentsStreamCtx(context.Background())
+}
+
+func (e *ClicheWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return e.payments.Subscribe(ctx)
+}
+
+func (e *ClicheWallet) checkPayment(ctx context.Context, hash string) (clichelib.CheckPaymentResult, error) {
+	var result clichelib.CheckPaymentResult
+	err := e.control.call(ctx, "check-payment", struct {
+		Hash string `json:"hash"`
+	}{hash}, &result)
+	return result, err
 }
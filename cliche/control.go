@@ -0,0 +1,231 @@
+package cliche
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	clichelib "github.com/fiatjaf/go-cliche"
+	rp "github.com/lnbits/relampago"
+)
+
+// control runs cliche as a child process and talks JSON-RPC to it over
+// stdin/stdout, just like clichelib.Control, except that calls take a context
+// and the process can be stopped.
+type control struct {
+	JARPath    string
+	BinaryPath string
+	DataDir    string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	exited chan struct{}
+
+	mu      sync.Mutex
+	encoder *json.Encoder
+	waiting map[string]chan clichelib.JSONRPCResponse
+}
+
+// start launches cliche and blocks until it is ready to receive commands.
+// Notifications it sends are given to onEvent, one at a time.
+func (c *control) start(onEvent func(clichelib.JSONRPCNotification)) error {
+	c.waiting = make(map[string]chan clichelib.JSONRPCResponse)
+	c.exited = make(chan struct{})
+
+	var usingPath string
+	if c.BinaryPath != "" {
+		usingPath = c.BinaryPath
+		c.cmd = exec.Command(
+			c.BinaryPath,
+			"-Dcliche.datadir="+c.DataDir,
+			"-Dcliche.json.compact=true",
+		)
+	} else if c.JARPath != "" {
+		usingPath = c.JARPath
+		c.cmd = exec.Command(
+			"java",
+			"-Dcliche.datadir="+c.DataDir,
+			"-Dcliche.json.compact=true",
+			"-jar", c.JARPath,
+		)
+	} else {
+		return fmt.Errorf("must specify BinaryPath or JARPath, but both are empty")
+	}
+
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open cliche stdin: %w", err)
+	}
+	c.stdin = stdin
+	c.encoder = json.NewEncoder(stdin)
+
+	stderr, err := c.cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open cliche stderr: %w", err)
+	}
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open cliche stdout: %w", err)
+	}
+
+	if err := c.cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start cliche (%s): %w", usingPath, err)
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+
+	go func() {
+		defer readers.Done()
+
+		reader := bufio.NewReader(stderr)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			log.Print("[cliche] stderr: ", strings.TrimSpace(string(line)))
+		}
+	}()
+
+	ready := make(chan struct{}, 1)
+	go func() {
+		defer readers.Done()
+
+		reader := bufio.NewReader(stdout)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+
+			// is this an event?
+			var event clichelib.JSONRPCNotification
+			if err = json.Unmarshal(line, &event); err == nil && event.Method != "" {
+				if event.Method == "ready" {
+					select {
+					case ready <- struct{}{}:
+					default:
+					}
+				} else {
+					onEvent(event)
+				}
+				continue
+			}
+
+			// is this a response from a command?
+			var response clichelib.JSONRPCResponse
+			if err = json.Unmarshal(line, &response); err == nil {
+				c.mu.Lock()
+				awaiter, ok := c.waiting[response.Id]
+				c.mu.Unlock()
+				if ok {
+					awaiter <- response
+				}
+				continue
+			}
+
+			// it's not json
+			log.Print("[cliche] stdout: ", strings.TrimSpace(string(line)))
+		}
+	}()
+
+	// the process can only be waited for after we're done reading its output
+	go func() {
+		readers.Wait()
+		c.cmd.Wait()
+		close(c.exited)
+	}()
+
+	// wait until cliche is ready to receive commands
+	select {
+	case <-ready:
+		return nil
+	case <-c.exited:
+		return fmt.Errorf("cliche (%s) exited before becoming ready", usingPath)
+	}
+}
+
+// stop kills the cliche process and waits until it is gone, which also means
+// no more events will be given to onEvent.
+func (c *control) stop() error {
+	c.stdin.Close()
+	err := c.cmd.Process.Kill()
+	<-c.exited
+
+	if errors.Is(err, os.ErrProcessDone) {
+		// it had already exited by itself
+		return nil
+	}
+	return err
+}
+
+func (c *control) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	id := fmt.Sprintf("id:%d", rand.Int63())
+	ch := make(chan clichelib.JSONRPCResponse, 1)
+
+	c.mu.Lock()
+	c.waiting[id] = ch
+	err := c.encoder.Encode(clichelib.JSONRPCRequest{Id: id, Method: method, Params: params})
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+	}()
+
+	if err != nil {
+		return rp.WrapError(rp.ErrBackendUnavailable,
+			fmt.Errorf("error writing json to cliche stdin ('%s'): %w", method, err))
+	}
+
+	select {
+	case response := <-ch:
+		if response.Error != nil {
+			return mapError(fmt.Errorf("'%s' error: '%s'", method, response.Error.Message))
+		}
+		return json.Unmarshal(response.Result, result)
+	case <-c.exited:
+		return rp.WrapError(rp.ErrBackendUnavailable,
+			fmt.Errorf("cliche exited while waiting for '%s'", method))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// clicheErrors are the messages cliche uses for the errors in the root
+// package.
+var clicheErrors = []struct {
+	message string
+	kind    error
+}{
+	{"couldn't get payment", rp.ErrInvoiceNotFound},
+	{"expired", rp.ErrInvoiceExpired},
+	{"already paid", rp.ErrAlreadyPaid},
+	{"not enough", rp.ErrInsufficientBalance},
+	{"no route", rp.ErrNoRoute},
+	{"invalid invoice", rp.ErrInvalidInvoice},
+	{"failed to parse", rp.ErrInvalidInvoice},
+}
+
+// mapError wraps an error cliche replied with with the matching error from the
+// root package, if there is one.
+func mapError(err error) error {
+	message := strings.ToLower(err.Error())
+	for _, e := range clicheErrors {
+		if strings.Contains(message, e.message) {
+			return rp.WrapError(e.kind, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package cliche
+
+import (
+	"errors"
+	"testing"
+
+	rp "github.com/lnbits/relampago"
+)
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{errors.New("'check-payment' error: 'couldn't get payment 'ff''"), rp.ErrInvoiceNotFound},
+		{errors.New("'pay-invoice' error: 'invoice expired'"), rp.ErrInvoiceExpired},
+		{errors.New("'pay-invoice' error: 'invoice already paid'"), rp.ErrAlreadyPaid},
+		{errors.New("'pay-invoice' error: 'not enough balance'"), rp.ErrInsufficientBalance},
+		{errors.New("'pay-invoice' error: 'no route to destination'"), rp.ErrNoRoute},
+		{errors.New("'pay-invoice' error: 'failed to parse invoice'"), rp.ErrInvalidInvoice},
+		{errors.New("'get-info' error: 'something else'"), nil},
+	}
+
+	for _, test := range tests {
+		got := mapError(test.err)
+		if test.want == nil {
+			if got != test.err {
+				t.Errorf("got %v, wanted %v", got, test.err)
+			}
+			continue
+		}
+		if !errors.Is(got, test.want) {
+			t.Errorf("got %v, wanted %v for '%v'", got, test.want, test.err)
+		}
+	}
+}
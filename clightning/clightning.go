@@ -0,0 +1,562 @@
+package clightning
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/sparko"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+	backoff "gopkg.in/cenkalti/backoff.v1"
+)
+
+// PaymentPollInterval is how long the background streams wait before trying
+// again after an error from lightningd.
+var PaymentPollInterval = 5 * time.Second
+
+// TrackPaymentRetryLimit is for how long following a payment is retried after
+// errors before it is published with an Unknown status.
+var TrackPaymentRetryLimit = 15 * time.Minute
+
+// WaitTimeout is how long a single pay, waitsendpay or waitanyinvoice call is
+// left waiting before it is made again.
+var WaitTimeout = time.Minute
+
+type Params struct {
+	Path           string // the lightning-rpc socket
+	ConnectTimeout time.Duration
+
+	InvoiceLabelPrefix string // optional, defaults to 'relampago'
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, gets errors from the background streams
+}
+
+type ClightningWallet struct {
+	Params
+
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+	held     *rp.Broadcaster[rp.InvoiceStatus] // accepted hold invoices
+}
+
+func Start(params Params) (*ClightningWallet, error) {
+	timeout := params.ConnectTimeout
+	if timeout == 0 {
+		timeout = lightning.DefaultTimeout
+	}
+
+	// calls only connect when they are made, so see if there is anything
+	// there first
+	conn, err := net.DialTimeout("unix", params.Path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w",
+			params.Path, rp.WrapError(rp.ErrBackendUnavailable, err))
+	}
+	conn.Close()
+
+	c := newClightningWallet(params)
+	c.life.Spawn(c.startInvoicesStream)
+	c.life.Spawn(c.startPaymentsStream)
+
+	return c, nil
+}
+
+func newClightningWallet(params Params) *ClightningWallet {
+	life := rp.NewLifecycle("clightning", params.OnError)
+	return &ClightningWallet{
+		Params:   params,
+		life:     life,
+		ctx:      life.Context(),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+		held:     rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+	}
+}
+
+// Compile time check to ensure that ClightningWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*ClightningWallet)(nil)
+var _ rp.HoldInvoiceWallet = (*ClightningWallet)(nil)
+var _ rp.KeysendWallet = (*ClightningWallet)(nil)
+var _ rp.ResumableWallet = (*ClightningWallet)(nil)
+var _ rp.StreamStatsReporter = (*ClightningWallet)(nil)
+
+func (c *ClightningWallet) Kind() string {
+	return "clightning"
+}
+
+func (c *ClightningWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		Keysend:               true,
+		HoldInvoices:          true, // with the hold plugin
+		MPP:                   true,
+		FeeLimits:             true,
+		PaymentTimeout:        true,
+		InvoicePaymentHashIDs: false, // invoices are checked by their label
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Close stops the background calls and closes every listener channel. It is
+// safe to call more than once.
+func (c *ClightningWallet) Close() error {
+	c.life.Close(c.invoices.Close, c.payments.Close, c.held.Close)
+	return nil
+}
+
+// call runs a lightningd RPC method bounded by ctx, using the context deadline
+// as the call timeout when there is one. The call is over as soon as ctx is
+// done, so once Close has cancelled c.ctx nothing is left talking to
+// lightningd.
+func (c *ClightningWallet) call(ctx context.Context, method string, params ...interface{}) (gjson.Result, error) {
+	timeout := c.ConnectTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		timeout = lightning.DefaultTimeout
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := rpc(callCtx, c.Path, method, params)
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case callCtx.Err() != nil:
+		err = lightning.ErrorTimeout{Seconds: int(timeout.Seconds())}
+	}
+	return res, sparko.MapError(err)
+}
+
+func (c *ClightningWallet) GetInfo() (rp.WalletInfo, error) {
+	return c.GetInfoCtx(context.Background())
+}
+
+func (c *ClightningWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	funds, err := c.call(ctx, "listfunds")
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling listfunds: %w", err)
+	}
+	node, err := c.call(ctx, "getinfo")
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling getinfo: %w", err)
+	}
+
+	return sparko.WalletInfo(node, funds), nil
+}
+
+func (c *ClightningWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return c.CreateInvoiceCtx(context.Background(), params)
+}
+
+func (c *ClightningWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	method, args, err := sparko.InvoiceRequest(params, c.InvoiceLabelPrefix)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	inv, err := c.call(ctx, method, args)
+	if err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("%s call failed: %w", method, err)
+	}
+	return rp.InvoiceData{
+		Invoice:    inv.Get("bolt11").String(),
+		Preimage:   args["preimage"].(string),
+		CheckingID: args["label"].(string),
+	}, nil
+}
+
+func (c *ClightningWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
+	return c.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (c *ClightningWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	res, err := c.call(ctx, "listinvoices", map[string]interface{}{"label": checkingID})
+	if err != nil {
+		return rp.InvoiceStatus{}, fmt.Errorf("error getting invoice label=%s: %w", checkingID, err)
+	}
+
+	if res.Get("invoices.#").Int() != 1 {
+		return sparko.GetHoldInvoiceStatus(ctx, c.call, checkingID)
+	}
+	return sparko.InvoiceToInvoiceStatus(res.Get("invoices.0")), nil
+}
+
+func (c *ClightningWallet) CreateHoldInvoice(params rp.InvoiceParams, paymentHash string) (rp.InvoiceData, error) {
+	return c.CreateHoldInvoiceCtx(context.Background(), params, paymentHash)
+}
+
+// CreateHoldInvoiceCtx creates the invoice with the hold plugin, which sends
+// no events, so it is looked up in the background until it is settled to feed
+// the held and paid invoices streams.
+func (c *ClightningWallet) CreateHoldInvoiceCtx(
+	ctx context.Context,
+	params rp.InvoiceParams,
+	paymentHash string,
+) (rp.InvoiceData, error) {
+	args, err := sparko.HoldInvoiceArgs(params, paymentHash)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	res, err := c.call(ctx, "holdinvoice", args)
+	if err != nil {
+		return rp.InvoiceData{}, sparko.HoldPluginError("holdinvoice", err)
+	}
+	c.life.Spawn(func() {
+		sparko.WatchHoldInvoice(c.ctx, c.call, paymentHash, c.held.Publish, c.invoices.Publish, c.life.ReportError)
+	})
+
+	return rp.InvoiceData{
+		CheckingID: paymentHash,
+		Invoice:    res.Get("bolt11").String(),
+	}, nil
+}
+
+func (c *ClightningWallet) SettleHoldInvoice(preimage string) error {
+	return c.SettleHoldInvoiceCtx(context.Background(), preimage)
+}
+
+func (c *ClightningWallet) SettleHoldInvoiceCtx(ctx context.Context, preimage string) error {
+	_, err := c.call(ctx, "settleholdinvoice", map[string]interface{}{"preimage": preimage})
+	if err != nil {
+		return sparko.HoldPluginError("settleholdinvoice", err)
+	}
+	return nil
+}
+
+func (c *ClightningWallet) CancelHoldInvoice(paymentHash string) error {
+	return c.CancelHoldInvoiceCtx(context.Background(), paymentHash)
+}
+
+func (c *ClightningWallet) CancelHoldInvoiceCtx(ctx context.Context, paymentHash string) error {
+	_, err := c.call(ctx, "cancelholdinvoice", map[string]interface{}{"payment_hash": paymentHash})
+	if err != nil {
+		return sparko.HoldPluginError("cancelholdinvoice", err)
+	}
+	return nil
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (c *ClightningWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return c.invoices.Stats(), c.payments.Stats()
+}
+
+func (c *ClightningWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return c.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (c *ClightningWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return c.invoices.Subscribe(ctx)
+}
+
+// HeldInvoicesStream gets the hold invoices whose payments are accepted.
+func (c *ClightningWallet) HeldInvoicesStream(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return c.held.Subscribe(ctx)
+}
+
+// PaidInvoicesStreamFrom follows waitanyinvoice from the pay index in cursor.
+func (c *ClightningWallet) PaidInvoicesStreamFrom(ctx context.Context, cursor uint64) (<-chan rp.InvoiceStatus, error) {
+	return sparko.InvoicesStreamFrom(ctx, c.life, func(ctx context.Context, emit func(rp.InvoiceStatus)) {
+		c.waitInvoices(ctx, cursor, emit)
+	})
+}
+
+func (c *ClightningWallet) startInvoicesStream() {
+	c.waitInvoices(c.ctx, 0, c.invoices.Publish)
+}
+
+func (c *ClightningWallet) waitInvoices(ctx context.Context, payIndex uint64, emit func(rp.InvoiceStatus)) {
+	sparko.WaitInvoices(ctx, c.call, payIndex, WaitTimeout, PaymentPollInterval, emit, c.life.ReportError)
+}
+
+func (c *ClightningWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	return c.MakePaymentCtx(context.Background(), params)
+}
+
+func (c *ClightningWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if err := ctx.Err(); err != nil {
+		return rp.PaymentData{}, err
+	}
+
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+	}
+
+	args := sparko.PayArgs(params, inv.MSatoshi)
+	c.life.Spawn(func() {
+		// give the caller some time to store the checkingID we will return
+		// before its status is published
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-c.ctx.Done():
+			return
+		}
+		c.pay(inv.PaymentHash, args)
+	})
+
+	return rp.PaymentData{
+		CheckingID: inv.PaymentHash,
+	}, nil
+}
+
+// pay calls pay and publishes how it went. When that can't be known from the
+// call, because it took too long, the connection broke or an earlier attempt
+// is in flight or done already, the payment is followed with waitsendpay
+// instead.
+func (c *ClightningWallet) pay(hash string, args map[string]interface{}) {
+	ctx, cancel := context.WithTimeout(c.ctx, WaitTimeout)
+	res, err := c.call(ctx, "pay", args)
+	cancel()
+
+	var cmderr lightning.ErrorCommand
+	switch {
+	case err == nil:
+		status := sparko.PayToPaymentStatus(res)
+		status.CheckingID = hash
+		c.payments.Publish(status)
+	case errors.As(err, &cmderr) && cmderr.Code != 200 && cmderr.Code != 201:
+		// anything but PAY_IN_PROGRESS and PAY_RHASH_ALREADY_USED is final
+		c.payments.Publish(rp.PaymentStatus{CheckingID: hash, Status: rp.Failed})
+	default:
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.trackPayment(hash)
+	}
+}
+
+func (c *ClightningWallet) MakeKeysend(params rp.KeysendParams) (rp.PaymentData, error) {
+	return c.MakeKeysendCtx(context.Background(), params)
+}
+
+// MakeKeysendCtx only returns once the payment is done, since lightningd makes
+// the preimage and its hash, the CheckingID, isn't known before. It waits for
+// WaitTimeout at most when ctx has no deadline.
+func (c *ClightningWallet) MakeKeysendCtx(ctx context.Context, params rp.KeysendParams) (rp.PaymentData, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, WaitTimeout)
+		defer cancel()
+	}
+
+	res, err := c.call(ctx, "keysend", sparko.KeysendArgs(params))
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("error calling keysend to %s: %w",
+			params.Destination, err)
+	}
+
+	// published in the background, the caller may be the one listening
+	status := sparko.PayToPaymentStatus(res)
+	c.life.Spawn(func() { c.payments.Publish(status) })
+
+	return rp.PaymentData{
+		CheckingID: status.CheckingID,
+	}, nil
+}
+
+func (c *ClightningWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
+	return c.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+func (c *ClightningWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	status, _, err := c.sendpays(ctx, checkingID)
+	return status, err
+}
+
+// sendpays is the status of the payment with the given hash, made from its
+// parts in listsendpays, and one of the parts that is still pending if any.
+func (c *ClightningWallet) sendpays(ctx context.Context, hash string) (
+	status rp.PaymentStatus, pending gjson.Result, err error,
+) {
+	res, err := c.call(ctx, "listsendpays", map[string]interface{}{
+		"payment_hash": hash,
+	})
+	if err != nil {
+		return rp.PaymentStatus{CheckingID: hash, Status: rp.Unknown}, pending,
+			fmt.Errorf("error getting payment %s: %w", hash, err)
+	}
+
+	status, pending = SendpaysToPaymentStatus(hash, res.Get("payments").Array())
+	return status, pending, nil
+}
+
+// SendpaysToPaymentStatus aggregates the parts of a payment, as listsendpays
+// returns them, into its status. Only the parts of the latest attempt count.
+// It also gives one of the parts that is still pending, if any.
+func SendpaysToPaymentStatus(hash string, parts []gjson.Result) (
+	status rp.PaymentStatus, pending gjson.Result,
+) {
+	status = rp.PaymentStatus{CheckingID: hash, Status: rp.NeverTried}
+	if len(parts) == 0 {
+		return status, pending
+	}
+
+	var groupID int64
+	for _, part := range parts {
+		if id := part.Get("groupid").Int(); id > groupID {
+			groupID = id
+		}
+	}
+
+	var complete int
+	var sent, needed int64
+	for _, part := range parts {
+		if part.Get("groupid").Int() != groupID {
+			continue
+		}
+		switch part.Get("status").String() {
+		case "complete":
+			complete++
+			sent += sparko.Msatoshi(part.Get("amount_sent_msat"))
+			needed += sparko.Msatoshi(part.Get("amount_msat"))
+			status.Preimage = part.Get("payment_preimage").String()
+		case "pending":
+			pending = part
+		}
+	}
+
+	// parts still pending after one completed will complete too, but the fee
+	// is only known once they have
+	switch {
+	case pending.Exists():
+		status.Status = rp.Pending
+	case complete > 0:
+		status.Status = rp.Complete
+		status.FeePaid = sent - needed
+	default:
+		status.Status = rp.Failed
+	}
+	return status, pending
+}
+
+func (c *ClightningWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
+	return c.PaymentsStreamCtx(context.Background())
+}
+
+func (c *ClightningWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return c.payments.Subscribe(ctx)
+}
+
+// startPaymentsStream follows every payment that was pending when the wallet
+// was started.
+func (c *ClightningWallet) startPaymentsStream() {
+	var res gjson.Result
+	err := backoff.RetryNotify(func() (err error) {
+		res, err = c.call(c.ctx, "listsendpays")
+		if err != nil {
+			return fmt.Errorf("error listing payments: %w", err)
+		}
+		return nil
+	}, c.retryBackOff(0), func(err error, _ time.Duration) {
+		c.life.ReportError(err)
+	})
+	if err != nil {
+		return
+	}
+
+	parts := make(map[string][]gjson.Result)
+	for _, part := range res.Get("payments").Array() {
+		hash := part.Get("payment_hash").String()
+		parts[hash] = append(parts[hash], part)
+	}
+	for hash := range parts {
+		if status, _ := SendpaysToPaymentStatus(hash, parts[hash]); status.Status != rp.Pending {
+			continue
+		}
+		hash := hash
+		c.life.Spawn(func() { c.trackPayment(hash) })
+	}
+}
+
+// trackPayment publishes the final status of a payment. Errors are retried
+// with backoff for up to TrackPaymentRetryLimit, after which the payment is
+// published with an Unknown status.
+func (c *ClightningWallet) trackPayment(hash string) {
+	var status rp.PaymentStatus
+	err := backoff.RetryNotify(func() (err error) {
+		status, err = c.waitPayment(hash)
+		return err
+	}, c.retryBackOff(TrackPaymentRetryLimit), func(err error, _ time.Duration) {
+		c.life.ReportError(err)
+	})
+	if c.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		// we don't know what happened, but listeners shouldn't wait forever
+		status = rp.PaymentStatus{CheckingID: hash, Status: rp.Unknown}
+	}
+
+	c.payments.Publish(status)
+}
+
+// waitPayment waits with waitsendpay until none of the parts of a payment are
+// pending anymore.
+func (c *ClightningWallet) waitPayment(hash string) (rp.PaymentStatus, error) {
+	for {
+		status, pending, err := c.sendpays(c.ctx, hash)
+		if err != nil || status.Status != rp.Pending {
+			return status, err
+		}
+
+		args := map[string]interface{}{
+			"payment_hash": hash,
+			"timeout":      WaitTimeout.Seconds(),
+		}
+		if partID := pending.Get("partid"); partID.Exists() {
+			args["partid"] = partID.Int()
+		}
+		if groupID := pending.Get("groupid"); groupID.Exists() {
+			args["groupid"] = groupID.Int()
+		}
+
+		ctx, cancel := context.WithTimeout(c.ctx, WaitTimeout+30*time.Second)
+		_, err = c.call(ctx, "waitsendpay", args)
+		cancel()
+
+		// whether the part succeeded, failed or is still going, look again
+		var cmderr lightning.ErrorCommand
+		if err == nil || (errors.As(err, &cmderr) && cmderr.Code == 200) {
+			// done, or PAY_IN_PROGRESS after the timeout
+			continue
+		}
+		if !errors.As(err, &cmderr) {
+			return status, fmt.Errorf("waitsendpay failed for %s: %w", hash, err)
+		}
+
+		// other command errors could come back right away, so don't go
+		// around too fast
+		select {
+		case <-time.After(PaymentPollInterval):
+		case <-c.ctx.Done():
+			return status, c.ctx.Err()
+		}
+	}
+}
+
+// retryBackOff is how the background streams retry after errors from
+// lightningd, for up to limit or forever if it is zero, stopping when the
+// wallet is closed.
+func (c *ClightningWallet) retryBackOff(limit time.Duration) backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = PaymentPollInterval
+	b.MaxElapsedTime = limit
+	return backoff.WithContext(b, c.ctx)
+}
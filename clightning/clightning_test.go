@@ -0,0 +1,517 @@
+package clightning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/sparko"
+	"github.com/tidwall/gjson"
+)
+
+const invoice = "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3"
+
+const hash = "3f06a81e0a0c2ad34ee9df2a30d87a810da9e3c3881f780755ace5e5e64d30a7"
+
+// handler answers a call with either a result, which is encoded as JSON, or an
+// error. It may block until ctx is done, which is when the test ends.
+type handler func(ctx context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError)
+
+func TestGetInfo(t *testing.T) {
+	c := setupServer(t, func(_ context.Context, method string, _ gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		switch method {
+		case "listfunds":
+			return json.RawMessage(`{"outputs":[{"amount_msat":3000,"status":"confirmed"}],"channels":[{"state":"CHANNELD_NORMAL","our_amount_msat":10000,"amount_msat":30000}]}`), nil
+		case "getinfo":
+			return json.RawMessage(`{"id":"02aa","alias":"alice","network":"bitcoin","blockheight":800,"version":"v22.11"}`), nil
+		}
+		return nil, &lightning.JSONRPCError{Code: -32601, Message: "Unknown command"}
+	})
+
+	want := rp.WalletInfo{
+		Balance:      10000,
+		Pubkey:       "02aa",
+		Alias:        "alice",
+		Network:      rp.Mainnet,
+		BlockHeight:  800,
+		Synced:       true,
+		Version:      "v22.11",
+		OutboundMsat: 10000,
+		InboundMsat:  20000,
+		OnchainMsat:  3000,
+	}
+	got, err := c.GetInfo()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestGetInvoiceStatus(t *testing.T) {
+	c := setupServer(t, func(_ context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		if params.Get("label").String() == "relampago/1" {
+			return json.RawMessage(`{"invoices":[{"label":"relampago/1","status":"paid","msatoshi_received":1000,"pay_index":2,"expires_at":1650003600,"paid_at":1650000060}]}`), nil
+		}
+		return json.RawMessage(`{"invoices":[]}`), nil
+	})
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "relampago/1",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 1000,
+		State:            rp.InvoiceSettled,
+		ExpiresAt:        time.Unix(1650003600, 0),
+		SettledAt:        time.Unix(1650000060, 0),
+		Cursor:           2,
+	}
+	got, err := c.GetInvoiceStatus("relampago/1")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	want = rp.InvoiceStatus{CheckingID: "relampago/2", Exists: false}
+	got, err = c.GetInvoiceStatus("relampago/2")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestPaidInvoicesStream(t *testing.T) {
+	c := setupServer(t, func(ctx context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		switch method {
+		case "listinvoices":
+			return json.RawMessage(`{"invoices":[{"label":"a","status":"paid","pay_index":5},{"label":"b","status":"unpaid"}]}`), nil
+		case "waitanyinvoice":
+			if params.Get("0").Int() == 5 {
+				return json.RawMessage(`{"label":"c","status":"paid","msatoshi_received":1000,"pay_index":6}`), nil
+			}
+			<-ctx.Done()
+		}
+		return nil, &lightning.JSONRPCError{Code: 904, Message: "Timed out"}
+	})
+
+	invoices, err := c.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	c.life.Spawn(c.startInvoicesStream)
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "c",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 1000,
+		State:            rp.InvoiceSettled,
+		Cursor:           6,
+	}
+	select {
+	case got := <-invoices:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("invoice wasn't published")
+	}
+}
+
+func TestTrackPayment(t *testing.T) {
+	waited := make(chan struct{})
+	c := setupServer(t, func(_ context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		switch method {
+		case "listsendpays":
+			select {
+			case <-waited:
+				return json.RawMessage(`{"payments":[
+					{"groupid":1,"partid":1,"status":"failed","amount_msat":1000,"amount_sent_msat":1010},
+					{"groupid":2,"partid":1,"status":"complete","amount_msat":600,"amount_sent_msat":606,"payment_preimage":"ee"},
+					{"groupid":2,"partid":2,"status":"complete","amount_msat":400,"amount_sent_msat":404,"payment_preimage":"ee"}
+				]}`), nil
+			default:
+				return json.RawMessage(`{"payments":[
+					{"groupid":1,"partid":1,"status":"failed","amount_msat":1000,"amount_sent_msat":1010},
+					{"groupid":2,"partid":1,"status":"complete","amount_msat":600,"amount_sent_msat":606,"payment_preimage":"ee"},
+					{"groupid":2,"partid":2,"status":"pending","amount_msat":400,"amount_sent_msat":404}
+				]}`), nil
+			}
+		case "waitsendpay":
+			if got := params.Get("partid").Int(); got != 2 {
+				t.Errorf("got %v, wanted %v", got, 2)
+			}
+			close(waited)
+			return json.RawMessage(`{"status":"complete"}`), nil
+		}
+		return nil, &lightning.JSONRPCError{Code: -32601, Message: "Unknown command"}
+	})
+
+	payments, err := c.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	c.life.Spawn(func() { c.trackPayment(hash) })
+
+	want := rp.PaymentStatus{
+		CheckingID: hash,
+		Status:     rp.Complete,
+		FeePaid:    10,
+		Preimage:   "ee",
+	}
+	select {
+	case got := <-payments:
+		if got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_NoRoute(t *testing.T) {
+	c := setupServer(t, func(_ context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		if got := params.Get("bolt11").String(); got != invoice {
+			t.Errorf("got %v, wanted %v", got, invoice)
+		}
+		return nil, &lightning.JSONRPCError{Code: 205, Message: "Could not find a route"}
+	})
+
+	payments, err := c.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	got, err := c.MakePayment(rp.PaymentParams{Invoice: invoice})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got.CheckingID != hash {
+		t.Errorf("got %v, wanted %v", got.CheckingID, hash)
+	}
+
+	want := rp.PaymentStatus{CheckingID: hash, Status: rp.Failed}
+	select {
+	case got := <-payments:
+		if got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("payment wasn't published")
+	}
+
+	_, err = c.call(context.Background(), "pay", map[string]interface{}{"bolt11": invoice})
+	if !errors.Is(err, rp.ErrNoRoute) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrNoRoute)
+	}
+}
+
+func TestMakePayment_AlreadyPaid(t *testing.T) {
+	c := setupServer(t, func(_ context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		switch method {
+		case "pay":
+			return nil, &lightning.JSONRPCError{Code: 201, Message: "Already paid with this hash"}
+		case "listsendpays":
+			return json.RawMessage(`{"payments":[
+				{"groupid":1,"partid":1,"status":"complete","amount_msat":1000,"amount_sent_msat":1001,"payment_preimage":"ee"}
+			]}`), nil
+		}
+		return nil, &lightning.JSONRPCError{Code: -32601, Message: "Unknown command"}
+	})
+
+	payments, err := c.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if _, err := c.MakePayment(rp.PaymentParams{Invoice: invoice}); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	// it isn't failed, it is looked up
+	want := rp.PaymentStatus{CheckingID: hash, Status: rp.Complete, FeePaid: 1, Preimage: "ee"}
+	select {
+	case got := <-payments:
+		if got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_Limits(t *testing.T) {
+	called := make(chan gjson.Result, 1)
+	c := setupServer(t, func(_ context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		if method == "pay" {
+			called <- params
+		}
+		return nil, &lightning.JSONRPCError{Code: 205, Message: "Could not find a route"}
+	})
+
+	_, err := c.MakePayment(rp.PaymentParams{
+		Invoice:      invoice,
+		CustomAmount: 100000,
+		MaxFeeMsat:   500,
+		Timeout:      45 * time.Second,
+	})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	var params gjson.Result
+	select {
+	case params = <-called:
+	case <-time.After(2 * time.Second):
+		t.Fatal("pay wasn't called")
+	}
+	if got := params.Get("maxfeepercent").Float(); got != 0.5 {
+		t.Errorf("got %v, wanted %v", got, 0.5)
+	}
+	if got := params.Get("exemptfee"); got.Int() != 0 || !got.Exists() {
+		t.Errorf("got %v, wanted %v", got, 0)
+	}
+	if got := params.Get("retry_for").Int(); got != 45 {
+		t.Errorf("got %v, wanted %v", got, 45)
+	}
+}
+
+func TestMakeKeysend(t *testing.T) {
+	c := setupServer(t, func(_ context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		if method != "keysend" {
+			return nil, &lightning.JSONRPCError{Code: -32601, Message: "unknown method"}
+		}
+		if got := params.Get("extratlvs.7629169").String(); got != "7b7d" {
+			t.Errorf("got %v, wanted %v", got, "7b7d")
+		}
+		return map[string]interface{}{
+			"payment_hash":     hash,
+			"payment_preimage": "ee",
+			"amount_msat":      "1000msat",
+			"amount_sent_msat": "1010msat",
+		}, nil
+	})
+
+	payments, err := c.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	got, err := c.MakeKeysend(rp.KeysendParams{
+		Destination:   "02abcd",
+		Msatoshi:      1000,
+		CustomRecords: map[uint64][]byte{7629169: []byte("{}")},
+	})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got.CheckingID != hash {
+		t.Errorf("got %v, wanted %v", got.CheckingID, hash)
+	}
+
+	want := rp.PaymentStatus{CheckingID: hash, Status: rp.Complete, FeePaid: 10, Preimage: "ee"}
+	select {
+	case got := <-payments:
+		if got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestHoldInvoice(t *testing.T) {
+	interval := sparko.HoldInvoicePollInterval
+	t.Cleanup(func() { sparko.HoldInvoicePollInterval = interval })
+	sparko.HoldInvoicePollInterval = 10 * time.Millisecond
+	preimage := "05"
+	settled := make(chan struct{})
+	c := setupServer(t, func(_ context.Context, method string, params gjson.Result) (interface{}, *lightning.JSONRPCError) {
+		switch method {
+		case "holdinvoice":
+			if got := params.Get("payment_hash").String(); got != hash {
+				t.Errorf("got %v, wanted %v", got, hash)
+			}
+			return map[string]interface{}{"bolt11": invoice}, nil
+		case "listinvoices":
+			return map[string]interface{}{"invoices": []interface{}{}}, nil
+		case "listholdinvoices":
+			state := "accepted"
+			select {
+			case <-settled:
+				state = "paid"
+			default:
+			}
+			return map[string]interface{}{"holdinvoices": []interface{}{
+				map[string]interface{}{"payment_hash": hash, "bolt11": invoice, "state": state},
+			}}, nil
+		case "settleholdinvoice":
+			if got := params.Get("preimage").String(); got != preimage {
+				t.Errorf("got %v, wanted %v", got, preimage)
+			}
+			close(settled)
+			return map[string]interface{}{}, nil
+		}
+		return nil, &lightning.JSONRPCError{Code: -32601, Message: "Unknown command"}
+	})
+
+	invoices, err := c.PaidInvoicesStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := c.HeldInvoicesStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.CreateHoldInvoice(rp.InvoiceParams{Msatoshi: 1000}, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (rp.InvoiceData{CheckingID: hash, Invoice: invoice}); data != want {
+		t.Errorf("got %v, wanted %v", data, want)
+	}
+
+	if got := <-held; got.CheckingID != hash || got.State != rp.InvoiceAccepted || got.Paid {
+		t.Errorf("got %v, wanted an accepted invoice", got)
+	}
+	if err := c.SettleHoldInvoice(preimage); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-invoices; got.CheckingID != hash || got.State != rp.InvoiceSettled || !got.Paid {
+		t.Errorf("got %v, wanted a paid invoice", got)
+	}
+	if got, _ := c.GetInvoiceStatus(hash); !got.Exists || !got.Paid {
+		t.Errorf("got %v, wanted a paid invoice", got)
+	}
+
+	// there is no cancelholdinvoice without the plugin
+	if err := c.CancelHoldInvoice(hash); !sparko.IsMethodNotFound(err) {
+		t.Errorf("got %v, wanted a method not found error", err)
+	}
+}
+
+func TestCallCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lightning-rpc")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// lightningd never answers, but sees the connection go away
+	released := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		close(released)
+	}()
+
+	c := newClightningWallet(Params{Path: path})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		c.Close()
+	}()
+	_, err = c.call(c.ctx, "waitanyinvoice", 0, WaitTimeout.Seconds())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, wanted %v", err, context.Canceled)
+	}
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Errorf("connection wasn't closed")
+	}
+}
+
+func TestSendpaysToPaymentStatus(t *testing.T) {
+	for _, test := range []struct {
+		parts string
+		want  rp.Status
+	}{
+		{`[]`, rp.NeverTried},
+		{`[{"groupid":1,"status":"failed"}]`, rp.Failed},
+		{`[{"groupid":1,"status":"failed"},{"groupid":2,"status":"pending"}]`, rp.Pending},
+		{`[{"groupid":1,"status":"pending"},{"groupid":1,"status":"failed"}]`, rp.Pending},
+	} {
+		got, _ := SendpaysToPaymentStatus(hash, gjson.Parse(test.parts).Array())
+		if got.Status != test.want {
+			t.Errorf("got %v, wanted %v for %s", got.Status, test.want, test.parts)
+		}
+	}
+}
+
+// setupServer serves handler on a unix socket like lightning-rpc and starts a
+// wallet that talks to it. Neither of the background streams is started,
+// tests that want them spawn them.
+func setupServer(t *testing.T, handle handler) *ClightningWallet {
+	path := filepath.Join(t.TempDir(), "lightning-rpc")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(ctx, conn, handle)
+		}
+	}()
+
+	c := newClightningWallet(Params{Path: path, OnError: func(error) {}})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func serve(ctx context.Context, conn net.Conn, handle handler) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var req struct {
+			ID     interface{}     `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+
+		result, rpcErr := handle(ctx, req.Method, gjson.ParseBytes(req.Params))
+		if ctx.Err() != nil {
+			return
+		}
+		res := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if rpcErr != nil {
+			res["error"] = rpcErr
+		} else {
+			res["result"] = result
+		}
+		if err := encoder.Encode(res); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package clightning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	"github.com/tidwall/gjson"
+)
+
+// rpc calls method over a connection of its own to the lightning-rpc socket
+// at path. The connection is closed as soon as ctx is done, so nothing is left
+// waiting on lightningd after that. Errors are the ones of the
+// lightningd-gjson-rpc client, for sparko.MapError.
+func rpc(ctx context.Context, path, method string, params []interface{}) (gjson.Result, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return gjson.Result{}, lightning.ErrorConnect{Path: path, Message: err.Error()}
+	}
+	defer conn.Close()
+
+	// closing the connection is what interrupts the write and read below
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	message := lightning.JSONRPCMessage{
+		Version: "2.0",
+		Id:      "0",
+		Method:  method,
+		Params:  rpcParams(params),
+	}
+	if err := json.NewEncoder(conn).Encode(message); err != nil {
+		return gjson.Result{}, lightning.ErrorConnectionBroken{}
+	}
+
+	var response lightning.JSONRPCResponse
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		var neterr net.Error
+		if errors.Is(err, io.EOF) || errors.As(err, &neterr) {
+			return gjson.Result{}, lightning.ErrorConnectionBroken{}
+		}
+		return gjson.Result{}, lightning.ErrorJSONDecode{Message: err.Error()}
+	}
+	if response.Error != nil && response.Error.Code != 0 {
+		return gjson.Result{}, lightning.ErrorCommand{
+			Message: response.Error.Message,
+			Code:    response.Error.Code,
+			Data:    response.Error.Data,
+		}
+	}
+	return gjson.ParseBytes(response.Result), nil
+}
+
+// rpcParams are params as lightningd takes them: a single map is sent as
+// named parameters, anything else by position.
+func rpcParams(params []interface{}) interface{} {
+	if len(params) == 1 {
+		if named, ok := params[0].(map[string]interface{}); ok {
+			return named
+		}
+	}
+	if params == nil {
+		return []interface{}{}
+	}
+	return params
+}
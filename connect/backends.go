@@ -0,0 +1,207 @@
+package relampago_connect
+
+import (
+	"errors"
+
+	"github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/cliche"
+	"github.com/lnbits/relampago/clightning"
+	"github.com/lnbits/relampago/eclair"
+	"github.com/lnbits/relampago/lnbits"
+	"github.com/lnbits/relampago/lnd"
+	"github.com/lnbits/relampago/lndrest"
+	"github.com/lnbits/relampago/lnpay"
+	"github.com/lnbits/relampago/sparko"
+	"github.com/lnbits/relampago/void"
+	"github.com/lnbits/relampago/zebedee"
+)
+
+// Settings of the built-in backends, by the variables they are read from.
+// Macaroons and certificates can be given inline as a Blob instead of a path.
+
+type voidSettings struct{}
+
+type lndRESTSettings struct {
+	ConnectTimeout
+	Proxy
+	Endpoint     string `envconfig:"LND_REST_ENDPOINT" required:"true"`
+	CertPath     string `envconfig:"LND_REST_CERT"`
+	MacaroonPath string `envconfig:"LND_REST_MACAROON"`
+	Cert         Blob   `envconfig:"LND_REST_CERT_DATA"`
+	Macaroon     Blob   `envconfig:"LND_REST_MACAROON_DATA"`
+}
+
+func (s lndRESTSettings) Validate() error {
+	if s.MacaroonPath == "" && len(s.Macaroon) == 0 {
+		return errors.New("needs LND_REST_MACAROON or LND_REST_MACAROON_DATA")
+	}
+	return nil
+}
+
+type lndSettings struct {
+	ConnectTimeout
+	Proxy
+	Host         string `envconfig:"LND_HOST"`
+	CertPath     string `envconfig:"LND_CERT_PATH"`
+	MacaroonPath string `envconfig:"LND_MACAROON_PATH"`
+	Cert         Blob   `envconfig:"LND_CERT"`
+	Macaroon     Blob   `envconfig:"LND_MACAROON"`
+	ConnectURI   string `envconfig:"LND_CONNECT_URI"` // instead of all the above
+	SkipVerify   bool   `envconfig:"LND_TLS_SKIP_VERIFY"`
+}
+
+func (s lndSettings) Validate() error {
+	if s.ConnectURI != "" {
+		_, err := lnd.ParseLndConnect(s.ConnectURI)
+		return err
+	}
+	if s.Host == "" {
+		return errors.New("needs LND_HOST or LND_CONNECT_URI")
+	}
+	if s.CertPath == "" && len(s.Cert) == 0 && !s.SkipVerify {
+		return errors.New("needs LND_CERT_PATH or LND_CERT")
+	}
+	if s.MacaroonPath == "" && len(s.Macaroon) == 0 {
+		return errors.New("needs LND_MACAROON_PATH or LND_MACAROON")
+	}
+	return nil
+}
+
+type eclairSettings struct {
+	Proxy
+	Host     string `envconfig:"ECLAIR_HOST" required:"true"`
+	Password string `envconfig:"ECLAIR_PASSWORD" required:"true"`
+}
+
+type clightningSettings struct {
+	ConnectTimeout
+	RPC string `envconfig:"CLIGHTNING_RPC" required:"true"`
+}
+
+type sparkoSettings struct {
+	ConnectTimeout
+	Proxy
+	URL   string `envconfig:"SPARKO_URL" required:"true"`
+	Token string `envconfig:"SPARKO_TOKEN" required:"true"`
+}
+
+type clicheSettings struct {
+	JARPath string `envconfig:"CLICHE_JAR_PATH"`
+	DataDir string `envconfig:"CLICHE_DATADIR"`
+}
+
+type lnbitsSettings struct {
+	ConnectTimeout
+	Proxy
+	Endpoint   string `envconfig:"LNBITS_ENDPOINT" required:"true"`
+	AdminKey   string `envconfig:"LNBITS_ADMIN_KEY" required:"true"`
+	InvoiceKey string `envconfig:"LNBITS_INVOICE_KEY"`
+}
+
+type lnpaySettings struct {
+	ConnectTimeout
+	Proxy
+	Endpoint  string `envconfig:"LNPAY_API_ENDPOINT"`
+	APIKey    string `envconfig:"LNPAY_API_KEY" required:"true"`
+	WalletKey string `envconfig:"LNPAY_WALLET_KEY" required:"true"`
+}
+
+type zebedeeSettings struct {
+	ConnectTimeout
+	Proxy
+	Endpoint string `envconfig:"ZEBEDEE_API_ENDPOINT"`
+	APIKey   string `envconfig:"ZEBEDEE_API_KEY" required:"true"`
+}
+
+func init() {
+	Register("void", func(voidSettings) (relampago.Wallet, error) {
+		return void.Start()
+	})
+	Register("lndrest", func(s lndRESTSettings) (relampago.Wallet, error) {
+		return lndrest.Start(lndrest.Params{
+			Host:           s.Endpoint,
+			CertPath:       s.CertPath,
+			MacaroonPath:   s.MacaroonPath,
+			Cert:           s.Cert.PEM(),
+			Macaroon:       s.Macaroon,
+			ConnectTimeout: s.Duration(),
+			Proxy:          s.Proxy.URL,
+		})
+	})
+	Register("lnd", startLND)
+	Register("lndgrpc", startLND)
+	Register("eclair", func(s eclairSettings) (relampago.Wallet, error) {
+		return eclair.Start(eclair.Params{
+			Host:     s.Host,
+			Password: s.Password,
+			Proxy:    s.Proxy.URL,
+		})
+	})
+	Register("clightning", func(s clightningSettings) (relampago.Wallet, error) {
+		return clightning.Start(clightning.Params{
+			Path:           s.RPC,
+			ConnectTimeout: s.Duration(),
+		})
+	})
+	Register("sparko", func(s sparkoSettings) (relampago.Wallet, error) {
+		return sparko.Start(sparko.Params{
+			Host:           s.URL,
+			Key:            s.Token,
+			ConnectTimeout: s.Duration(),
+			Proxy:          s.Proxy.URL,
+		})
+	})
+	Register("cliche", func(s clicheSettings) (relampago.Wallet, error) {
+		return cliche.Start(cliche.Params{
+			JARPath: s.JARPath,
+			DataDir: s.DataDir,
+		})
+	})
+	Register("lnbits", func(s lnbitsSettings) (relampago.Wallet, error) {
+		return lnbits.Start(lnbits.Params{
+			Host:           s.Endpoint,
+			AdminKey:       s.AdminKey,
+			InvoiceKey:     s.InvoiceKey,
+			ConnectTimeout: s.Duration(),
+			Proxy:          s.Proxy.URL,
+		})
+	})
+	Register("lnpay", func(s lnpaySettings) (relampago.Wallet, error) {
+		return lnpay.Start(lnpay.Params{
+			Host:           s.Endpoint,
+			APIKey:         s.APIKey,
+			WalletKey:      s.WalletKey,
+			ConnectTimeout: s.Duration(),
+			Proxy:          s.Proxy.URL,
+		})
+	})
+	Register("zebedee", func(s zebedeeSettings) (relampago.Wallet, error) {
+		return zebedee.Start(zebedee.Params{
+			Host:           s.Endpoint,
+			APIKey:         s.APIKey,
+			ConnectTimeout: s.Duration(),
+			Proxy:          s.Proxy.URL,
+		})
+	})
+}
+
+func startLND(s lndSettings) (relampago.Wallet, error) {
+	params := lnd.Params{
+		Host:         s.Host,
+		CertPath:     s.CertPath,
+		MacaroonPath: s.MacaroonPath,
+		Cert:         s.Cert,
+		Macaroon:     s.Macaroon,
+	}
+	if s.ConnectURI != "" {
+		var err error
+		params, err = lnd.ParseLndConnect(s.ConnectURI)
+		if err != nil {
+			return nil, err
+		}
+	}
+	params.ConnectTimeout = s.Duration()
+	params.InsecureSkipVerify = s.SkipVerify
+	params.Proxy = s.Proxy.URL
+	return lnd.Start(params)
+}
@@ -0,0 +1,190 @@
+package relampago_connect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/lnbits/relampago"
+	"gopkg.in/yaml.v3"
+)
+
+// ConnectFromConfig starts every backend in the config file at path and
+// returns them by name. The format, TOML, JSON or YAML, is picked by the file
+// extension, and the file looks like
+//
+//	[backends.main]
+//	type = "lnd"
+//	lnd_host = "127.0.0.1:10009"
+//	lnd_cert_file = "/run/secrets/tls.cert"
+//	lnd_macaroon = "0201036c6e6402..."
+//
+// where each backend has a registered type and the settings that type reads
+// from the environment, named the same in any case. The whole file is checked
+// before anything is started, and if a backend fails to start the ones
+// already started are closed.
+func ConnectFromConfig(path string) (map[string]relampago.Wallet, error) {
+	backends, err := loadConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	wallets := make(map[string]relampago.Wallet, len(backends))
+	for _, name := range names {
+		b := backends[name]
+		wallet, err := b.factory.start(b.config)
+		if err != nil {
+			for _, w := range wallets {
+				w.Close()
+			}
+			return nil, fmt.Errorf("failed to start backend %q: %w", name, err)
+		}
+		wallets[name] = wallet
+	}
+	return wallets, nil
+}
+
+// configuredBackend is a backend from a config file, with its settings
+// already loaded.
+type configuredBackend struct {
+	factory factory
+	config  interface{}
+}
+
+// loadConfig parses the file at path and loads the settings of every backend
+// in it.
+func loadConfig(path string) (map[string]configuredBackend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file map[string]interface{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		_, err = toml.Decode(string(data), &file)
+	case ".json":
+		// numbers are kept as written, 1000000 instead of 1e+06
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&file)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		return nil, fmt.Errorf("unknown config format %q, use .toml, .json or .yaml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+
+	for key := range file {
+		if key != "backends" {
+			return nil, fmt.Errorf("unknown key %q, only backends is allowed", key)
+		}
+	}
+	tables, ok := file["backends"].(map[string]interface{})
+	if !ok || len(tables) == 0 {
+		return nil, errors.New("no backends configured")
+	}
+
+	backends := make(map[string]configuredBackend, len(tables))
+	for name, table := range tables {
+		settings, ok := table.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("backends.%s: must be a table of settings", name)
+		}
+		b, err := loadBackend(settings)
+		if err != nil {
+			return nil, fmt.Errorf("backends.%s: %w", name, err)
+		}
+		backends[name] = b
+	}
+	return backends, nil
+}
+
+func loadBackend(table map[string]interface{}) (configuredBackend, error) {
+	backendType, ok := table["type"].(string)
+	if !ok {
+		return configuredBackend{}, fmt.Errorf("type must be one of: %s",
+			strings.Join(Backends(), ", "))
+	}
+	f, found := lookupFactory(backendType)
+	if !found {
+		return configuredBackend{}, fmt.Errorf("unknown type %q, valid types are: %s",
+			backendType, strings.Join(Backends(), ", "))
+	}
+
+	known := make(map[string]bool)
+	for _, name := range settingNames(f.config) {
+		known[name] = true
+		known[name+"_FILE"] = true
+	}
+
+	settings := make(map[string]string, len(table))
+	for key, value := range table {
+		if key == "type" {
+			continue
+		}
+		name := strings.ToUpper(key)
+		if !known[name] {
+			return configuredBackend{}, fmt.Errorf("unknown setting %q for %s backend", key, backendType)
+		}
+		if _, dup := settings[name]; dup {
+			return configuredBackend{}, fmt.Errorf("%s is set twice", name)
+		}
+		switch v := value.(type) {
+		case string, bool, int, int64, json.Number:
+			settings[name] = fmt.Sprint(v)
+		case float64:
+			settings[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return configuredBackend{}, fmt.Errorf("%s must be a string, number or boolean", key)
+		}
+	}
+
+	if err := readSettingFiles(settings); err != nil {
+		return configuredBackend{}, err
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := settings[name]
+		return value, ok
+	}
+	config, err := f.load(backendType, lookup, func(config interface{}) error {
+		return fillSettings(config, lookup)
+	})
+	if err != nil {
+		return configuredBackend{}, err
+	}
+	return configuredBackend{factory: f, config: config}, nil
+}
+
+// readSettingFiles sets every setting given as a file, with a _FILE suffix,
+// to the contents of that file, unless it is also given inline, so secrets
+// can be kept out of config files.
+func readSettingFiles(settings map[string]string) error {
+	for key, path := range settings {
+		name := strings.TrimSuffix(key, "_FILE")
+		if name == key || path == "" || settings[name] != "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		settings[name] = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package relampago_connect
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/void"
+)
+
+const testCert = `-----BEGIN CERTIFICATE-----
+MIIBszCCAVmgAwIBAgIQGx0h
+-----END CERTIFICATE-----
+`
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.cert")
+	if err := os.WriteFile(certPath, []byte(testCert), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, content := range map[string]string{
+		"config.toml": `
+[backends.main]
+type = "lnd"
+lnd_host = "127.0.0.1:10009"
+lnd_cert_file = "` + certPath + `"
+lnd_macaroon = "0201036c6e64"
+LIGHTNING_CONNECT_TIMEOUT = 30
+
+[backends.spare]
+type = "void"
+`,
+		"config.json": `{"backends": {
+	"main": {
+		"type": "lnd",
+		"lnd_host": "127.0.0.1:10009",
+		"lnd_cert_file": "` + certPath + `",
+		"lnd_macaroon": "AgEDbG5k",
+		"LIGHTNING_CONNECT_TIMEOUT": 30
+	},
+	"spare": {"type": "void"}
+}}`,
+		"config.yaml": `
+backends:
+  main:
+    type: lnd
+    lnd_host: 127.0.0.1:10009
+    lnd_cert_file: ` + certPath + `
+    lnd_macaroon: AgEDbG5k
+    LIGHTNING_CONNECT_TIMEOUT: 30
+  spare:
+    type: void
+`,
+	} {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		backends, err := loadConfig(path)
+		if err != nil {
+			t.Errorf("%s: got %v, wanted %v", file, err, nil)
+			continue
+		}
+		if len(backends) != 2 {
+			t.Errorf("%s: got %v, wanted %v", file, len(backends), 2)
+		}
+		got := backends["main"].config.(*lndSettings)
+		if got.Host != "127.0.0.1:10009" || got.Duration().Seconds() != 30 {
+			t.Errorf("%s: got %v, wanted %v", file, got, "127.0.0.1:10009 with a 30s timeout")
+		}
+		if !bytes.Equal(got.Cert, []byte(testCert)) {
+			t.Errorf("%s: got %q, wanted %q", file, got.Cert, testCert)
+		}
+		if want := []byte{0x02, 0x01, 0x03, 'l', 'n', 'd'}; !bytes.Equal(got.Macaroon, want) {
+			t.Errorf("%s: got %x, wanted %x", file, got.Macaroon, want)
+		}
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		file    string
+		content string
+		want    string
+	}{
+		{"a.ini", ``, `unknown config format ".ini"`},
+		{"b.toml", `backends = `, "failed to parse"},
+		{"c.toml", `default = "main"`, `unknown key "default"`},
+		{"d.toml", ``, "no backends configured"},
+		{"e.toml", "[backends.main]\ntype = \"lnd2\"", `backends.main: unknown type "lnd2", valid types are: cliche,`},
+		{"f.toml", "[backends.main]\nlnd_host = \"x\"", "backends.main: type must be one of"},
+		{"g.json", `{"backends": {"main": {"type": "void", "lnd_host": "x"}}}`, `unknown setting "lnd_host" for void backend`},
+		{"h.yaml", "backends:\n  main:\n    type: sparko\n    sparko_url: http://x", "sparko backend needs SPARKO_TOKEN to be set"},
+		{"i.toml", "[backends.main]\ntype = \"lnd\"\nlnd_host = \"x\"\nlnd_cert = \"nope!\"", "invalid LND_CERT: not hex, base64 or PEM"},
+		{"j.toml", "[backends.main]\ntype = \"lnd\"\nlnd_host = \"x\"\nlnd_cert = \"00\"", "needs LND_MACAROON_PATH or LND_MACAROON"},
+		{"k.toml", "[backends.main]\ntype = \"lnd\"\nlnd_host = \"x\"\nlnd_macaroon_file = \"/nonexistent\"", "failed to read LND_MACAROON_FILE"},
+		{"l.json", `{"backends": {"main": {"type": "eclair", "eclair_host": ["x"]}}}`, "eclair_host must be a string, number or boolean"},
+	} {
+		path := filepath.Join(dir, test.file)
+		if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := ConnectFromConfig(path)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, wanted an error with %q", test.file, err, test.want)
+		}
+	}
+}
+
+func TestConnectFromConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(path, []byte("[backends.a]\ntype = \"void\"\n[backends.b]\ntype = \"void\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallets, err := ConnectFromConfig(path)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	for _, name := range []string{"a", "b"} {
+		if wallet, ok := wallets[name]; !ok || wallet.Kind() != "void" {
+			t.Errorf("got %v, wanted a void wallet named %s", wallet, name)
+		} else {
+			wallet.Close()
+		}
+	}
+}
+
+func TestLoadConfig_Numbers(t *testing.T) {
+	Register("void_timeout", func(ConnectTimeout) (relampago.Wallet, error) {
+		return void.Start()
+	})
+	t.Cleanup(func() {
+		factoriesMu.Lock()
+		delete(factories, "void_timeout")
+		factoriesMu.Unlock()
+	})
+
+	dir := t.TempDir()
+	for file, test := range map[string]struct {
+		content string
+		want    int
+	}{
+		"a.json": {`{"backends": {"main": {"type": "void_timeout", "LIGHTNING_CONNECT_TIMEOUT": 1000000}}}`, 1000000},
+		"b.json": {`{"backends": {"main": {"type": "void_timeout", "LIGHTNING_CONNECT_TIMEOUT": "010"}}}`, 10},
+		"c.toml": {"[backends.main]\ntype = \"void_timeout\"\nLIGHTNING_CONNECT_TIMEOUT = 1000000", 1000000},
+		"d.yaml": {"backends:\n  main:\n    type: void_timeout\n    LIGHTNING_CONNECT_TIMEOUT: 1000000", 1000000},
+	} {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		backends, err := loadConfig(path)
+		if err != nil {
+			t.Errorf("%s: got %v, wanted %v", file, err, nil)
+			continue
+		}
+		got := backends["main"].config.(*ConnectTimeout).ConnectTimeoutSeconds
+		if got != test.want {
+			t.Errorf("%s: got %v, wanted %v", file, got, test.want)
+		}
+	}
+}
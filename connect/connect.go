@@ -2,18 +2,17 @@ package relampago_connect
 
 import (
 	"fmt"
-	"strconv"
-	"time"
+	"os"
+	"strings"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/lnbits/relampago"
-	"github.com/lnbits/relampago/cliche"
-	"github.com/lnbits/relampago/eclair"
-	"github.com/lnbits/relampago/lnd"
-	"github.com/lnbits/relampago/sparko"
-	"github.com/lnbits/relampago/void"
 )
 
+// LightningBackendSettings are the settings Connect read before backends were
+// registered, kept for the code that fills it itself.
+//
+// Deprecated: each backend now has settings of its own, see Register.
 type LightningBackendSettings struct {
 	BackendType    string `envconfig:"LIGHTNING_BACKEND_TYPE"`
 	ConnectTimeout string `envconfig:"LIGHTNING_CONNECT_TIMEOUT" default:"15"`
@@ -32,50 +31,21 @@ type LightningBackendSettings struct {
 	ClicheDataDir string `envconfig:"CLICHE_DATADIR"`
 }
 
+// Connect starts the registered backend LIGHTNING_BACKEND_TYPE names, "void"
+// included, with its settings read from the environment.
 func Connect() (relampago.Wallet, error) {
-	var lbs LightningBackendSettings
-	err := envconfig.Process("", &lbs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to process envconfig: %w", err)
-	}
+	backendType := os.Getenv("LIGHTNING_BACKEND_TYPE")
 
-	connectTimeout, err := strconv.Atoi(lbs.ConnectTimeout)
+	f, ok := lookupFactory(backendType)
+	if !ok {
+		return nil, fmt.Errorf("unknown LIGHTNING_BACKEND_TYPE %q, valid types are: %s",
+			backendType, strings.Join(Backends(), ", "))
+	}
+	config, err := f.load(backendType, os.LookupEnv, func(config interface{}) error {
+		return envconfig.Process("", config)
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	// start lightning backend
-	switch lbs.BackendType {
-	case "lndrest":
-	case "lnd", "lndgrpc":
-		return lnd.Start(lnd.Params{
-			Host:           lbs.LNDHost,
-			CertPath:       lbs.LNDCertPath,
-			MacaroonPath:   lbs.LNDMacaroonPath,
-			ConnectTimeout: time.Duration(connectTimeout) * time.Second,
-		})
-	case "eclair":
-		return eclair.Start(eclair.Params{
-			Host:     lbs.EclairHost,
-			Password: lbs.EclairPassword,
-		})
-	case "clightning":
-	case "sparko":
-		return sparko.Start(sparko.Params{
-			Host:           lbs.SparkoURL,
-			Key:            lbs.SparkoToken,
-			ConnectTimeout: time.Duration(connectTimeout) * time.Second,
-		})
-	case "cliche":
-		return cliche.Start(cliche.Params{
-			JARPath: lbs.ClicheJARPath,
-			DataDir: lbs.ClicheDataDir,
-		})
-	case "lnbits":
-	case "lnpay":
-	case "zebedee":
-	}
-
-	// use void wallet that does nothing
-	return void.Start()
+	return f.start(config)
 }
@@ -0,0 +1,56 @@
+package relampago_connect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConnect(t *testing.T) {
+	for _, test := range []struct {
+		env  map[string]string
+		want string // in the error, or no error when empty
+	}{
+		{map[string]string{"LIGHTNING_BACKEND_TYPE": "void"}, ""},
+		{map[string]string{"LIGHTNING_BACKEND_TYPE": "lnd2"}, "valid types are: cliche, clightning, eclair,"},
+		{map[string]string{"LIGHTNING_BACKEND_TYPE": ""}, `unknown LIGHTNING_BACKEND_TYPE ""`},
+		{map[string]string{"LIGHTNING_BACKEND_TYPE": "sim"}, `unknown LIGHTNING_BACKEND_TYPE "sim"`},
+		{map[string]string{
+			"LIGHTNING_BACKEND_TYPE": "lnd",
+			"LND_HOST":               "127.0.0.1:10009",
+			"LND_CERT_PATH":          "/tmp/tls.cert",
+		}, "invalid settings for lnd backend: needs LND_MACAROON_PATH or LND_MACAROON"},
+		{map[string]string{
+			"LIGHTNING_BACKEND_TYPE": "lnd",
+			"LND_CONNECT_URI":        "https://127.0.0.1:10009",
+		}, `invalid lndconnect uri: scheme is "https"`},
+		{map[string]string{"LIGHTNING_BACKEND_TYPE": "sparko"}, "needs SPARKO_URL, SPARKO_TOKEN"},
+		{map[string]string{
+			"LIGHTNING_BACKEND_TYPE":    "lnd",
+			"LIGHTNING_CONNECT_TIMEOUT": "soon",
+			"LND_HOST":                  "127.0.0.1:10009",
+			"LND_CERT_PATH":             "/tmp/tls.cert",
+			"LND_MACAROON_PATH":         "/tmp/admin.macaroon",
+		}, "invalid settings for lnd backend"},
+	} {
+		for _, name := range []string{"LIGHTNING_BACKEND_TYPE", "LIGHTNING_CONNECT_TIMEOUT",
+			"LND_HOST", "LND_CERT_PATH", "LND_MACAROON_PATH", "LND_CONNECT_URI", "SPARKO_URL", "SPARKO_TOKEN"} {
+			t.Setenv(name, test.env[name])
+		}
+		if _, ok := test.env["LIGHTNING_CONNECT_TIMEOUT"]; !ok {
+			t.Setenv("LIGHTNING_CONNECT_TIMEOUT", "15")
+		}
+
+		wallet, err := Connect()
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("got %v, wanted %v", err, nil)
+			} else if wallet.Kind() != "void" {
+				t.Errorf("got %v, wanted %v", wallet.Kind(), "void")
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v, wanted an error with %q", err, test.want)
+		}
+	}
+}
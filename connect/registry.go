@@ -0,0 +1,111 @@
+package relampago_connect
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lnbits/relampago"
+)
+
+// factory is a registered backend: the type of its settings and how to start
+// it from a filled one.
+type factory struct {
+	config reflect.Type
+	start  func(config interface{}) (relampago.Wallet, error)
+}
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]factory)
+)
+
+// Register makes a backend available to Connect and ConnectFromConfig under
+// name, the type that selects it. Config must be a struct whose fields are
+// read with envconfig, or from the settings of the same names in a config
+// file. Fields tagged `required:"true"` must be set and not empty,
+// `default:"..."` is used for the ones that aren't, and if Config is a
+// Validator it is checked too. Backends from other modules
+// usually call it from init, so a blank import is enough to plug them in.
+//
+// Register panics if name is empty, already registered or Config isn't a
+// struct.
+func Register[Config any](name string, start func(config Config) (relampago.Wallet, error)) {
+	t := reflect.TypeOf((*Config)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("relampago_connect: %s backend config %s isn't a struct", name, t))
+	}
+	if name == "" {
+		panic("relampago_connect: Register with an empty name")
+	}
+
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("relampago_connect: Register called twice for %s backend", name))
+	}
+	factories[name] = factory{
+		config: t,
+		start: func(config interface{}) (relampago.Wallet, error) {
+			return start(*config.(*Config))
+		},
+	}
+}
+
+// Backends are the registered backend names, sorted.
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupFactory(name string) (factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	f, ok := factories[name]
+	return f, ok
+}
+
+// load fills the backend settings with fill, checking first that lookup has
+// the required ones.
+func (f factory) load(
+	name string,
+	lookup lookupFunc,
+	fill func(config interface{}) error,
+) (interface{}, error) {
+	config, missing, err := loadSettings(f.config, lookup, fill)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%s backend needs %s to be set",
+			name, strings.Join(missing, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid settings for %s backend: %w", name, err)
+	}
+	return config, nil
+}
+
+// ConnectTimeout is LIGHTNING_CONNECT_TIMEOUT, in seconds, for backend
+// settings to embed.
+type ConnectTimeout struct {
+	ConnectTimeoutSeconds int `envconfig:"LIGHTNING_CONNECT_TIMEOUT" default:"15"`
+}
+
+// Duration is the connect timeout as a time.Duration.
+func (c ConnectTimeout) Duration() time.Duration {
+	return time.Duration(c.ConnectTimeoutSeconds) * time.Second
+}
+
+// Proxy is LIGHTNING_PROXY, a SOCKS5 proxy like socks5://127.0.0.1:9050, for
+// the settings of backends that can connect through one to embed.
+type Proxy struct {
+	URL string `envconfig:"LIGHTNING_PROXY"`
+}
@@ -0,0 +1,53 @@
+package relampago_connect
+
+import (
+	"testing"
+
+	"github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/void"
+)
+
+type fakeSettings struct {
+	ConnectTimeout
+	Node  string `envconfig:"FAKE_NODE" required:"true"`
+	Label string `envconfig:"FAKE_LABEL" default:"relampago"`
+}
+
+func TestRegister(t *testing.T) {
+	var got fakeSettings
+	Register("fake", func(s fakeSettings) (relampago.Wallet, error) {
+		got = s
+		return void.Start()
+	})
+	t.Cleanup(func() {
+		factoriesMu.Lock()
+		delete(factories, "fake")
+		factoriesMu.Unlock()
+	})
+
+	t.Setenv("LIGHTNING_BACKEND_TYPE", "fake")
+	t.Setenv("LIGHTNING_CONNECT_TIMEOUT", "7")
+	t.Setenv("FAKE_NODE", "")
+	if _, err := Connect(); err == nil || err.Error() != "fake backend needs FAKE_NODE to be set" {
+		t.Errorf("got %v, wanted %v", err, "fake backend needs FAKE_NODE to be set")
+	}
+
+	t.Setenv("FAKE_NODE", "alice")
+	wallet, err := Connect()
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer wallet.Close()
+
+	want := fakeSettings{ConnectTimeout{7}, "alice", "relampago"}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("registering fake twice didn't panic")
+		}
+	}()
+	Register("fake", func(fakeSettings) (relampago.Wallet, error) { return nil, nil })
+}
@@ -0,0 +1,208 @@
+package relampago_connect
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupFunc finds the value of a setting by its variable name, like
+// os.LookupEnv.
+type lookupFunc func(name string) (string, bool)
+
+// Validator is implemented by backend settings that have rules the struct
+// tags can't say, like needing one of two settings. It is called after the
+// settings are filled.
+type Validator interface {
+	Validate() error
+}
+
+// loadSettings fills a new value of the settings struct t with fill. It
+// returns the required settings that lookup doesn't have, if any, before
+// trying to fill the rest.
+func loadSettings(
+	t reflect.Type,
+	lookup lookupFunc,
+	fill func(config interface{}) error,
+) (interface{}, []string, error) {
+	config := reflect.New(t)
+	if missing := missingSettings(t, lookup); len(missing) > 0 {
+		return nil, missing, nil
+	}
+	if err := fill(config.Interface()); err != nil {
+		return nil, nil, err
+	}
+	if v, ok := config.Interface().(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return config.Interface(), nil, nil
+}
+
+// settingName is the variable a field is read from, its envconfig tag or its
+// name, uppercased.
+func settingName(field reflect.StructField) string {
+	if name := field.Tag.Get("envconfig"); name != "" {
+		return strings.ToUpper(name)
+	}
+	return strings.ToUpper(field.Name)
+}
+
+// settingFields calls fn with every field of t that is a setting, going into
+// embedded structs.
+func settingFields(t reflect.Type, fn func(index []int, field reflect.StructField)) {
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" || field.Tag.Get("ignored") == "true" {
+				continue
+			}
+			fieldIndex := append(append([]int(nil), index...), i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				walk(field.Type, fieldIndex)
+				continue
+			}
+			fn(fieldIndex, field)
+		}
+	}
+	walk(t, nil)
+}
+
+// settingNames are the variables the settings struct t is read from.
+func settingNames(t reflect.Type) []string {
+	var names []string
+	settingFields(t, func(_ []int, field reflect.StructField) {
+		names = append(names, settingName(field))
+	})
+	return names
+}
+
+// missingSettings are the variables of the required fields of t that are
+// unset or empty.
+func missingSettings(t reflect.Type, lookup lookupFunc) []string {
+	var missing []string
+	settingFields(t, func(_ []int, field reflect.StructField) {
+		if field.Tag.Get("required") != "true" {
+			return
+		}
+		name := settingName(field)
+		if value, _ := lookup(name); value == "" {
+			missing = append(missing, name)
+		}
+	})
+	return missing
+}
+
+// fillSettings fills the settings struct config points to from lookup, the
+// way envconfig fills it from the environment.
+func fillSettings(config interface{}, lookup lookupFunc) error {
+	v := reflect.ValueOf(config).Elem()
+	var err error
+	settingFields(v.Type(), func(index []int, field reflect.StructField) {
+		if err != nil {
+			return
+		}
+		name := settingName(field)
+
+		value, _ := lookup(name)
+		if value == "" {
+			value = field.Tag.Get("default")
+		}
+		if value == "" {
+			return
+		}
+		if perr := setField(v.FieldByIndex(index), value); perr != nil {
+			err = fmt.Errorf("invalid %s: %w", name, perr)
+		}
+	})
+	return err
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(f reflect.Value, value string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch {
+	case f.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.String:
+		f.SetString(value)
+	case f.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case f.CanInt():
+		n, err := strconv.ParseInt(value, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case f.CanUint():
+		n, err := strconv.ParseUint(value, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case f.CanFloat():
+		n, err := strconv.ParseFloat(value, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.Type())
+	}
+	return nil
+}
+
+// Blob is binary data, like a macaroon or a certificate, given inline as hex
+// or base64. PEM text is kept as it is.
+type Blob []byte
+
+func (b *Blob) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if strings.HasPrefix(s, "-----BEGIN") {
+		*b = Blob(s + "\n")
+		return nil
+	}
+	if data, err := hex.DecodeString(s); err == nil {
+		*b = data
+		return nil
+	}
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if data, err := enc.DecodeString(s); err == nil {
+			*b = data
+			return nil
+		}
+	}
+	return errors.New("not hex, base64 or PEM")
+}
+
+// PEM is the certificate in b, encoded as PEM if it isn't already.
+func (b Blob) PEM() []byte {
+	if len(b) == 0 || strings.HasPrefix(string(b), "-----BEGIN") {
+		return b
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})
+}
@@ -0,0 +1,132 @@
+package relampago
+
+import "context"
+
+// ContextWallet is a Wallet whose calls take a caller-supplied context, so
+// they can be cancelled or bounded by the caller's own deadline instead of
+// the fixed timeouts used by the plain methods.
+type ContextWallet interface {
+	Wallet
+
+	GetInfoCtx(context.Context) (WalletInfo, error)
+
+	CreateInvoiceCtx(context.Context, InvoiceParams) (InvoiceData, error)
+	GetInvoiceStatusCtx(context.Context, string) (InvoiceStatus, error)
+
+	MakePaymentCtx(context.Context, PaymentParams) (PaymentData, error)
+	GetPaymentStatusCtx(context.Context, string) (PaymentStatus, error)
+
+	// PaidInvoicesStreamCtx and PaymentsStreamCtx work like their plain
+	// counterparts, but the listener is removed and the channel closed once
+	// ctx is done.
+	PaidInvoicesStreamCtx(context.Context) (<-chan InvoiceStatus, error)
+	PaymentsStreamCtx(context.Context) (<-chan PaymentStatus, error)
+}
+
+// WithContext lifts any Wallet into a ContextWallet. Wallets that already
+// implement ContextWallet are returned as they are, others are wrapped so the
+// call returns as soon as the context is done (the underlying call is left to
+// finish in the background).
+func WithContext(w Wallet) ContextWallet {
+	if cw, ok := w.(ContextWallet); ok {
+		return cw
+	}
+	return contextAdapter{w}
+}
+
+type contextAdapter struct {
+	Wallet
+}
+
+func (a contextAdapter) GetInfoCtx(ctx context.Context) (WalletInfo, error) {
+	return CallContext(ctx, a.GetInfo)
+}
+
+func (a contextAdapter) CreateInvoiceCtx(ctx context.Context, params InvoiceParams) (InvoiceData, error) {
+	return CallContext(ctx, func() (InvoiceData, error) { return a.CreateInvoice(params) })
+}
+
+func (a contextAdapter) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (InvoiceStatus, error) {
+	return CallContext(ctx, func() (InvoiceStatus, error) { return a.GetInvoiceStatus(checkingID) })
+}
+
+func (a contextAdapter) MakePaymentCtx(ctx context.Context, params PaymentParams) (PaymentData, error) {
+	return CallContext(ctx, func() (PaymentData, error) { return a.MakePayment(params) })
+}
+
+func (a contextAdapter) GetPaymentStatusCtx(ctx context.Context, checkingID string) (PaymentStatus, error) {
+	return CallContext(ctx, func() (PaymentStatus, error) { return a.GetPaymentStatus(checkingID) })
+}
+
+func (a contextAdapter) PaidInvoicesStreamCtx(ctx context.Context) (<-chan InvoiceStatus, error) {
+	src, err := a.PaidInvoicesStream()
+	if err != nil {
+		return nil, err
+	}
+	return forwardContext(ctx, src), nil
+}
+
+func (a contextAdapter) PaymentsStreamCtx(ctx context.Context) (<-chan PaymentStatus, error) {
+	src, err := a.PaymentsStream()
+	if err != nil {
+		return nil, err
+	}
+	return forwardContext(ctx, src), nil
+}
+
+// forwardContext relays src into a new channel that is closed once ctx is
+// done. The wrapped wallet can't drop the listener, so src is drained until
+// the wallet closes it, otherwise it would block on us.
+func forwardContext[T any](ctx context.Context, src <-chan T) <-chan T {
+	dst := make(chan T)
+	go func() {
+		defer func() {
+			for range src {
+			}
+		}()
+		defer close(dst)
+
+		for {
+			select {
+			case v, ok := <-src:
+				if !ok {
+					return
+				}
+				select {
+				case dst <- v:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return dst
+}
+
+// CallContext runs fn and returns its result, or the context error if ctx is
+// done first. It is meant for backends whose clients can't take a context.
+func CallContext[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
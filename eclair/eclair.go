@@ -1,26 +1,53 @@
 package eclair
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fiatjaf/eclair-go"
+	"github.com/gorilla/websocket"
 	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+	backoff "gopkg.in/cenkalti/backoff.v1"
 )
 
 type Params struct {
 	Host     string
 	Password string
+	Proxy    string // optional, a SOCKS5 proxy every connection goes through
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, gets errors from the background streams
 }
 
 type EclairWallet struct {
 	Params
+	client *http.Client
+	dialer *websocket.Dialer
+
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	mu     sync.Mutex // guards ws, so it is closed by Close or by its reader
+	ws     *websocket.Conn
+	health rp.HealthTracker
 
-	client                 *eclair.Client
-	invoiceStatusListeners []chan rp.InvoiceStatus
-	paymentStatusListeners []chan rp.PaymentStatus
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
 }
 
 func Start(params Params) (*EclairWallet, error) {
@@ -28,78 +55,382 @@ func Start(params Params) (*EclairWallet, error) {
 		params.Host = "http://" + params.Host
 	}
 
+	dial, err := rp.ProxyDialer(params.Proxy, 0)
+	if err != nil {
+		return nil, err
+	}
+	client, err := rp.HTTPClient(params.Proxy, 0)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &websocket.Dialer{
+		NetDialContext:   dial,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+	if params.Proxy == "" {
+		dialer.Proxy = http.ProxyFromEnvironment
+	}
+
+	life := rp.NewLifecycle("eclair", params.OnError)
 	e := &EclairWallet{
-		Params: params,
-		client: &eclair.Client{
-			Host:     params.Host,
-			Password: params.Password,
-		},
+		Params:   params,
+		client:   client,
+		dialer:   dialer,
+		life:     life,
+		ctx:      life.Context(),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
 	}
 
-	if ws, err := e.client.Websocket(); err != nil {
-		panic(err)
-	} else {
-		go func() {
-			for event := range ws {
-				switch event.Get("type").String() {
-				case "payment-received":
-					var msats int64
-					for _, part := range event.Get("parts").Array() {
-						msats += part.Get("amount").Int()
-					}
-
-					for _, listener := range e.invoiceStatusListeners {
-						listener <- rp.InvoiceStatus{
-							CheckingID:       event.Get("paymentHash").String(),
-							Exists:           true,
-							Paid:             true,
-							MSatoshiReceived: msats,
-						}
-					}
-				case "payment-sent":
-					var feePaid int64
-					for _, part := range event.Get("parts").Array() {
-						feePaid += part.Get("feesPaid").Int()
-					}
-
-					for _, listener := range e.paymentStatusListeners {
-						listener <- rp.PaymentStatus{
-							CheckingID: event.Get("id").String(),
-							Status:     rp.Complete,
-							FeePaid:    feePaid,
-							Preimage:   event.Get("paymentPreimage").String(),
-						}
-					}
-				}
-			}
-		}()
+	ws, err := e.dial()
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("failed to open websocket connection: %w", err)
 	}
+	e.ws = ws
+	e.health.Connected()
+	e.life.Spawn(func() { e.followWebsocket(ws) })
 
 	return e, nil
 }
 
-// Compile time check to ensure that EclairWallet fully implements rp.Wallet
-var _ rp.Wallet = (*EclairWallet)(nil)
+func (e *EclairWallet) dial() (*websocket.Conn, error) {
+	url := strings.Replace(e.Host, "http", "ws", 1) + "/ws"
+	ws, _, err := e.dialer.DialContext(e.ctx, url, http.Header{
+		"Authorization": {e.authorization()},
+	})
+	return ws, err
+}
+
+// followWebsocket reads the events from ws and, whenever the connection drops,
+// opens a new one with backoff and looks for payments received in the gap.
+func (e *EclairWallet) followWebsocket(ws *websocket.Conn) {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // never give up
+
+	for {
+		err := e.readWebsocket(ws)
+		if e.ctx.Err() != nil {
+			return
+		}
+
+		e.mu.Lock()
+		e.ws = nil
+		e.mu.Unlock()
+		ws.Close()
+
+		e.life.ReportError(fmt.Errorf("websocket disconnected, reconnecting: %w", err))
+		e.health.Disconnected(err)
+
+		for {
+			select {
+			case <-time.After(b.NextBackOff()):
+			case <-e.ctx.Done():
+				return
+			}
+
+			ws, err = e.dial()
+			if err == nil {
+				break
+			}
+			e.health.Disconnected(err)
+		}
+		b.Reset()
+
+		e.mu.Lock()
+		if e.ctx.Err() != nil {
+			e.mu.Unlock()
+			ws.Close()
+			return
+		}
+		e.ws = ws
+		e.mu.Unlock()
+
+		if reconnected, lostAt := e.health.Connected(); reconnected {
+			e.life.Spawn(func() { e.reconcile(lostAt) })
+		}
+	}
+}
+
+// reconcile publishes the payments received since the websocket was lost, as
+// they were never sent over it. Some may have been and are sent again.
+func (e *EclairWallet) reconcile(lostAt time.Time) {
+	received, err := e.receivedSince(e.ctx, uint64(lostAt.UnixMilli()))
+	if err != nil {
+		return
+	}
+	for _, status := range received {
+		e.invoices.Publish(status)
+	}
+}
+
+// Health reports whether the websocket is currently connected.
+func (e *EclairWallet) Health() rp.Health {
+	return e.health.Health()
+}
+
+func (e *EclairWallet) authorization() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(":"+e.Password))
+}
+
+// readWebsocket dispatches the events eclair sends until the connection drops
+// or the wallet is closed.
+func (e *EclairWallet) readWebsocket(ws *websocket.Conn) error {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	e.life.Spawn(func() {
+		ticker := time.NewTicker(time.Second * 29)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*5))
+			case <-stop:
+				return
+			case <-e.ctx.Done():
+				return
+			}
+		}
+	})
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		e.handleEvent(gjson.ParseBytes(message))
+	}
+}
+
+func (e *EclairWallet) handleEvent(event gjson.Result) {
+	switch event.Get("type").String() {
+	case "payment-received":
+		e.invoices.Publish(receivedToInvoiceStatus(event))
+	case "payment-sent":
+		var feePaid int64
+		for _, part := range event.Get("parts").Array() {
+			feePaid += part.Get("feesPaid").Int()
+		}
+
+		e.payments.Publish(rp.PaymentStatus{
+			CheckingID: event.Get("id").String(),
+			Status:     rp.Complete,
+			FeePaid:    feePaid,
+			Preimage:   event.Get("paymentPreimage").String(),
+		})
+	}
+}
+
+// receivedToInvoiceStatus reads a payment-received event, or an entry of the
+// same shape from audit.
+func receivedToInvoiceStatus(received gjson.Result) rp.InvoiceStatus {
+	var msats int64
+	var cursor uint64
+	for _, part := range received.Get("parts").Array() {
+		msats += part.Get("amount").Int()
+		if ts := timestampMillis(part.Get("timestamp")); ts > cursor {
+			cursor = ts
+		}
+	}
+
+	status := rp.InvoiceStatus{
+		CheckingID:       received.Get("paymentHash").String(),
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: msats,
+		State:            rp.InvoiceSettled,
+		Cursor:           cursor,
+	}
+	if cursor > 0 {
+		status.SettledAt = time.UnixMilli(int64(cursor))
+	}
+	return status
+}
+
+// timestampMillis reads eclair timestamps, which are milliseconds in older
+// versions and {"iso": ..., "unix": seconds} in newer ones.
+func timestampMillis(ts gjson.Result) uint64 {
+	if ts.IsObject() {
+		return ts.Get("unix").Uint() * 1000
+	}
+	return ts.Uint()
+}
+
+// Compile time check to ensure that EclairWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*EclairWallet)(nil)
+var _ rp.KeysendWallet = (*EclairWallet)(nil)
+var _ rp.ResumableWallet = (*EclairWallet)(nil)
+var _ rp.HealthReporter = (*EclairWallet)(nil)
+var _ rp.StreamStatsReporter = (*EclairWallet)(nil)
 
 func (e *EclairWallet) Kind() string {
 	return "eclair"
 }
 
+func (e *EclairWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		Keysend:               true,
+		MPP:                   true,
+		FeeLimits:             true, // rounded up to whole satoshis
+		InvoicePaymentHashIDs: true,
+		PaymentPaymentHashIDs: false, // payments are checked by eclair's UUID
+		Streaming:             true,
+	}
+}
+
+// Close closes the websocket and every listener channel. It is safe to call
+// more than once.
+func (e *EclairWallet) Close() error {
+	var err error
+	e.life.Close(func() {
+		// once ctx is done the reader won't set a new one
+		e.mu.Lock()
+		if e.ws != nil {
+			err = e.ws.Close()
+		}
+		e.mu.Unlock()
+	}, e.invoices.Close, e.payments.Close)
+	return err
+}
+
+// eclairErrors are the messages eclair uses for the errors in the root
+// package, checked in order.
+var eclairErrors = []struct {
+	message string
+	kind    error
+}{
+	{"route not found", rp.ErrNoRoute},
+	{"not found", rp.ErrInvoiceNotFound},
+	{"expired", rp.ErrInvoiceExpired},
+	{"already paid", rp.ErrAlreadyPaid},
+	{"insufficient funds", rp.ErrInsufficientBalance},
+	{"balance too low", rp.ErrInsufficientBalance},
+	{"invalid payment request", rp.ErrInvalidInvoice},
+	{"cannot parse", rp.ErrInvalidInvoice},
+}
+
+// mapError wraps an error eclair replied with with the matching error from the
+// root package, if there is one.
+func mapError(err error) error {
+	message := strings.ToLower(err.Error())
+	for _, e := range eclairErrors {
+		if strings.Contains(message, e.message) {
+			return rp.WrapError(e.kind, err)
+		}
+	}
+	return err
+}
+
+// call is like eclair.Client.Call, but the request is bound to ctx.
+func (e *EclairWallet) call(ctx context.Context, method string, data map[string]interface{}) (gjson.Result, error) {
+	form := url.Values{}
+	for k, v := range data {
+		form.Set(k, fmt.Sprintf("%v", v))
+	}
+
+	r, err := http.NewRequestWithContext(ctx, "POST", e.Host+"/"+method,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return gjson.Result{},
+			fmt.Errorf("error creating http request to %s: %w", e.Host, err)
+	}
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", e.authorization())
+
+	w, err := e.client.Do(r)
+	if err != nil {
+		err = fmt.Errorf("call to %s errored: %w", e.Host, err)
+		if ctx.Err() == nil {
+			err = rp.WrapError(rp.ErrBackendUnavailable, err)
+		}
+		return gjson.Result{}, err
+	}
+	defer w.Body.Close()
+
+	b, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if w.StatusCode >= 300 {
+		var errorResponse eclair.ErrorResponse
+		if err := json.Unmarshal(b, &errorResponse); err != nil {
+			text := string(b)
+			if len(text) > 200 {
+				text = text[:200]
+			}
+			return gjson.Result{},
+				fmt.Errorf("failed to decode json error response '%s': %w", text, err)
+		}
+
+		return gjson.Result{}, mapError(fmt.Errorf("eclair said: %s", errorResponse.Error))
+	}
+
+	if !gjson.ValidBytes(b) {
+		text := string(b)
+		if len(text) > 200 {
+			text = text[:200]
+		}
+		return gjson.Result{}, fmt.Errorf("failed to decode json good response '%s'", text)
+	}
+
+	return gjson.ParseBytes(b), nil
+}
+
 func (e *EclairWallet) GetInfo() (rp.WalletInfo, error) {
-	res, err := e.client.Call("channels", map[string]interface{}{})
+	return e.GetInfoCtx(context.Background())
+}
+
+func (e *EclairWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	channels, err := e.call(ctx, "channels", map[string]interface{}{})
 	if err != nil {
 		return rp.WalletInfo{}, fmt.Errorf("error calling 'channels': %w", err)
 	}
+	node, err := e.call(ctx, "getinfo", map[string]interface{}{})
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling 'getinfo': %w", err)
+	}
+	onchain, err := e.call(ctx, "onchainbalance", map[string]interface{}{})
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling 'onchainbalance': %w", err)
+	}
 
-	var balance int64
-	for _, channel := range res.Array() {
-		balance += channel.Get("data.commitments.localCommit.spec.toLocal").Int()
+	info := rp.WalletInfo{
+		Pubkey:      node.Get("nodeId").String(),
+		Alias:       node.Get("alias").String(),
+		Network:     rp.Network(node.Get("network").String()),
+		BlockHeight: uint32(node.Get("blockHeight").Uint()),
+		Version:     node.Get("version").String(),
+		Synced:      true, // eclair only serves its API once it has caught up
+		OnchainMsat: onchain.Get("confirmed").Int() * 1000,
+	}
+	for _, channel := range channels.Array() {
+		spec := channel.Get("data.commitments.localCommit.spec")
+		switch state := channel.Get("state").String(); {
+		case state == "NORMAL":
+			info.OutboundMsat += spec.Get("toLocal").Int()
+			info.InboundMsat += spec.Get("toRemote").Int()
+		case strings.HasPrefix(state, "WAIT_FOR_FUNDING"),
+			state == "WAIT_FOR_CHANNEL_READY", state == "WAIT_FOR_DUAL_FUNDING_CONFIRMED":
+			info.PendingMsat += spec.Get("toLocal").Int()
+		}
 	}
+	info.Balance = info.OutboundMsat
 
-	return rp.WalletInfo{Balance: balance}, nil
+	return info, nil
 }
 
 func (e *EclairWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return e.CreateInvoiceCtx(context.Background(), params)
+}
+
+func (e *EclairWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
 	args := map[string]interface{}{
 		"amountMsat": params.Msatoshi,
 	}
@@ -121,7 +452,7 @@ func (e *EclairWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, e
 		args["expireIn"] = params.Expiry.Seconds()
 	}
 
-	inv, err := e.client.Call("createinvoice", args)
+	inv, err := e.call(ctx, "createinvoice", args)
 	if err != nil {
 		return rp.InvoiceData{}, fmt.Errorf("'createinvoice' call failed: %w", err)
 	}
@@ -133,11 +464,15 @@ func (e *EclairWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, e
 }
 
 func (e *EclairWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
-	res, err := e.client.Call("getreceivedinfo", map[string]interface{}{
+	return e.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (e *EclairWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	res, err := e.call(ctx, "getreceivedinfo", map[string]interface{}{
 		"paymentHash": checkingID,
 	})
 	if err != nil {
-		if strings.Contains(err.Error(), "Not found") {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
 			return rp.InvoiceStatus{
 				CheckingID: checkingID,
 				Exists:     false,
@@ -148,31 +483,181 @@ func (e *EclairWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, er
 			fmt.Errorf("error on 'getreceivedinfo' hash=%s: %w", checkingID, err)
 	}
 
-	return rp.InvoiceStatus{
+	status := rp.InvoiceStatus{
 		CheckingID:       checkingID,
 		Exists:           true,
 		Paid:             res.Get("status.type").String() == "received",
 		MSatoshiReceived: res.Get("status.amount").Int(),
-	}, nil
+		Invoice:          res.Get("paymentRequest.serialized").String(),
+	}
+	status.CreatedAt, status.ExpiresAt = rp.InvoiceTimes(status.Invoice)
+	switch res.Get("status.type").String() {
+	case "received":
+		status.State = rp.InvoiceSettled
+		status.Cursor = timestampMillis(res.Get("status.receivedAt"))
+		if status.Cursor > 0 {
+			status.SettledAt = time.UnixMilli(int64(status.Cursor))
+		}
+	case "expired":
+		status.State = rp.InvoiceExpired
+	default:
+		status.State = rp.UnpaidState(status.ExpiresAt)
+	}
+	return status, nil
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (e *EclairWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return e.invoices.Stats(), e.payments.Stats()
 }
 
 func (e *EclairWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return e.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (e *EclairWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return e.invoices.Subscribe(ctx)
+}
+
+// PaidInvoicesStreamFrom replays the payments eclair's audit has received
+// since cursor, a timestamp in milliseconds, then follows the websocket.
+// Payments received in the same second as cursor can be sent again.
+func (e *EclairWallet) PaidInvoicesStreamFrom(ctx context.Context, cursor uint64) (<-chan rp.InvoiceStatus, error) {
 	listener := make(chan rp.InvoiceStatus)
-	e.invoiceStatusListeners = append(e.invoiceStatusListeners, listener)
+	ctx, cancel := context.WithCancel(ctx)
+
+	// subscribe before replaying so nothing received in between is missed,
+	// the overlap is skipped by comparing cursors. What arrives meanwhile is
+	// queued, up to a limit, so the websocket isn't held up by the replay or
+	// by this reader.
+	live, err := e.invoices.Subscribe(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	live = rp.Queue(ctx, live, rp.DefaultQueueLimit)
+
+	started := e.life.Spawn(func() {
+		defer close(listener)
+		defer cancel()
+
+		// the stream also ends when the wallet is closed
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-e.ctx.Done():
+				cancel()
+			}
+		}()
+
+		send := func(status rp.InvoiceStatus) bool {
+			select {
+			case listener <- status:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		if cursor != 0 {
+			replayed, err := e.receivedSince(ctx, cursor)
+			if err != nil {
+				return
+			}
+			for _, status := range replayed {
+				if !send(status) {
+					return
+				}
+				cursor = status.Cursor
+			}
+		}
+
+		for status := range live {
+			if status.Cursor < cursor {
+				continue
+			}
+			if !send(status) {
+				return
+			}
+		}
+	})
+	if !started {
+		cancel()
+		return nil, rp.ErrClosed
+	}
+
 	return listener, nil
 }
 
+// receivedSince lists, oldest first, the payments received from the second
+// of cursor on. Errors are retried with backoff until ctx is done.
+func (e *EclairWallet) receivedSince(ctx context.Context, cursor uint64) ([]rp.InvoiceStatus, error) {
+	exp := backoff.NewExponentialBackOff()
+	exp.MaxElapsedTime = 0 // never give up
+	b := backoff.WithContext(exp, ctx)
+
+	var res gjson.Result
+	err := backoff.RetryNotify(func() (err error) {
+		res, err = e.call(ctx, "audit", map[string]interface{}{
+			"from": cursor / 1000,
+		})
+		return err
+	}, b, func(err error, _ time.Duration) {
+		e.life.ReportError(fmt.Errorf("audit failed, trying again: %w", err))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error calling 'audit': %w", err)
+	}
+
+	var received []rp.InvoiceStatus
+	for _, payment := range res.Get("received").Array() {
+		status := receivedToInvoiceStatus(payment)
+		if status.Cursor/1000 >= cursor/1000 {
+			received = append(received, status)
+		}
+	}
+	sort.Slice(received, func(i, j int) bool {
+		return received[i].Cursor < received[j].Cursor
+	})
+	return received, nil
+}
+
 func (e *EclairWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	return e.MakePaymentCtx(context.Background(), params)
+}
+
+// DefaultMaxFeePercent limits the fees of payments when PaymentParams don't,
+// along with eclair's own flat limit for small ones.
+const DefaultMaxFeePercent = 1
+
+func (e *EclairWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if params.Timeout != 0 {
+		return rp.PaymentData{}, errors.New("eclair can't time out a payment")
+	}
+
 	args := map[string]interface{}{
 		"invoice":   params.Invoice,
 		"blocking":  false,
-		"maxFeePct": 1,
+		"maxFeePct": DefaultMaxFeePercent,
+	}
+	msatoshi := params.CustomAmount
+	if msatoshi != 0 {
+		args["amountMsat"] = msatoshi
 	}
-	if params.CustomAmount != 0 {
-		args["amountMsat"] = params.CustomAmount
+	if params.MaxFeeMsat != 0 || params.MaxFeePercent != 0 {
+		if msatoshi == 0 {
+			inv, err := decodepay.Decodepay(params.Invoice)
+			if err != nil {
+				return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+					params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+			}
+			msatoshi = inv.MSatoshi
+		}
+		limit, _ := params.FeeLimit(msatoshi)
+		setFeeLimit(args, limit)
 	}
 
-	id, err := e.client.Call("payinvoice", args)
+	id, err := e.call(ctx, "payinvoice", args)
 	if err != nil {
 		return rp.PaymentData{}, fmt.Errorf("error calling 'payinvoice' with '%s': %w",
 			params.Invoice, err)
@@ -183,8 +668,54 @@ func (e *EclairWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, err
 	}, nil
 }
 
+func (e *EclairWallet) MakeKeysend(params rp.KeysendParams) (rp.PaymentData, error) {
+	return e.MakeKeysendCtx(context.Background(), params)
+}
+
+// MakeKeysendCtx pays with sendtonode, which can't carry custom records.
+func (e *EclairWallet) MakeKeysendCtx(ctx context.Context, params rp.KeysendParams) (rp.PaymentData, error) {
+	if len(params.CustomRecords) > 0 {
+		return rp.PaymentData{}, errors.New("eclair can't send custom records")
+	}
+	if params.Timeout != 0 {
+		return rp.PaymentData{}, errors.New("eclair can't time out a payment")
+	}
+
+	args := map[string]interface{}{
+		"nodeId":     params.Destination,
+		"amountMsat": params.Msatoshi,
+		"maxFeePct":  DefaultMaxFeePercent,
+	}
+	if limit, ok := params.FeeLimit(); ok {
+		setFeeLimit(args, limit)
+	}
+
+	id, err := e.call(ctx, "sendtonode", args)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("error calling 'sendtonode' to '%s': %w",
+			params.Destination, err)
+	}
+
+	return rp.PaymentData{
+		CheckingID: id.String(),
+	}, nil
+}
+
+// setFeeLimit puts a fee limit in the args of a payment. eclair allows the
+// larger of the flat and the percentage limits, so it goes in the flat one
+// alone. That one is in whole satoshis, so the limit is rounded up and fees
+// up to 999 msat over it may be paid.
+func setFeeLimit(args map[string]interface{}, limit int64) {
+	args["maxFeeFlatSat"] = (limit + 999) / 1000
+	args["maxFeePct"] = 0
+}
+
 func (e *EclairWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
-	res, err := e.client.Call("getsentinfo", map[string]interface{}{
+	return e.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+func (e *EclairWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	res, err := e.call(ctx, "getsentinfo", map[string]interface{}{
 		"id": checkingID,
 	})
 	if err != nil {
@@ -235,7 +766,9 @@ func (e *EclairWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, er
 }
 
 func (e *EclairWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
-	listener := make(chan rp.PaymentStatus)
-	e.paymentStatusListeners = append(e.paymentStatusListeners, listener)
-	return listener, nil
+	return e.PaymentsStreamCtx(context.Background())
+}
+
+func (e *EclairWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return e.payments.Subscribe(ctx)
 }
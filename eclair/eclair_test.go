@@ -0,0 +1,487 @@
+package eclair
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/socks5test"
+)
+
+func TestClose(t *testing.T) {
+	server, connections := setupWebsocketServer(nil)
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+
+	// start, use and close the wallet twice to be sure it can be restarted
+	for i := 0; i < 2; i++ {
+		e, err := Start(Params{Host: server.URL})
+		if err != nil {
+			t.Fatalf("got %v, wanted %v", err, nil)
+		}
+
+		invoices, err := e.PaidInvoicesStream()
+		if err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+		payments, err := e.PaymentsStream()
+		if err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+
+		events := <-connections
+		events <- `{"type":"payment-received","paymentHash":"ff","parts":[{"amount":1000}]}`
+		want := rp.InvoiceStatus{
+			CheckingID:       "ff",
+			Exists:           true,
+			Paid:             true,
+			MSatoshiReceived: 1000,
+			State:            rp.InvoiceSettled,
+		}
+		if got := <-invoices; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+
+		if err := e.Close(); err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+		if _, ok := <-invoices; ok {
+			t.Errorf("invoices stream wasn't closed")
+		}
+		if _, ok := <-payments; ok {
+			t.Errorf("payments stream wasn't closed")
+		}
+		if _, err := e.PaymentsStream(); err != rp.ErrClosed {
+			t.Errorf("got %v, wanted %v", err, rp.ErrClosed)
+		}
+	}
+
+	// every goroutine started by the wallets should be gone by now
+	server.CloseClientConnections()
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("got %v goroutines, wanted %v", got, before)
+	}
+}
+
+func TestPaidInvoicesStreamFrom(t *testing.T) {
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/audit" || r.FormValue("from") != "1000" {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprint(w, `{"sent":[],"relayed":[],"received":[
+			{"paymentHash":"03","parts":[{"amount":3000,"timestamp":1002000}]},
+			{"paymentHash":"01","parts":[{"amount":1000,"timestamp":999500}]},
+			{"paymentHash":"02","parts":[{"amount":2000,"timestamp":{"iso":"","unix":1000}}]}
+		]}`)
+	})
+	defer server.Close()
+
+	e, err := Start(Params{Host: server.URL})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+
+	stream, err := e.PaidInvoicesStreamFrom(context.Background(), 1000000)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	events := <-connections
+	go func() {
+		// the first one was already replayed, but timestamps aren't unique
+		// enough to tell, so it is sent again
+		events <- `{"type":"payment-received","paymentHash":"03","parts":[{"amount":3000,"timestamp":1002000}]}`
+		events <- `{"type":"payment-received","paymentHash":"04","parts":[{"amount":4000,"timestamp":1003000}]}`
+	}()
+
+	for _, want := range []rp.InvoiceStatus{
+		{CheckingID: "02", Exists: true, Paid: true, MSatoshiReceived: 2000, Cursor: 1000000},
+		{CheckingID: "03", Exists: true, Paid: true, MSatoshiReceived: 3000, Cursor: 1002000},
+		{CheckingID: "03", Exists: true, Paid: true, MSatoshiReceived: 3000, Cursor: 1002000},
+		{CheckingID: "04", Exists: true, Paid: true, MSatoshiReceived: 4000, Cursor: 1003000},
+	} {
+		want.State = rp.InvoiceSettled
+		want.SettledAt = time.UnixMilli(int64(want.Cursor))
+		if got := <-stream; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/getinfo":
+			fmt.Fprint(w, `{"nodeId":"02aa","alias":"alice","network":"regtest","blockHeight":800,"version":"0.7.0"}`)
+		case "/onchainbalance":
+			fmt.Fprint(w, `{"confirmed":3,"unconfirmed":4}`)
+		case "/channels":
+			fmt.Fprint(w, `[
+  {"state": "NORMAL", "data": {"commitments": {"localCommit": {"spec": {"toLocal": 10000, "toRemote": 20000}}}}},
+  {"state": "WAIT_FOR_FUNDING_CONFIRMED", "data": {"commitments": {"localCommit": {"spec": {"toLocal": 5000, "toRemote": 0}}}}},
+  {"state": "CLOSING", "data": {"commitments": {"localCommit": {"spec": {"toLocal": 7000, "toRemote": 0}}}}}
+]`)
+		}
+	})
+	defer server.Close()
+
+	e, err := Start(Params{Host: server.URL})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+	<-connections
+
+	want := rp.WalletInfo{
+		Balance:      10000,
+		Pubkey:       "02aa",
+		Alias:        "alice",
+		Network:      rp.Regtest,
+		BlockHeight:  800,
+		Synced:       true,
+		Version:      "0.7.0",
+		OutboundMsat: 10000,
+		InboundMsat:  20000,
+		PendingMsat:  5000,
+		OnchainMsat:  3000,
+	}
+	got, err := e.GetInfo()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestGetInvoiceStatus(t *testing.T) {
+	invoice := "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3"
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("paymentHash") {
+		case "ff":
+			fmt.Fprintf(w, `{"paymentRequest":{"serialized":"%s"},"status":{"type":"expired"}}`, invoice)
+		case "ee":
+			fmt.Fprintf(w, `{"paymentRequest":{"serialized":"%s"},"status":{"type":"received","amount":1000,"receivedAt":{"iso":"2021-12-05T15:00:00Z","unix":1638716400}}}`, invoice)
+		}
+	})
+	defer server.Close()
+
+	e, err := Start(Params{Host: server.URL})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+	<-connections
+
+	for _, want := range []rp.InvoiceStatus{
+		{CheckingID: "ff", Exists: true, State: rp.InvoiceExpired},
+		{
+			CheckingID:       "ee",
+			Exists:           true,
+			Paid:             true,
+			MSatoshiReceived: 1000,
+			State:            rp.InvoiceSettled,
+			SettledAt:        time.Unix(1638716400, 0),
+			Cursor:           1638716400000,
+		},
+	} {
+		want.Invoice = invoice
+		want.CreatedAt = time.Unix(1638716301, 0)
+		want.ExpiresAt = time.Unix(1638802701, 0)
+		got, err := e.GetInvoiceStatus(want.CheckingID)
+		if err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	response := make(chan string, 1)
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, <-response)
+	})
+	defer server.Close()
+
+	e, err := Start(Params{Host: server.URL})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+	<-connections
+
+	tests := []struct {
+		response string
+		want     error
+	}{
+		{`{"error":"route not found"}`, rp.ErrNoRoute},
+		{`{"error":"payment request has expired"}`, rp.ErrInvoiceExpired},
+		{`{"error":"invoice already paid"}`, rp.ErrAlreadyPaid},
+		{`{"error":"insufficient funds"}`, rp.ErrInsufficientBalance},
+		{`{"error":"cannot parse lnbc1garbage"}`, rp.ErrInvalidInvoice},
+	}
+	for _, test := range tests {
+		response <- test.response
+		_, err := e.MakePayment(rp.PaymentParams{Invoice: "lnbc1"})
+		if !errors.Is(err, test.want) {
+			t.Errorf("got %v, wanted %v", err, test.want)
+		}
+	}
+
+	// not found is how eclair says an invoice doesn't exist
+	response <- `{"error":"Not found"}`
+	want := rp.InvoiceStatus{CheckingID: "ff", Exists: false}
+	got, err := e.GetInvoiceStatus("ff")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	down := &EclairWallet{Params: Params{Host: "http://127.0.0.1:1"}, client: http.DefaultClient}
+	_, err = down.GetInfo()
+	if !errors.Is(err, rp.ErrBackendUnavailable) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrBackendUnavailable)
+	}
+}
+
+func TestMakePayment_Limits(t *testing.T) {
+	forms := make(chan url.Values, 1)
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/payinvoice" {
+			r.ParseForm()
+			forms <- r.PostForm
+		}
+		fmt.Fprint(w, `"d8f6a1f2-26d2-4a64-b4f4-2e1b4d7f8a11"`)
+	})
+	defer server.Close()
+
+	e, err := Start(Params{Host: server.URL})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+	<-connections
+
+	tests := []struct {
+		params      rp.PaymentParams
+		wantFlatSat string
+		wantPct     string
+	}{
+		{rp.PaymentParams{}, "", "1"},
+		{rp.PaymentParams{CustomAmount: 100000, MaxFeePercent: 2}, "2", "0"},
+		{rp.PaymentParams{CustomAmount: 100000, MaxFeeMsat: 1500}, "2", "0"},
+		{rp.PaymentParams{CustomAmount: 100000, MaxFeeMsat: 1000}, "1", "0"},
+		{rp.PaymentParams{CustomAmount: 100000, MaxFeeMsat: 1}, "1", "0"},
+	}
+	for _, test := range tests {
+		test.params.Invoice = "lnbc1"
+		if _, err := e.MakePayment(test.params); err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+			continue
+		}
+		form := <-forms
+		if got := form.Get("maxFeeFlatSat"); got != test.wantFlatSat {
+			t.Errorf("got %v, wanted %v", got, test.wantFlatSat)
+		}
+		if got := form.Get("maxFeePct"); got != test.wantPct {
+			t.Errorf("got %v, wanted %v", got, test.wantPct)
+		}
+	}
+
+	_, err = e.MakePayment(rp.PaymentParams{Invoice: "lnbc1", Timeout: time.Minute})
+	if err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+}
+
+func TestMakeKeysend(t *testing.T) {
+	forms := make(chan url.Values, 1)
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sendtonode" {
+			r.ParseForm()
+			forms <- r.PostForm
+		}
+		fmt.Fprint(w, `"d8f6a1f2-26d2-4a64-b4f4-2e1b4d7f8a11"`)
+	})
+	defer server.Close()
+
+	e, err := Start(Params{Host: server.URL})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+	<-connections
+
+	got, err := e.MakeKeysend(rp.KeysendParams{Destination: "02abcd", Msatoshi: 5000})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if want := "d8f6a1f2-26d2-4a64-b4f4-2e1b4d7f8a11"; got.CheckingID != want {
+		t.Errorf("got %v, wanted %v", got.CheckingID, want)
+	}
+	form := <-forms
+	if form.Get("nodeId") != "02abcd" || form.Get("amountMsat") != "5000" {
+		t.Errorf("got %v, wanted nodeId 02abcd and amountMsat 5000", form)
+	}
+
+	_, err = e.MakeKeysend(rp.KeysendParams{
+		Destination:   "02abcd",
+		Msatoshi:      5000,
+		CustomRecords: map[uint64][]byte{7629169: []byte("{}")},
+	})
+	if err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/audit" {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprintf(w, `{"sent":[],"relayed":[],"received":[
+			{"paymentHash":"01","parts":[{"amount":1000,"timestamp":1000}]},
+			{"paymentHash":"02","parts":[{"amount":2000,"timestamp":%d}]}
+		]}`, time.Now().UnixMilli())
+	})
+	defer server.Close()
+
+	errs := make(chan error, 10)
+	onError := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	e, err := Start(Params{Host: server.URL, OnError: onError})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+
+	invoices, err := e.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	// drop the first connection
+	close(<-connections)
+	<-connections
+
+	// the payment received while it was down is found
+	got := <-invoices
+	if got.CheckingID != "02" || got.MSatoshiReceived != 2000 {
+		t.Errorf("got %v, wanted the payment received in the gap", got)
+	}
+
+	health := e.Health()
+	if !health.Connected || health.Reconnects != 1 || health.LastError == nil {
+		t.Errorf("got %+v, wanted a connection that was reconnected once", health)
+	}
+	if len(errs) == 0 {
+		t.Errorf("got no errors, wanted the disconnection reported")
+	}
+}
+
+func TestStart_Proxy(t *testing.T) {
+	server, connections := setupWebsocketServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"nodeId":"02aa"}`)
+	})
+	defer server.Close()
+
+	proxy := socks5test.NewServer(t, "user", "secret")
+	proxy.AddHost("eclair.onion:8080", server.Listener.Addr().String())
+
+	e, err := Start(Params{Host: "http://eclair.onion:8080", Proxy: proxy.URL()})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer e.Close()
+	<-connections
+
+	if _, err := e.call(context.Background(), "getinfo", nil); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	// the websocket and the call
+	want := []string{"eclair.onion:8080", "eclair.onion:8080"}
+	if got := proxy.Targets(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+// setupWebsocketServer returns a fake eclair that, for every websocket
+// connection, hands out a channel whose messages are written to it, closing it
+// drops the connection. Other calls are given to rpc.
+func setupWebsocketServer(rpc http.HandlerFunc) (*httptest.Server, chan chan string) {
+	connections := make(chan chan string)
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" && rpc != nil {
+			rpc(w, r)
+			return
+		}
+		if r.URL.Path != "/ws" {
+			http.NotFound(w, r)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		events := make(chan string)
+		select {
+		case connections <- events:
+		case <-closed:
+			return
+		}
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				conn.WriteMessage(websocket.TextMessage, []byte(event))
+			case <-closed:
+				return
+			}
+		}
+	}))
+
+	return server, connections
+}
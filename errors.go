@@ -0,0 +1,37 @@
+package relampago
+
+import "errors"
+
+// ErrClosed is returned by wallets that were already closed.
+var ErrClosed = errors.New("wallet is closed")
+
+// Backends map the errors their nodes give onto these, so callers can check
+// for them with errors.Is without knowing which backend they're talking to.
+var (
+	ErrInvoiceNotFound     = errors.New("invoice not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrInvoiceExpired      = errors.New("invoice expired")
+	ErrAlreadyPaid         = errors.New("invoice already paid")
+	ErrNoRoute             = errors.New("no route found")
+	ErrBackendUnavailable  = errors.New("backend unavailable")
+	ErrInvalidInvoice      = errors.New("invalid invoice")
+)
+
+// WrapError marks err as being of kind, one of the errors above. The result
+// reads like err and still unwraps to it, so both errors.Is(result, kind) and
+// errors.As on the native error work.
+func WrapError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string        { return e.err.Error() }
+func (e *kindError) Unwrap() error        { return e.err }
+func (e *kindError) Is(target error) bool { return target == e.kind }
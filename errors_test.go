@@ -0,0 +1,28 @@
+package relampago
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestWrapError(t *testing.T) {
+	err := fmt.Errorf("error calling pay: %w", WrapError(ErrNoRoute, io.EOF))
+
+	if !errors.Is(err, ErrNoRoute) {
+		t.Errorf("got %v, wanted %v", err, ErrNoRoute)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, wanted %v", err, io.EOF)
+	}
+	if errors.Is(err, ErrInvoiceExpired) {
+		t.Errorf("got %v, wanted anything but %v", err, ErrInvoiceExpired)
+	}
+	if got, want := err.Error(), "error calling pay: EOF"; got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	if WrapError(ErrNoRoute, nil) != nil {
+		t.Errorf("got an error wrapping nil")
+	}
+}
@@ -0,0 +1,67 @@
+package relampago
+
+import (
+	"sync"
+	"time"
+)
+
+// Health describes the connection a wallet keeps to its backend's event feed,
+// which is what its streams depend on.
+type Health struct {
+	Connected  bool      `json:"connected"`
+	Since      time.Time `json:"since"` // when Connected last changed
+	LastError  error     `json:"-"`     // why it was last disconnected
+	Reconnects int       `json:"reconnects"`
+}
+
+// HealthReporter is implemented by wallets that follow a live event feed and
+// reconnect to it on their own.
+type HealthReporter interface {
+	Health() Health
+}
+
+// HealthTracker keeps the Health of an event feed as the backends connect to
+// it and lose it. The zero value is a feed that was never connected.
+type HealthTracker struct {
+	mu        sync.Mutex
+	health    Health
+	connected bool // at least once
+}
+
+// Connected marks the feed as connected. If it was connected before it also
+// returns when it was lost, so the caller can look for anything it missed.
+func (t *HealthTracker) Connected() (reconnected bool, lostAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.health.Connected {
+		return false, time.Time{}
+	}
+	reconnected, lostAt = t.connected, t.health.Since
+	if reconnected {
+		t.health.Reconnects++
+	}
+	t.connected = true
+	t.health.Connected = true
+	t.health.Since = time.Now()
+	return reconnected, lostAt
+}
+
+// Disconnected marks the feed as lost because of err. It can be called again
+// with the errors of failed attempts to reconnect.
+func (t *HealthTracker) Disconnected(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.health.Connected || t.health.Since.IsZero() {
+		t.health.Connected = false
+		t.health.Since = time.Now()
+	}
+	t.health.LastError = err
+}
+
+func (t *HealthTracker) Health() Health {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.health
+}
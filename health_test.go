@@ -0,0 +1,34 @@
+package relampago
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHealthTracker(t *testing.T) {
+	var tracker HealthTracker
+
+	// failing to connect at first isn't a reconnection
+	tracker.Disconnected(errors.New("connection refused"))
+	if reconnected, _ := tracker.Connected(); reconnected {
+		t.Errorf("got %v, wanted %v", reconnected, false)
+	}
+
+	lost := errors.New("connection reset")
+	tracker.Disconnected(lost)
+	lostAt := tracker.Health().Since
+	tracker.Disconnected(errors.New("connection refused"))
+	if got := tracker.Health().Since; got != lostAt {
+		t.Errorf("got %v, wanted %v", got, lostAt)
+	}
+
+	reconnected, gotLostAt := tracker.Connected()
+	if !reconnected || gotLostAt != lostAt {
+		t.Errorf("got %v %v, wanted %v %v", reconnected, gotLostAt, true, lostAt)
+	}
+
+	health := tracker.Health()
+	if !health.Connected || health.Reconnects != 1 || health.LastError.Error() != "connection refused" {
+		t.Errorf("got %+v, wanted connected after 1 reconnection", health)
+	}
+}
@@ -0,0 +1,125 @@
+// Package httpjson calls the JSON APIs of the custodial backends, which all
+// take a key in a header and explain their errors with a message.
+package httpjson
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/tidwall/gjson"
+)
+
+// Errors are the messages an API uses for the errors in the root package,
+// in lower case, checked in order.
+type Errors []struct {
+	Message string
+	Kind    error
+}
+
+// Client calls the API at Host.
+type Client struct {
+	HTTP *http.Client
+	Host string
+
+	Name         string // of the backend, for errors
+	Header       string // the key goes in, like X-Api-Key
+	MessageField string // of the replies that explains errors
+	Errors       Errors
+
+	Timeout time.Duration // optional, for calls whose ctx has no deadline
+}
+
+// MapError wraps an error the API replied with, with code, with the matching
+// error from the root package, if there is one.
+func (c *Client) MapError(code int, err error) error {
+	message := strings.ToLower(err.Error())
+	for _, e := range c.Errors {
+		if strings.Contains(message, e.Message) {
+			return rp.WrapError(e.Kind, err)
+		}
+	}
+	switch code {
+	case 404:
+		return rp.WrapError(rp.ErrInvoiceNotFound, err)
+	case 502, 503, 504:
+		return rp.WrapError(rp.ErrBackendUnavailable, err)
+	}
+	return err
+}
+
+// Call makes a request with key, bounded by ctx or by Timeout when ctx has no
+// deadline, and gives the JSON reply. body is sent as JSON.
+func (c *Client) Call(
+	ctx context.Context,
+	method, path, key string,
+	body interface{},
+) (gjson.Result, error) {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return gjson.Result{}, fmt.Errorf("failed to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, c.Host+path, reqBody)
+	if err != nil {
+		return gjson.Result{},
+			fmt.Errorf("error creating http request to %s: %w", c.Host, err)
+	}
+	r.Header.Set(c.Header, key)
+	r.Header.Set("Content-Type", "application/json")
+
+	w, err := c.HTTP.Do(r)
+	if err != nil {
+		err = fmt.Errorf("call to %s errored: %w", c.Host, err)
+		if ctx.Err() == nil {
+			err = rp.WrapError(rp.ErrBackendUnavailable, err)
+		}
+		return gjson.Result{}, err
+	}
+	defer w.Body.Close()
+
+	b, err := io.ReadAll(w.Body)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if w.StatusCode >= 300 {
+		message := gjson.GetBytes(b, c.MessageField).String()
+		if message == "" {
+			message = truncate(b)
+		}
+		return gjson.Result{}, c.MapError(w.StatusCode,
+			fmt.Errorf("%s said (%d): %s", c.Name, w.StatusCode, message))
+	}
+
+	if !gjson.ValidBytes(b) {
+		return gjson.Result{}, fmt.Errorf("failed to decode json good response '%s'", truncate(b))
+	}
+
+	return gjson.ParseBytes(b), nil
+}
+
+// truncate keeps replies short enough for errors.
+func truncate(b []byte) string {
+	text := string(b)
+	if len(text) > 200 {
+		text = text[:200]
+	}
+	return text
+}
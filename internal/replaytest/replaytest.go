@@ -0,0 +1,43 @@
+// Package replaytest serves replies recorded from the APIs of the custodial
+// backends, so they can be tested offline.
+package replaytest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Responses are the replies recorded in the testdata of the package under
+// test, by method and path, like "GET /wallet".
+type Responses map[string]struct {
+	Code int
+	File string
+}
+
+// Server replays responses to requests carrying key in header, failing t on
+// any other request. It is closed when t is done.
+func Server(t *testing.T, header, key string, responses Responses) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get(header); got != key {
+			t.Errorf("got %v, wanted %v", got, key)
+		}
+
+		res, ok := responses[r.Method+" "+r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(500)
+			return
+		}
+		body, err := os.ReadFile(filepath.Join("testdata", res.File))
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(res.Code)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
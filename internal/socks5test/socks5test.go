@@ -0,0 +1,266 @@
+// Package socks5test is a SOCKS5 proxy for testing that backends send every
+// connection through the proxy they are given.
+package socks5test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Server is a SOCKS5 proxy that only does CONNECT, and remembers every address
+// it was asked to connect to.
+type Server struct {
+	Addr string // host:port it listens on
+
+	user, password string            // required when user is set
+	hosts          map[string]string // addresses only the proxy can reach
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	conns   map[net.Conn]struct{}
+	targets []string
+}
+
+// NewServer starts a proxy that is closed when the test ends. The user and
+// password, when not empty, are required from clients.
+func NewServer(t testing.TB, user, password string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		user:     user,
+		password: password,
+		hosts:    make(map[string]string),
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// URL is what backends take as their proxy setting.
+func (s *Server) URL() string {
+	if s.user != "" {
+		return "socks5://" + s.user + ":" + s.password + "@" + s.Addr
+	}
+	return "socks5://" + s.Addr
+}
+
+// AddHost makes name, a host:port like an .onion address that can't be
+// resolved locally, connect to addr when asked through the proxy.
+func (s *Server) AddHost(name, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hosts[name] = addr
+}
+
+// Targets are the addresses clients asked to connect to, in order.
+func (s *Server) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+// Close stops the proxy and drops every connection through it.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+	conn.Close()
+}
+
+func (s *Server) handle(conn net.Conn) {
+	if err := s.negotiate(conn); err != nil {
+		return
+	}
+
+	target, err := readRequest(conn)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	addr, ok := s.hosts[target]
+	s.mu.Unlock()
+	if !ok {
+		addr = target
+	}
+
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}) // connection refused
+		return
+	}
+	if !s.track(upstream) {
+		return
+	}
+	defer s.untrack(upstream)
+
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(upstream, conn); done <- struct{}{} }()
+	go func() { io.Copy(conn, upstream); done <- struct{}{} }()
+	<-done
+}
+
+// negotiate picks the authentication method and checks the credentials.
+func (s *Server) negotiate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != 5 {
+		return errors.New("not socks5")
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	want := byte(0) // no authentication
+	if s.user != "" {
+		want = 2 // username and password
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{5, want}); err != nil {
+		return err
+	}
+	if want == 0 {
+		return nil
+	}
+
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return err
+	}
+	user, err := readString(conn)
+	if err != nil {
+		return err
+	}
+	password, err := readString(conn)
+	if err != nil {
+		return err
+	}
+	if user != s.user || password != s.password {
+		conn.Write([]byte{1, 1})
+		return errors.New("wrong credentials")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
+
+// readRequest reads a CONNECT request and returns the address it is for.
+func readRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != 5 || header[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0}) // command not supported
+		return "", errors.New("only CONNECT is supported")
+	}
+
+	var host string
+	switch header[3] {
+	case 1, 4: // IPv4, IPv6
+		ip := make(net.IP, 4)
+		if header[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3: // domain name
+		name, err := readString(conn)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		return "", errors.New("unknown address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readString reads a string prefixed by its length in one byte.
+func readString(conn net.Conn) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", err
+	}
+	s := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
@@ -0,0 +1,27 @@
+package relampago
+
+import (
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+// InvoiceTimes are when bolt11 was created and when it expires, both zero
+// when it can't be decoded.
+func InvoiceTimes(bolt11 string) (createdAt, expiresAt time.Time) {
+	inv, err := decodepay.Decodepay(bolt11)
+	if err != nil {
+		return time.Time{}, time.Time{}
+	}
+	createdAt = time.Unix(int64(inv.CreatedAt), 0)
+	return createdAt, createdAt.Add(time.Duration(inv.Expiry) * time.Second)
+}
+
+// UnpaidState is the state of an invoice that wasn't paid and expires at
+// expiresAt, for backends that don't tell open and expired invoices apart.
+func UnpaidState(expiresAt time.Time) InvoiceState {
+	if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+		return InvoiceExpired
+	}
+	return InvoiceOpen
+}
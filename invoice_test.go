@@ -0,0 +1,37 @@
+package relampago
+
+import (
+	"testing"
+	"time"
+)
+
+const invoice = "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3"
+
+func TestInvoiceTimes(t *testing.T) {
+	createdAt, expiresAt := InvoiceTimes(invoice)
+	if want := time.Unix(1638716301, 0); !createdAt.Equal(want) {
+		t.Errorf("got %v, wanted %v", createdAt, want)
+	}
+	if want := time.Unix(1638802701, 0); !expiresAt.Equal(want) {
+		t.Errorf("got %v, wanted %v", expiresAt, want)
+	}
+
+	if createdAt, expiresAt := InvoiceTimes("lnbc1"); !createdAt.IsZero() || !expiresAt.IsZero() {
+		t.Errorf("got %v and %v, wanted zero times", createdAt, expiresAt)
+	}
+}
+
+func TestUnpaidState(t *testing.T) {
+	for _, test := range []struct {
+		expiresAt time.Time
+		want      InvoiceState
+	}{
+		{time.Time{}, InvoiceOpen},
+		{time.Now().Add(time.Minute), InvoiceOpen},
+		{time.Now().Add(-time.Minute), InvoiceExpired},
+	} {
+		if got := UnpaidState(test.expiresAt); got != test.want {
+			t.Errorf("got %v, wanted %v", got, test.want)
+		}
+	}
+}
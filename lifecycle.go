@@ -0,0 +1,84 @@
+package relampago
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Lifecycle runs the background goroutines of a wallet until it is closed,
+// when they are all stopped and waited for. Use NewLifecycle to make one.
+type Lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+
+	name    string      // of the backend, for logs
+	onError func(error) // optional
+}
+
+// NewLifecycle starts the lifecycle of a wallet of the kind name. Errors from
+// its background goroutines go to onError, or are logged if it is nil.
+func NewLifecycle(name string, onError func(error)) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		ctx:     ctx,
+		cancel:  cancel,
+		name:    name,
+		onError: onError,
+	}
+}
+
+// Context is done once the wallet is closed.
+func (lc *Lifecycle) Context() context.Context {
+	return lc.ctx
+}
+
+// Spawn runs fn in a goroutine that Close will wait for. Nothing is run after
+// the wallet is closed, in which case it returns false.
+func (lc *Lifecycle) Spawn(fn func()) bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.ctx.Err() != nil {
+		return false
+	}
+	lc.wg.Add(1)
+	go func() {
+		defer lc.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// Close cancels the Context, calls release, then waits for every goroutine
+// to be done. release should close the broadcasters of the wallet, which
+// also frees the goroutines blocked on slow listeners. It returns false when
+// the wallet was already closed, in which case release isn't called.
+func (lc *Lifecycle) Close(release ...func()) bool {
+	lc.mu.Lock()
+	if lc.ctx.Err() != nil {
+		lc.mu.Unlock()
+		return false
+	}
+	lc.cancel()
+	lc.mu.Unlock()
+
+	for _, fn := range release {
+		fn()
+	}
+	lc.wg.Wait()
+
+	return true
+}
+
+// ReportError gives errors from the background goroutines to the onError of
+// NewLifecycle, or logs them if there is none.
+func (lc *Lifecycle) ReportError(err error) {
+	if lc.onError != nil {
+		lc.onError(err)
+		return
+	}
+	log.Print(lc.name, ": ", err)
+}
@@ -0,0 +1,46 @@
+package relampago
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLifecycle(t *testing.T) {
+	var reported []error
+	lc := NewLifecycle("test", func(err error) { reported = append(reported, err) })
+
+	stopped := make(chan struct{})
+	if !lc.Spawn(func() {
+		<-lc.Context().Done()
+		close(stopped)
+	}) {
+		t.Errorf("got %v, wanted %v", false, true)
+	}
+
+	released := 0
+	if !lc.Close(func() { released++ }) {
+		t.Errorf("got %v, wanted %v", false, true)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Errorf("Close returned before the goroutine was done")
+	}
+
+	// closing again and spawning after it do nothing
+	if lc.Close(func() { released++ }) {
+		t.Errorf("got %v, wanted %v", true, false)
+	}
+	if released != 1 {
+		t.Errorf("got %v, wanted %v", released, 1)
+	}
+	if lc.Spawn(func() { t.Errorf("ran after Close") }) {
+		t.Errorf("got %v, wanted %v", true, false)
+	}
+
+	err := errors.New("stream broke")
+	lc.ReportError(err)
+	if len(reported) != 1 || reported[0] != err {
+		t.Errorf("got %v, wanted %v", reported, []error{err})
+	}
+}
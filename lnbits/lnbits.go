@@ -0,0 +1,477 @@
+package lnbits
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/httpjson"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	sse "github.com/r3labs/sse/v2"
+	"github.com/tidwall/gjson"
+	backoff "gopkg.in/cenkalti/backoff.v1"
+)
+
+// PaymentPollInterval is how often the status of a payment is checked while
+// it is pending, and how long to wait before trying again after errors.
+var PaymentPollInterval = 5 * time.Second
+
+// TrackPaymentRetryLimit is for how long a payment is followed before it is
+// published with an Unknown status.
+var TrackPaymentRetryLimit = 15 * time.Minute
+
+// PayTimeout is how long the call that pays an invoice, which only returns
+// once it is done, is waited for before the payment is followed by polling.
+var PayTimeout = time.Minute
+
+type Params struct {
+	Host           string
+	AdminKey       string // needed for paying
+	InvoiceKey     string // optional when there is an AdminKey
+	ConnectTimeout time.Duration
+	Proxy          string // optional, a SOCKS5 proxy every connection goes through
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, gets errors from the background streams
+}
+
+type LNbitsWallet struct {
+	Params
+	client *http.Client
+	api    *httpjson.Client
+
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	health rp.HealthTracker
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+}
+
+func Start(params Params) (*LNbitsWallet, error) {
+	if !strings.HasPrefix(params.Host, "http") {
+		params.Host = "https://" + params.Host
+	}
+	params.Host = strings.TrimSuffix(params.Host, "/")
+	if params.InvoiceKey == "" {
+		params.InvoiceKey = params.AdminKey
+	}
+
+	client, err := rp.HTTPClient(params.Proxy, params.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLNbitsWallet(params, client)
+	if _, err := l.GetInfo(); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to get wallet from %s: %w", params.Host, err)
+	}
+	l.life.Spawn(l.followEvents)
+
+	return l, nil
+}
+
+func newLNbitsWallet(params Params, client *http.Client) *LNbitsWallet {
+	life := rp.NewLifecycle("lnbits", params.OnError)
+	return &LNbitsWallet{
+		Params: params,
+		client: client,
+		api: &httpjson.Client{
+			HTTP:         client,
+			Host:         params.Host,
+			Name:         "lnbits",
+			Header:       "X-Api-Key",
+			MessageField: "detail",
+			Errors:       lnbitsErrors,
+			Timeout:      params.ConnectTimeout,
+		},
+		life:     life,
+		ctx:      life.Context(),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+	}
+}
+
+// followEvents subscribes to the SSE stream of payments and, whenever it
+// drops, subscribes again with backoff and looks for invoices paid in the gap.
+func (l *LNbitsWallet) followEvents() {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // never give up
+
+	sseClient := sse.NewClient(l.Host + "/api/v1/payments/sse")
+	sseClient.Connection = l.client
+	sseClient.Headers["X-Api-Key"] = l.InvoiceKey
+	sseClient.ReconnectStrategy = &backoff.StopBackOff{} // we retry here instead
+	sseClient.ResponseValidator = func(_ *sse.Client, resp *http.Response) error {
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return fmt.Errorf("could not connect to stream: %s", resp.Status)
+		}
+
+		b.Reset()
+		if reconnected, lostAt := l.health.Connected(); reconnected {
+			l.life.Spawn(func() { l.reconcile(lostAt) })
+		}
+		return nil
+	}
+
+	for {
+		err := sseClient.SubscribeWithContext(l.ctx, "", l.handleEvent)
+		if l.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("stream ended")
+		}
+		l.life.ReportError(fmt.Errorf("stream disconnected, reconnecting: %w", err))
+		l.health.Disconnected(err)
+
+		select {
+		case <-time.After(b.NextBackOff()):
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *LNbitsWallet) handleEvent(ev *sse.Event) {
+	if string(ev.Event) != "payment-received" {
+		return
+	}
+
+	payment := gjson.ParseBytes(ev.Data)
+	if payment.Get("amount").Int() > 0 && !payment.Get("pending").Bool() {
+		l.invoices.Publish(paymentToInvoiceStatus(payment))
+	}
+}
+
+// reconcile publishes the invoices paid since the stream was lost, as their
+// events were never received. Some may have been and are sent again.
+func (l *LNbitsWallet) reconcile(lostAt time.Time) {
+	res, err := l.call(l.ctx, "GET", "/api/v1/payments?limit=100", l.InvoiceKey, nil)
+	if err != nil {
+		l.life.ReportError(fmt.Errorf("failed to look for invoices paid while disconnected: %w", err))
+		return
+	}
+
+	for _, payment := range res.Array() {
+		if payment.Get("amount").Int() > 0 && !payment.Get("pending").Bool() &&
+			!paymentTime(payment.Get("time")).Before(lostAt.Truncate(time.Second)) {
+			l.invoices.Publish(paymentToInvoiceStatus(payment))
+		}
+	}
+}
+
+// paymentToInvoiceStatus reads an incoming payment from the list or the SSE
+// stream, which have the same shape. LNbits doesn't tell when they were
+// paid.
+func paymentToInvoiceStatus(payment gjson.Result) rp.InvoiceStatus {
+	status := rp.InvoiceStatus{
+		CheckingID:       payment.Get("payment_hash").String(),
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: payment.Get("amount").Int(),
+		State:            rp.InvoiceSettled,
+		Invoice:          payment.Get("bolt11").String(),
+	}
+	status.CreatedAt, status.ExpiresAt = rp.InvoiceTimes(status.Invoice)
+	return status
+}
+
+// paymentTime reads payment times, which are unix timestamps in older LNbits
+// versions and ISO dates in newer ones.
+func paymentTime(ts gjson.Result) time.Time {
+	if ts.Type == gjson.String {
+		t, _ := time.Parse(time.RFC3339, ts.String())
+		return t
+	}
+	return time.Unix(ts.Int(), 0)
+}
+
+// Health reports whether the SSE stream is currently connected.
+func (l *LNbitsWallet) Health() rp.Health {
+	return l.health.Health()
+}
+
+// Compile time check to ensure that LNbitsWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*LNbitsWallet)(nil)
+var _ rp.HealthReporter = (*LNbitsWallet)(nil)
+var _ rp.StreamStatsReporter = (*LNbitsWallet)(nil)
+
+func (l *LNbitsWallet) Kind() string {
+	return "lnbits"
+}
+
+func (l *LNbitsWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		InvoicePaymentHashIDs: true,
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Close stops the SSE subscription and closes every listener channel. It is
+// safe to call more than once.
+func (l *LNbitsWallet) Close() error {
+	l.life.Close(l.invoices.Close, l.payments.Close)
+	return nil
+}
+
+// lnbitsErrors are the messages LNbits uses for the errors in the root
+// package, checked in order.
+var lnbitsErrors = httpjson.Errors{
+	{"does not exist", rp.ErrInvoiceNotFound},
+	{"insufficient balance", rp.ErrInsufficientBalance},
+	{"already paid", rp.ErrAlreadyPaid},
+	{"expired", rp.ErrInvoiceExpired},
+	{"no route", rp.ErrNoRoute},
+	{"unable to find a path", rp.ErrNoRoute},
+	{"bolt11", rp.ErrInvalidInvoice},
+}
+
+// call makes a request to the LNbits API with key, bounded by ctx or by
+// ConnectTimeout when ctx has no deadline. body is sent as JSON.
+func (l *LNbitsWallet) call(
+	ctx context.Context,
+	method, path, key string,
+	body interface{},
+) (gjson.Result, error) {
+	return l.api.Call(ctx, method, path, key, body)
+}
+
+func (l *LNbitsWallet) GetInfo() (rp.WalletInfo, error) {
+	return l.GetInfoCtx(context.Background())
+}
+
+func (l *LNbitsWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	wallet, err := l.call(ctx, "GET", "/api/v1/wallet", l.InvoiceKey, nil)
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error getting wallet: %w", err)
+	}
+
+	// the funding LNbits doesn't say anything about its node, only about the
+	// balance of this wallet on it
+	balance := wallet.Get("balance").Int()
+	return rp.WalletInfo{
+		Balance:      balance,
+		Alias:        wallet.Get("name").String(),
+		Synced:       true,
+		OutboundMsat: balance,
+	}, nil
+}
+
+func (l *LNbitsWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return l.CreateInvoiceCtx(context.Background(), params)
+}
+
+// CreateInvoiceCtx creates the invoice on the funding LNbits, which doesn't
+// say what its preimage is, so it is left empty.
+func (l *LNbitsWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	if params.Msatoshi%1000 != 0 {
+		return rp.InvoiceData{},
+			fmt.Errorf("lnbits can only make invoices for whole satoshis, not %d msat", params.Msatoshi)
+	}
+
+	args := map[string]interface{}{
+		"out":    false,
+		"amount": params.Msatoshi / 1000,
+	}
+	if params.DescriptionHash == nil {
+		args["memo"] = params.Description
+	} else {
+		args["description_hash"] = hex.EncodeToString(params.DescriptionHash)
+	}
+	if params.Expiry != nil {
+		args["expiry"] = int64(params.Expiry.Seconds())
+	}
+
+	inv, err := l.call(ctx, "POST", "/api/v1/payments", l.InvoiceKey, args)
+	if err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error creating invoice: %w", err)
+	}
+
+	bolt11 := inv.Get("payment_request").String()
+	if bolt11 == "" {
+		bolt11 = inv.Get("bolt11").String()
+	}
+	return rp.InvoiceData{
+		Invoice:    bolt11,
+		CheckingID: inv.Get("payment_hash").String(),
+	}, nil
+}
+
+func (l *LNbitsWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
+	return l.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (l *LNbitsWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	res, err := l.call(ctx, "GET", "/api/v1/payments/"+checkingID, l.InvoiceKey, nil)
+	if err != nil {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.InvoiceStatus{CheckingID: checkingID, Exists: false}, nil
+		}
+		return rp.InvoiceStatus{}, fmt.Errorf("error getting invoice %s: %w", checkingID, err)
+	}
+
+	status := rp.InvoiceStatus{
+		CheckingID: checkingID,
+		Exists:     true,
+		Paid:       res.Get("paid").Bool(),
+		Invoice:    res.Get("details.bolt11").String(),
+	}
+	status.CreatedAt, status.ExpiresAt = rp.InvoiceTimes(status.Invoice)
+	if status.Paid {
+		status.State = rp.InvoiceSettled
+		status.MSatoshiReceived = res.Get("details.amount").Int()
+	} else {
+		status.State = rp.UnpaidState(status.ExpiresAt)
+	}
+	return status, nil
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (l *LNbitsWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return l.invoices.Stats(), l.payments.Stats()
+}
+
+func (l *LNbitsWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return l.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (l *LNbitsWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return l.invoices.Subscribe(ctx)
+}
+
+func (l *LNbitsWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	return l.MakePaymentCtx(context.Background(), params)
+}
+
+// MakePaymentCtx starts paying the invoice in the background, as LNbits only
+// replies once the payment is done. Custom amounts and payment limits aren't
+// supported.
+func (l *LNbitsWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if err := ctx.Err(); err != nil {
+		return rp.PaymentData{}, err
+	}
+	if params.CustomAmount != 0 {
+		return rp.PaymentData{}, errors.New("lnbits can't pay a custom amount")
+	}
+	if params.MaxFeeMsat != 0 || params.MaxFeePercent != 0 || params.Timeout != 0 {
+		return rp.PaymentData{}, errors.New("lnbits can't limit the fees or time of a payment")
+	}
+
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+	}
+
+	if !l.life.Spawn(func() { l.pay(inv.PaymentHash, params.Invoice) }) {
+		return rp.PaymentData{}, rp.ErrClosed
+	}
+
+	return rp.PaymentData{
+		CheckingID: inv.PaymentHash,
+	}, nil
+}
+
+// pay pays invoice and publishes how it went.
+func (l *LNbitsWallet) pay(hash, invoice string) {
+	ctx, cancel := context.WithTimeout(l.ctx, PayTimeout)
+	_, err := l.call(ctx, "POST", "/api/v1/payments", l.AdminKey, map[string]interface{}{
+		"out":    true,
+		"bolt11": invoice,
+	})
+	timedOut := ctx.Err() != nil
+	cancel()
+	if l.ctx.Err() != nil {
+		return
+	}
+	if err != nil && !errors.Is(err, rp.ErrBackendUnavailable) && !timedOut {
+		// LNbits said no, so it won't be paid
+		l.life.ReportError(fmt.Errorf("payment %s failed: %w", hash, err))
+		l.payments.Publish(rp.PaymentStatus{CheckingID: hash, Status: rp.Failed})
+		return
+	}
+
+	l.trackPayment(hash)
+}
+
+// trackPayment polls the status of a payment until it is done and publishes
+// it, or until TrackPaymentRetryLimit, when it is published as Unknown.
+func (l *LNbitsWallet) trackPayment(hash string) {
+	ctx, cancel := context.WithTimeout(l.ctx, TrackPaymentRetryLimit)
+	defer cancel()
+
+	status := rp.PaymentStatus{CheckingID: hash, Status: rp.Unknown}
+	rp.Poll(ctx, PaymentPollInterval, func() (bool, error) {
+		current, err := l.GetPaymentStatusCtx(ctx, hash)
+		if err != nil {
+			return false, err
+		}
+		if current.Status == rp.Complete || current.Status == rp.Failed {
+			status = current
+			return true, nil
+		}
+		return false, nil
+	}, l.life.ReportError)
+	if l.ctx.Err() != nil {
+		return
+	}
+
+	l.payments.Publish(status)
+}
+
+func (l *LNbitsWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
+	return l.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+func (l *LNbitsWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	res, err := l.call(ctx, "GET", "/api/v1/payments/"+checkingID, l.InvoiceKey, nil)
+	if err != nil {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.PaymentStatus{CheckingID: checkingID, Status: rp.NeverTried}, nil
+		}
+		return rp.PaymentStatus{}, fmt.Errorf("error getting payment %s: %w", checkingID, err)
+	}
+
+	return paymentToPaymentStatus(checkingID, res), nil
+}
+
+// paymentToPaymentStatus reads what LNbits says about an outgoing payment,
+// which has negative amounts and fees.
+func paymentToPaymentStatus(checkingID string, res gjson.Result) rp.PaymentStatus {
+	status := rp.PaymentStatus{CheckingID: checkingID}
+	switch {
+	case res.Get("paid").Bool():
+		status.Status = rp.Complete
+		status.FeePaid = res.Get("details.fee").Int()
+		if status.FeePaid < 0 {
+			status.FeePaid = -status.FeePaid
+		}
+		status.Preimage = res.Get("preimage").String()
+	case res.Get("details.pending").Bool():
+		status.Status = rp.Pending
+	default:
+		status.Status = rp.Failed
+	}
+	return status
+}
+
+func (l *LNbitsWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
+	return l.PaymentsStreamCtx(context.Background())
+}
+
+func (l *LNbitsWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return l.payments.Subscribe(ctx)
+}
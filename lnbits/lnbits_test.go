@@ -0,0 +1,300 @@
+package lnbits
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/socks5test"
+	"github.com/tidwall/gjson"
+)
+
+const invoice = "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3"
+
+const hash = "3f06a81e0a0c2ad34ee9df2a30d87a810da9e3c3881f780755ace5e5e64d30a7"
+
+func TestGetInfo(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Api-Key"); got != "invoicekey" {
+			t.Errorf("got %v, wanted %v", got, "invoicekey")
+		}
+		fmt.Fprint(w, `{"id":"abc","name":"funding","balance":21000}`)
+	})
+
+	want := rp.WalletInfo{
+		Balance:      21000,
+		Alias:        "funding",
+		Synced:       true,
+		OutboundMsat: 21000,
+	}
+	got, err := l.GetInfo()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestCreateInvoice(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := gjson.GetBytes(body, "amount").Int(); got != 2 {
+			t.Errorf("got %v, wanted %v", got, 2)
+		}
+		if got := gjson.GetBytes(body, "out").Bool(); got {
+			t.Errorf("got %v, wanted %v", got, false)
+		}
+		w.WriteHeader(201)
+		fmt.Fprint(w, `{"payment_hash":"ff","payment_request":"lnbc20n1"}`)
+	})
+
+	want := rp.InvoiceData{CheckingID: "ff", Invoice: "lnbc20n1"}
+	got, err := l.CreateInvoice(rp.InvoiceParams{Msatoshi: 2000})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	if _, err := l.CreateInvoice(rp.InvoiceParams{Msatoshi: 2001}); err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+}
+
+func TestGetInvoiceStatus(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/payments/ff":
+			fmt.Fprintf(w, `{"paid":true,"preimage":"ee","details":{"amount":1000,"pending":false,"bolt11":"%s"}}`, invoice)
+		case "/api/v1/payments/ee":
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"detail":"Payment does not exist."}`)
+		case "/api/v1/payments/dd":
+			w.WriteHeader(502)
+		}
+	})
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "ff",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 1000,
+		State:            rp.InvoiceSettled,
+		Invoice:          invoice,
+		CreatedAt:        time.Unix(1638716301, 0),
+		ExpiresAt:        time.Unix(1638802701, 0),
+	}
+	got, err := l.GetInvoiceStatus("ff")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	want = rp.InvoiceStatus{CheckingID: "ee", Exists: false}
+	got, err = l.GetInvoiceStatus("ee")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	_, err = l.GetInvoiceStatus("dd")
+	if !errors.Is(err, rp.ErrBackendUnavailable) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrBackendUnavailable)
+	}
+}
+
+func TestMakePayment(t *testing.T) {
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = 10 * time.Millisecond
+
+	polls := 0
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/payments":
+			if got := r.Header.Get("X-Api-Key"); got != "adminkey" {
+				t.Errorf("got %v, wanted %v", got, "adminkey")
+			}
+			body, _ := io.ReadAll(r.Body)
+			if got := gjson.GetBytes(body, "bolt11").String(); got != invoice {
+				t.Errorf("got %v, wanted %v", got, invoice)
+			}
+			w.WriteHeader(201)
+			fmt.Fprintf(w, `{"payment_hash":"%s"}`, hash)
+		case "/api/v1/payments/" + hash:
+			polls++
+			if polls == 1 {
+				fmt.Fprint(w, `{"paid":false,"details":{"amount":-1000,"fee":0,"pending":true}}`)
+				return
+			}
+			fmt.Fprint(w, `{"paid":true,"preimage":"ee","details":{"amount":-1000,"fee":-12,"pending":false}}`)
+		}
+	})
+
+	payments, err := l.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	got, err := l.MakePayment(rp.PaymentParams{Invoice: invoice})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got.CheckingID != hash {
+		t.Errorf("got %v, wanted %v", got.CheckingID, hash)
+	}
+
+	want := rp.PaymentStatus{
+		CheckingID: hash,
+		Status:     rp.Complete,
+		FeePaid:    12,
+		Preimage:   "ee",
+	}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_InsufficientBalance(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, `{"detail":"Insufficient balance."}`)
+	})
+
+	payments, err := l.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if _, err := l.MakePayment(rp.PaymentParams{Invoice: invoice}); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	want := rp.PaymentStatus{CheckingID: hash, Status: rp.Failed}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+
+	_, err = l.call(l.ctx, "POST", "/api/v1/payments", l.AdminKey, nil)
+	if !errors.Is(err, rp.ErrInsufficientBalance) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrInsufficientBalance)
+	}
+}
+
+func TestPaidInvoicesStream(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/payments/sse" {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: payment-received\ndata: {\"payment_hash\":\"ee\",\"amount\":-1000,\"pending\":false}\n\n")
+		fmt.Fprint(w, "event: payment-received\ndata: {\"payment_hash\":\"ff\",\"amount\":1000,\"pending\":false}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+
+	invoices, err := l.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	l.life.Spawn(l.followEvents)
+
+	// outgoing payments are in the stream too, but skipped
+	want := rp.InvoiceStatus{
+		CheckingID:       "ff",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 1000,
+		State:            rp.InvoiceSettled,
+	}
+	select {
+	case got := <-invoices:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("invoice wasn't published")
+	}
+}
+
+func TestStart_Proxy(t *testing.T) {
+	subscribed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/payments/sse" {
+			fmt.Fprint(w, `{"id":"abc","name":"funding","balance":21000}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		<-subscribed
+		fmt.Fprint(w, "event: payment-received\ndata: {\"payment_hash\":\"ff\",\"amount\":1000,\"pending\":false}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	// the host can only be reached through the proxy
+	proxy := socks5test.NewServer(t, "", "")
+	proxy.AddHost("lnbits.onion:80", server.Listener.Addr().String())
+
+	l, err := Start(Params{
+		Host:     "http://lnbits.onion",
+		AdminKey: "adminkey",
+		Proxy:    proxy.URL(),
+		OnError:  func(error) {},
+	})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer l.Close()
+
+	invoices, err := l.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	close(subscribed)
+	select {
+	case got := <-invoices:
+		if got.CheckingID != "ff" {
+			t.Errorf("got %v, wanted %v", got.CheckingID, "ff")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("invoice wasn't published")
+	}
+}
+
+// setupServer starts a server answering with handler and a wallet that talks
+// to it. The SSE stream isn't followed, tests that want it spawn it.
+func setupServer(t *testing.T, handler http.HandlerFunc) *LNbitsWallet {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	l := newLNbitsWallet(Params{
+		Host:       server.URL,
+		AdminKey:   "adminkey",
+		InvoiceKey: "invoicekey",
+		OnError:    func(error) {},
+	}, http.DefaultClient)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
@@ -0,0 +1,125 @@
+package lnd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+// transportCredentials checks lnd's certificate against Cert, or the one at
+// CertPath, or the system roots when neither is set.
+func transportCredentials(params Params) (credentials.TransportCredentials, error) {
+	if params.InsecureSkipVerify {
+		return credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}), nil
+	}
+
+	cert := params.Cert
+	if len(cert) == 0 && params.CertPath != "" {
+		var err error
+		cert, err = ioutil.ReadFile(params.CertPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cert) == 0 {
+		return credentials.NewClientTLSFromCert(nil, ""), nil
+	}
+
+	pool := x509.NewCertPool()
+	if !bytes.Contains(cert, []byte("-----BEGIN")) {
+		parsed, err := x509.ParseCertificate(cert)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+		pool.AddCert(parsed)
+	} else if !pool.AppendCertsFromPEM(cert) {
+		return nil, errors.New("no certificate found")
+	}
+	return credentials.NewClientTLSFromCert(pool, ""), nil
+}
+
+// loadMacaroon reads Macaroon, in binary, hex or base64, or the file at
+// MacaroonPath.
+func loadMacaroon(params Params) (*macaroon.Macaroon, error) {
+	data := params.Macaroon
+	if len(data) == 0 {
+		var err error
+		data, err = ioutil.ReadFile(params.MacaroonPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := &macaroon.Macaroon{}
+	if err := m.UnmarshalBinary(data); err == nil {
+		return m, nil
+	}
+	text := strings.TrimSpace(string(data))
+	decoded, err := hex.DecodeString(text)
+	if err != nil {
+		decoded, err = decodeBase64(text)
+	}
+	if err != nil {
+		return nil, errors.New("macaroon isn't binary, hex or base64")
+	}
+	if err := m.UnmarshalBinary(decoded); err != nil {
+		return nil, fmt.Errorf("invalid macaroon: %w", err)
+	}
+	return m, nil
+}
+
+// ParseLndConnect reads the host, certificate and macaroon from an lndconnect
+// URI, like lndconnect://host:10009?cert=...&macaroon=..., with both in
+// base64url. The cert is optional, without it lnd's certificate must be
+// trusted by the system.
+func ParseLndConnect(uri string) (Params, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Params{}, fmt.Errorf("invalid lndconnect uri: %w", err)
+	}
+	if u.Scheme != "lndconnect" {
+		return Params{}, fmt.Errorf("invalid lndconnect uri: scheme is %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return Params{}, errors.New("invalid lndconnect uri: no host")
+	}
+
+	params := Params{Host: u.Host}
+	query := u.Query()
+	if cert := query.Get("cert"); cert != "" {
+		der, err := decodeBase64(cert)
+		if err != nil {
+			return Params{}, fmt.Errorf("invalid lndconnect cert: %w", err)
+		}
+		params.Cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	mac := query.Get("macaroon")
+	if mac == "" {
+		return Params{}, errors.New("invalid lndconnect uri: no macaroon")
+	}
+	params.Macaroon, err = decodeBase64(mac)
+	if err != nil {
+		return Params{}, fmt.Errorf("invalid lndconnect macaroon: %w", err)
+	}
+	return params, nil
+}
+
+// decodeBase64 takes any of the base64 alphabets, padded or not.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "-_") {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+	return base64.RawStdEncoding.DecodeString(s)
+}
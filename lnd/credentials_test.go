@@ -0,0 +1,121 @@
+package lnd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	macaroon "gopkg.in/macaroon.v2"
+)
+
+func TestLoadMacaroon(t *testing.T) {
+	m, err := macaroon.New([]byte("root key"), []byte("id"), "lnd", macaroon.LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{
+		bin,
+		[]byte(hex.EncodeToString(bin)),
+		[]byte(base64.StdEncoding.EncodeToString(bin)),
+		[]byte(base64.RawURLEncoding.EncodeToString(bin) + "\n"),
+	} {
+		got, err := loadMacaroon(Params{Macaroon: data})
+		if err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+			continue
+		}
+		if !bytes.Equal(got.Signature(), m.Signature()) {
+			t.Errorf("got %x, wanted %x", got.Signature(), m.Signature())
+		}
+	}
+
+	if _, err := loadMacaroon(Params{Macaroon: []byte("not a macaroon!")}); err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+}
+
+func TestTransportCredentials(t *testing.T) {
+	der, _ := testCertificate(t)
+	for _, cert := range [][]byte{
+		der,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	} {
+		if _, err := transportCredentials(Params{Cert: cert}); err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+	}
+
+	if _, err := transportCredentials(Params{Cert: []byte("junk")}); err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+	if _, err := transportCredentials(Params{Cert: []byte("junk"), InsecureSkipVerify: true}); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+}
+
+func TestParseLndConnect(t *testing.T) {
+	der, _ := testCertificate(t)
+	mac := []byte{0x02, 0x01, 0x03, 'l', 'n', 'd'}
+
+	got, err := ParseLndConnect("lndconnect://abcdef.onion:10009?cert=" +
+		base64.RawURLEncoding.EncodeToString(der) + "&macaroon=" +
+		base64.RawURLEncoding.EncodeToString(mac))
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if got.Host != "abcdef.onion:10009" {
+		t.Errorf("got %v, wanted %v", got.Host, "abcdef.onion:10009")
+	}
+	if block, _ := pem.Decode(got.Cert); block == nil || !bytes.Equal(block.Bytes, der) {
+		t.Errorf("got %q, wanted the certificate in PEM", got.Cert)
+	}
+	if !bytes.Equal(got.Macaroon, mac) {
+		t.Errorf("got %x, wanted %x", got.Macaroon, mac)
+	}
+
+	for _, uri := range []string{
+		"https://node:10009?macaroon=AgED",
+		"lndconnect://?macaroon=AgED",
+		"lndconnect://node:10009",
+		"lndconnect://node:10009?macaroon=!!",
+	} {
+		if _, err := ParseLndConnect(uri); err == nil {
+			t.Errorf("%s: got %v, wanted an error", uri, err)
+		}
+	}
+}
+
+// testCertificate is a self-signed certificate for lnd.onion, in DER, and its
+// key.
+func testCertificate(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lnd"},
+		DNSNames:     []string{"lnd.onion"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der, key
+}
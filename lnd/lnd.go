@@ -3,29 +3,49 @@ package lnd
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
+	"net"
 	"strings"
 	"time"
 
 	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
 	"github.com/lightningnetwork/lnd/macaroons"
 	rp "github.com/lnbits/relampago"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	macaroon "gopkg.in/macaroon.v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// PaymentPollInterval is how long the event streams wait before trying again
+// after an error from lnd.
+var PaymentPollInterval = 5 * time.Second
+
+// TrackPaymentRetryLimit is for how long tracking a payment is retried after
+// errors before it is reported with an Unknown status.
+var TrackPaymentRetryLimit = 15 * time.Minute
+
 type Params struct {
 	Host           string
 	CertPath       string
 	MacaroonPath   string
+	Cert           []byte // optional, PEM or DER, used instead of reading CertPath
+	Macaroon       []byte // optional, binary, hex or base64, used instead of reading MacaroonPath
 	ConnectTimeout time.Duration
+	Proxy          string // optional, a SOCKS5 proxy every connection goes through
+
+	// InsecureSkipVerify still uses TLS but accepts any certificate, for Tor
+	// and regtest nodes where it can't be checked anyway. Cert and CertPath are
+	// ignored.
+	InsecureSkipVerify bool
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, errors from background streams, logged otherwise
 }
 
 type LndWallet struct {
@@ -34,9 +54,15 @@ type LndWallet struct {
 	Conn      *grpc.ClientConn
 	Lightning lnrpc.LightningClient
 	Router    routerrpc.RouterClient
+	Invoices  invoicesrpc.InvoicesClient
 
-	invoiceStatusListeners []chan rp.InvoiceStatus
-	paymentStatusListeners []chan rp.PaymentStatus
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+	held     *rp.Broadcaster[rp.InvoiceStatus] // accepted hold invoices
 }
 
 func Start(params Params) (*LndWallet, error) {
@@ -48,19 +74,14 @@ func Start(params Params) (*LndWallet, error) {
 	}
 
 	// TLS
-	tls, err := credentials.NewClientTLSFromFile(params.CertPath, "")
+	tls, err := transportCredentials(params)
 	if err != nil {
 		return nil, err
 	}
 	dialOpts = append(dialOpts, grpc.WithTransportCredentials(tls))
 
 	// Macaroon Auth
-	macBytes, err := ioutil.ReadFile(params.MacaroonPath)
-	if err != nil {
-		return nil, err
-	}
-	m := &macaroon.Macaroon{}
-	err = m.UnmarshalBinary(macBytes)
+	m, err := loadMacaroon(params)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +90,15 @@ func Start(params Params) (*LndWallet, error) {
 		return nil, err
 	}
 	dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(creds))
+	if params.Proxy != "" {
+		dial, err := rp.ProxyDialer(params.Proxy, params.ConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		}))
+	}
 	dialOpts = append(dialOpts, grpc.WithBlock())
 	dialOpts = append(dialOpts, grpc.WithTimeout(params.ConnectTimeout))
 
@@ -79,65 +109,145 @@ func Start(params Params) (*LndWallet, error) {
 	}
 	ln := lnrpc.NewLightningClient(conn)
 	router := routerrpc.NewRouterClient(conn)
+	invoices := invoicesrpc.NewInvoicesClient(conn)
+
+	l := newLndWallet(params, conn, ln, router, invoices)
+	l.life.Spawn(l.startPaymentsStream)
+	l.life.Spawn(l.startInvoicesStream)
 
-	l := &LndWallet{
+	return l, nil
+}
+
+func newLndWallet(
+	params Params,
+	conn *grpc.ClientConn,
+	ln lnrpc.LightningClient,
+	router routerrpc.RouterClient,
+	invoices invoicesrpc.InvoicesClient,
+) *LndWallet {
+	life := rp.NewLifecycle("lnd", params.OnError)
+	return &LndWallet{
 		Params:    params,
 		Conn:      conn,
 		Lightning: ln,
 		Router:    router,
+		Invoices:  invoices,
+		life:      life,
+		ctx:       life.Context(),
+		invoices:  rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments:  rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+		held:      rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
 	}
-
-	go l.startPaymentsStream()
-	go l.startInvoicesStream()
-
-	return l, nil
 }
 
-// Compile time check to ensure that LndWallet fully implements rp.Wallet
-var _ rp.Wallet = (*LndWallet)(nil)
+// Compile time check to ensure that LndWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*LndWallet)(nil)
+var _ rp.HoldInvoiceWallet = (*LndWallet)(nil)
+var _ rp.KeysendWallet = (*LndWallet)(nil)
+var _ rp.ResumableWallet = (*LndWallet)(nil)
+var _ rp.StreamStatsReporter = (*LndWallet)(nil)
 
 func (l *LndWallet) Kind() string {
 	return "lndgrpc"
 }
 
+func (l *LndWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		Keysend:               true,
+		HoldInvoices:          true,
+		MPP:                   true,
+		FeeLimits:             true,
+		PaymentTimeout:        true,
+		InvoicePaymentHashIDs: true,
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Close stops all background streams, closes every listener channel and then
+// the connection to lnd. It is safe to call more than once.
+func (l *LndWallet) Close() error {
+	if !l.life.Close(l.invoices.Close, l.payments.Close, l.held.Close) {
+		return nil
+	}
+
+	if l.Conn != nil {
+		return l.Conn.Close()
+	}
+	return nil
+}
+
 func (l *LndWallet) GetInfo() (rp.WalletInfo, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	return l.GetInfoCtx(ctx)
+}
 
-	res, err := l.Lightning.ChannelBalance(ctx, &lnrpc.ChannelBalanceRequest{})
+func (l *LndWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	balance, err := l.Lightning.ChannelBalance(ctx, &lnrpc.ChannelBalanceRequest{})
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling ChannelBalance: %w", MapError(err))
+	}
+	info, err := l.Lightning.GetInfo(ctx, &lnrpc.GetInfoRequest{})
 	if err != nil {
-		return rp.WalletInfo{}, fmt.Errorf("error calling ChannelBalance: %w", err)
+		return rp.WalletInfo{}, fmt.Errorf("error calling GetInfo: %w", MapError(err))
+	}
+	onchain, err := l.Lightning.WalletBalance(ctx, &lnrpc.WalletBalanceRequest{})
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling WalletBalance: %w", MapError(err))
+	}
+
+	var network rp.Network
+	if len(info.Chains) > 0 {
+		network = rp.Network(info.Chains[0].Network)
 	}
 
 	return rp.WalletInfo{
-		Balance: int64(res.LocalBalance.Sat),
+		Balance:      int64(balance.GetLocalBalance().GetMsat()),
+		Pubkey:       info.IdentityPubkey,
+		Alias:        info.Alias,
+		Network:      network,
+		BlockHeight:  info.BlockHeight,
+		Synced:       info.SyncedToChain,
+		Version:      info.Version,
+		OutboundMsat: int64(balance.GetLocalBalance().GetMsat()),
+		InboundMsat:  int64(balance.GetRemoteBalance().GetMsat()),
+		PendingMsat:  int64(balance.GetPendingOpenLocalBalance().GetMsat()),
+		OnchainMsat:  onchain.ConfirmedBalance * 1000,
 	}, nil
 }
 
 func (l *LndWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	return l.CreateInvoiceCtx(ctx, params)
+}
 
-	preimage := make([]byte, 32)
-	rand.Read(preimage)
-
+func (l *LndWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
 	args := &lnrpc.Invoice{
 		Memo:            params.Description,
 		DescriptionHash: params.DescriptionHash,
 		ValueMsat:       params.Msatoshi,
-		RPreimage:       preimage,
 	}
 	if params.Expiry != nil {
 		args.Expiry = int64(params.Expiry.Seconds())
 	}
-	inv, err := l.Lightning.AddInvoice(ctx, args)
+	res, err := l.Lightning.AddInvoice(ctx, args)
 	if err != nil {
-		return rp.InvoiceData{}, fmt.Errorf("error calling AddInvoice: %w", err)
+		return rp.InvoiceData{}, fmt.Errorf("error calling AddInvoice: %w", MapError(err))
+	}
+
+	// fetch the invoice back so we get the preimage lnd generated for it
+	inv, err := l.Lightning.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: res.RHash})
+	if err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error calling LookupInvoice: %w", MapError(err))
 	}
 
 	return rp.InvoiceData{
 		CheckingID: hex.EncodeToString(inv.RHash),
-		Preimage:   hex.EncodeToString(preimage),
+		Preimage:   hex.EncodeToString(inv.RPreimage),
 		Invoice:    inv.PaymentRequest,
 	}, nil
 }
@@ -145,74 +255,272 @@ func (l *LndWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, erro
 func (l *LndWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	return l.GetInvoiceStatusCtx(ctx, checkingID)
+}
 
+func (l *LndWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
 	rHash, err := hex.DecodeString(checkingID)
 	if err != nil {
 		return rp.InvoiceStatus{}, fmt.Errorf("invalid checkingID: %w", err)
 	}
 	res, err := l.Lightning.LookupInvoice(ctx, &lnrpc.PaymentHash{RHash: rHash})
-	if err != nil || res == nil {
-		return rp.InvoiceStatus{
-			CheckingID:       checkingID,
-			Exists:           false,
-			Paid:             false,
-			MSatoshiReceived: 0,
-		}, nil
-	}
-	return rp.InvoiceStatus{
-		CheckingID:       checkingID,
-		Exists:           true,
-		Paid:             res.State == lnrpc.Invoice_SETTLED,
-		MSatoshiReceived: res.AmtPaidMsat,
+	if err != nil {
+		err = MapError(err)
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.InvoiceStatus{
+				CheckingID:       checkingID,
+				Exists:           false,
+				Paid:             false,
+				MSatoshiReceived: 0,
+			}, nil
+		}
+		return rp.InvoiceStatus{}, fmt.Errorf("error calling LookupInvoice: %w", err)
+	}
+	return InvoiceToInvoiceStatus(res), nil
+}
+
+func (l *LndWallet) CreateHoldInvoice(params rp.InvoiceParams, paymentHash string) (rp.InvoiceData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.CreateHoldInvoiceCtx(ctx, params, paymentHash)
+}
+
+func (l *LndWallet) CreateHoldInvoiceCtx(
+	ctx context.Context,
+	params rp.InvoiceParams,
+	paymentHash string,
+) (rp.InvoiceData, error) {
+	args, err := HoldInvoiceRequest(params, paymentHash)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+	res, err := l.Invoices.AddHoldInvoice(ctx, args)
+	if err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error calling AddHoldInvoice: %w", MapError(err))
+	}
+
+	return rp.InvoiceData{
+		CheckingID: paymentHash,
+		Invoice:    res.PaymentRequest,
 	}, nil
 }
 
-func (l *LndWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+func (l *LndWallet) SettleHoldInvoice(preimage string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	return l.SettleHoldInvoiceCtx(ctx, preimage)
+}
 
-	inv, err := decodepay.Decodepay(params.Invoice)
+func (l *LndWallet) SettleHoldInvoiceCtx(ctx context.Context, preimage string) error {
+	p, err := DecodeHash(preimage)
 	if err != nil {
-		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w", params.Invoice, err)
+		return fmt.Errorf("invalid preimage: %w", err)
+	}
+	if _, err := l.Invoices.SettleInvoice(ctx, &invoicesrpc.SettleInvoiceMsg{Preimage: p}); err != nil {
+		return fmt.Errorf("error calling SettleInvoice: %w", MapError(err))
 	}
+	return nil
+}
 
-	req := &routerrpc.SendPaymentRequest{
-		PaymentRequest: params.Invoice,
-		TimeoutSeconds: 30,
-		FeeLimitMsat:   int64(float64(inv.MSatoshi) * 0.01),
+func (l *LndWallet) CancelHoldInvoice(paymentHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.CancelHoldInvoiceCtx(ctx, paymentHash)
+}
+
+func (l *LndWallet) CancelHoldInvoiceCtx(ctx context.Context, paymentHash string) error {
+	hash, err := DecodeHash(paymentHash)
+	if err != nil {
+		return err
 	}
-	if params.CustomAmount != 0 {
-		req.AmtMsat = params.CustomAmount
-		req.FeeLimitMsat = int64(float64(params.CustomAmount) * 0.01)
+	if _, err := l.Invoices.CancelInvoice(ctx, &invoicesrpc.CancelInvoiceMsg{PaymentHash: hash}); err != nil {
+		return fmt.Errorf("error calling CancelInvoice: %w", MapError(err))
+	}
+	return nil
+}
+
+// HoldInvoiceRequest makes the AddHoldInvoice request for params and the
+// payment hash in hex.
+func HoldInvoiceRequest(params rp.InvoiceParams, paymentHash string) (*invoicesrpc.AddHoldInvoiceRequest, error) {
+	hash, err := DecodeHash(paymentHash)
+	if err != nil {
+		return nil, err
 	}
-	if req.FeeLimitMsat < 2000 {
-		req.FeeLimitMsat = 2000
+
+	req := &invoicesrpc.AddHoldInvoiceRequest{
+		Memo:            params.Description,
+		Hash:            hash,
+		DescriptionHash: params.DescriptionHash,
+		ValueMsat:       params.Msatoshi,
+	}
+	if params.Expiry != nil {
+		req.Expiry = int64(params.Expiry.Seconds())
+	}
+	return req, nil
+}
+
+// DecodeHash decodes a payment hash or preimage, which are both 32 bytes.
+func DecodeHash(value string) ([]byte, error) {
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment hash %s: %w", value, err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("invalid payment hash %s: it must be 32 bytes", value)
+	}
+	return b, nil
+}
+
+func (l *LndWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.MakePaymentCtx(ctx, params)
+}
+
+func (l *LndWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+	}
+
+	return l.sendPayment(ctx, SendPaymentRequest(params, inv.MSatoshi), inv.PaymentHash)
+}
+
+func (l *LndWallet) MakeKeysend(params rp.KeysendParams) (rp.PaymentData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.MakeKeysendCtx(ctx, params)
+}
+
+func (l *LndWallet) MakeKeysendCtx(ctx context.Context, params rp.KeysendParams) (rp.PaymentData, error) {
+	req, hash, err := KeysendRequest(params)
+	if err != nil {
+		return rp.PaymentData{}, err
 	}
+	return l.sendPayment(ctx, req, hash)
+}
 
+// sendPayment starts the payment of req, with the given hash, and follows it
+// in the background once lnd has taken it.
+func (l *LndWallet) sendPayment(
+	ctx context.Context,
+	req *routerrpc.SendPaymentRequest,
+	hash string,
+) (rp.PaymentData, error) {
 	stream, err := l.Router.SendPaymentV2(ctx, req)
 	if err != nil {
-		return rp.PaymentData{}, fmt.Errorf("error calling SendPaymentV2: %w", err)
+		return rp.PaymentData{}, fmt.Errorf("error calling SendPaymentV2: %w", MapError(err))
 	}
 
 	// listen to the first notification, which should be "in_flight"
-	if _, err := stream.Recv(); err != nil {
-		return rp.PaymentData{}, fmt.Errorf("failed to stream.Recv() on MakePayment(%s): %w",
-			inv.PaymentHash, err)
+	first, err := stream.Recv()
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to stream.Recv() on payment %s: %w",
+			hash, MapError(err))
+	}
+	if first.Status == lnrpc.Payment_FAILED {
+		// failed before even trying, like when there's no route
+		return rp.PaymentData{}, fmt.Errorf("payment %s failed: %w",
+			hash, FailureError(first.FailureReason))
 	}
 
 	// track this so it can emit payment notifications
-	go l.trackOutgoingPayment(inv.PaymentHash)
+	l.life.Spawn(func() { l.trackOutgoingPayment(hash) })
 
 	// return the checking id
 	return rp.PaymentData{
-		CheckingID: inv.PaymentHash,
+		CheckingID: hash,
 	}, nil
 }
 
+// Payments are limited to a 1% fee, or 2 sat for small ones, and 30 seconds
+// when PaymentParams leave those out.
+const (
+	DefaultMaxFeePercent = 1
+	DefaultMinFeeMsat    = 2000
+	DefaultPayTimeout    = 30 * time.Second
+)
+
+// SendPaymentRequest is the router request that pays params, for an invoice
+// of msatoshi.
+func SendPaymentRequest(params rp.PaymentParams, msatoshi int64) *routerrpc.SendPaymentRequest {
+	req := &routerrpc.SendPaymentRequest{
+		PaymentRequest: params.Invoice,
+	}
+	if params.CustomAmount != 0 {
+		req.AmtMsat = params.CustomAmount
+		msatoshi = params.CustomAmount
+	}
+
+	limit, ok := params.FeeLimit(msatoshi)
+	setLimits(req, msatoshi, limit, ok, params.Timeout)
+	return req
+}
+
+// KeysendRequest is the router request that pays params, with the hash of the
+// new preimage it sends along.
+func KeysendRequest(params rp.KeysendParams) (*routerrpc.SendPaymentRequest, string, error) {
+	dest, err := hex.DecodeString(params.Destination)
+	if err != nil || len(dest) != 33 {
+		return nil, "", fmt.Errorf("invalid destination pubkey '%s'", params.Destination)
+	}
+
+	preimage := make([]byte, 32)
+	if _, err := rand.Read(preimage); err != nil {
+		return nil, "", fmt.Errorf("failed to make random preimage: %w", err)
+	}
+	hash := sha256.Sum256(preimage)
+
+	records := make(map[uint64][]byte, len(params.CustomRecords)+1)
+	for typ, value := range params.CustomRecords {
+		records[typ] = value
+	}
+	records[rp.KeysendRecord] = preimage
+
+	req := &routerrpc.SendPaymentRequest{
+		Dest:              dest,
+		AmtMsat:           params.Msatoshi,
+		PaymentHash:       hash[:],
+		DestCustomRecords: records,
+	}
+	limit, ok := params.FeeLimit()
+	setLimits(req, params.Msatoshi, limit, ok, params.Timeout)
+
+	return req, hex.EncodeToString(hash[:]), nil
+}
+
+// setLimits sets the fee limit and timeout of req, or the defaults when they
+// aren't given.
+func setLimits(
+	req *routerrpc.SendPaymentRequest,
+	msatoshi, feeLimit int64,
+	hasFeeLimit bool,
+	timeout time.Duration,
+) {
+	if hasFeeLimit {
+		req.FeeLimitMsat = feeLimit
+	} else {
+		req.FeeLimitMsat = msatoshi * DefaultMaxFeePercent / 100
+		if req.FeeLimitMsat < DefaultMinFeeMsat {
+			req.FeeLimitMsat = DefaultMinFeeMsat
+		}
+	}
+
+	req.TimeoutSeconds = int32(DefaultPayTimeout / time.Second)
+	if timeout > 0 {
+		// lnd counts whole seconds, rounded up so it is never zero
+		req.TimeoutSeconds = int32((timeout + time.Second - 1) / time.Second)
+	}
+}
+
 func (l *LndWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	return l.GetPaymentStatusCtx(ctx, checkingID)
+}
 
+func (l *LndWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
 	paymentHash, err := hex.DecodeString(checkingID)
 	if err != nil {
 		return rp.PaymentStatus{}, fmt.Errorf("checkingID must be a valid payment hash 32-byte hex, got '%s': %w", checkingID, err)
@@ -226,20 +534,22 @@ func (l *LndWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error
 		},
 	)
 	if err != nil {
-		return rp.PaymentStatus{}, fmt.Errorf("error calling TrackPaymentV2: %w", err)
+		return rp.PaymentStatus{}, fmt.Errorf("error calling TrackPaymentV2: %w", MapError(err))
 	}
 
 	// the first event will always be the current state of the payment from the db
 	payment, err := stream.Recv()
 	if err != nil {
 		return rp.PaymentStatus{},
-			fmt.Errorf("error calling Recv() on TrackPaymentV2: %w", err)
+			fmt.Errorf("error calling Recv() on TrackPaymentV2: %w", MapError(err))
 	}
 
-	return paymentToPaymentStatus(payment), nil
+	return PaymentToPaymentStatus(payment), nil
 }
 
-func paymentToPaymentStatus(payment *lnrpc.Payment) rp.PaymentStatus {
+// PaymentToPaymentStatus converts a payment as lnd gives it, which is also
+// what the lndrest backend decodes its responses into.
+func PaymentToPaymentStatus(payment *lnrpc.Payment) rp.PaymentStatus {
 	status := rp.PaymentStatus{
 		CheckingID: payment.PaymentHash,
 		Status:     rp.Unknown,
@@ -268,50 +578,178 @@ func paymentToPaymentStatus(payment *lnrpc.Payment) rp.PaymentStatus {
 	}
 }
 
+// StreamStats reports how the invoice and payment streams are doing.
+func (l *LndWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return l.invoices.Stats(), l.payments.Stats()
+}
+
 func (l *LndWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return l.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (l *LndWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return l.invoices.Subscribe(ctx)
+}
+
+// PaidInvoicesStreamFrom opens a subscription of its own to lnd, replaying
+// every invoice with a settle index after cursor.
+func (l *LndWallet) PaidInvoicesStreamFrom(ctx context.Context, cursor uint64) (<-chan rp.InvoiceStatus, error) {
 	listener := make(chan rp.InvoiceStatus)
-	l.invoiceStatusListeners = append(l.invoiceStatusListeners, listener)
+	ctx, cancel := context.WithCancel(ctx)
+
+	started := l.life.Spawn(func() {
+		defer close(listener)
+		defer cancel()
+
+		// the subscription also ends when the wallet is closed
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-l.ctx.Done():
+				cancel()
+			}
+		}()
+
+		l.subscribeInvoices(ctx, cursor, func(status rp.InvoiceStatus) {
+			if status.State != rp.InvoiceSettled {
+				return // held ones have no settle index yet
+			}
+			select {
+			case listener <- status:
+			case <-ctx.Done():
+			}
+		})
+	})
+	if !started {
+		cancel()
+		return nil, rp.ErrClosed
+	}
+
 	return listener, nil
 }
 
 func (l *LndWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
-	listener := make(chan rp.PaymentStatus)
-	l.paymentStatusListeners = append(l.paymentStatusListeners, listener)
-	return listener, nil
+	return l.PaymentsStreamCtx(context.Background())
+}
+
+func (l *LndWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return l.payments.Subscribe(ctx)
+}
+
+// HeldInvoicesStream gets the hold invoices whose payments are accepted.
+func (l *LndWallet) HeldInvoicesStream(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return l.held.Subscribe(ctx)
 }
 
 func (l *LndWallet) startInvoicesStream() {
-	stream, err := l.Lightning.SubscribeInvoices(context.Background(), &lnrpc.InvoiceSubscription{})
-	if err != nil {
-		log.Fatalf("Failed to SubscribeInvoices: %v", err)
-	}
-	for {
-		res, err := stream.Recv()
-		if err == io.EOF {
-			break
+	l.subscribeInvoices(l.ctx, 0, func(status rp.InvoiceStatus) {
+		if status.State == rp.InvoiceAccepted {
+			l.held.Publish(status)
+		} else {
+			l.invoices.Publish(status)
 		}
+	})
+}
+
+func (l *LndWallet) subscribeInvoices(
+	ctx context.Context,
+	settleIndex uint64,
+	emit func(rp.InvoiceStatus),
+) {
+	SubscribeInvoices(ctx, settleIndex, func(ctx context.Context, settleIndex uint64) (InvoiceRecv, error) {
+		stream, err := l.Lightning.SubscribeInvoices(ctx, &lnrpc.InvoiceSubscription{
+			SettleIndex: settleIndex,
+		})
 		if err != nil {
-			log.Printf("Error receiving invoice event: %v", err)
+			return nil, err
 		}
+		return stream.Recv, nil
+	}, PaymentPollInterval, emit, l.life.ReportError)
+}
 
-		if res.State != lnrpc.Invoice_SETTLED {
-			continue // Only notify for paid invoices
+// InvoiceToInvoiceStatus is like PaymentToPaymentStatus, for invoices. lnd
+// cancels invoices once they expire, so cancelled ones past their expiry are
+// reported as expired.
+func InvoiceToInvoiceStatus(invoice *lnrpc.Invoice) rp.InvoiceStatus {
+	status := rp.InvoiceStatus{
+		CheckingID:       hex.EncodeToString(invoice.RHash),
+		Exists:           true,
+		Paid:             invoice.State == lnrpc.Invoice_SETTLED,
+		MSatoshiReceived: invoice.AmtPaidMsat,
+		Invoice:          invoice.PaymentRequest,
+		Cursor:           invoice.SettleIndex,
+		Keysend:          invoice.IsKeysend,
+	}
+	if invoice.CreationDate > 0 {
+		status.CreatedAt = time.Unix(invoice.CreationDate, 0)
+		status.ExpiresAt = status.CreatedAt.Add(time.Duration(invoice.Expiry) * time.Second)
+	}
+	if invoice.SettleDate > 0 {
+		status.SettledAt = time.Unix(invoice.SettleDate, 0)
+	}
+
+	switch invoice.State {
+	case lnrpc.Invoice_OPEN:
+		status.State = rp.UnpaidState(status.ExpiresAt)
+	case lnrpc.Invoice_ACCEPTED:
+		status.State = rp.InvoiceAccepted
+	case lnrpc.Invoice_SETTLED:
+		status.State = rp.InvoiceSettled
+	case lnrpc.Invoice_CANCELED:
+		status.State = rp.InvoiceCancelled
+		if rp.UnpaidState(status.ExpiresAt) == rp.InvoiceExpired {
+			status.State = rp.InvoiceExpired
 		}
-		for _, listener := range l.invoiceStatusListeners {
-			go func(listener chan rp.InvoiceStatus) {
-				listener <- rp.InvoiceStatus{
-					CheckingID:       hex.EncodeToString(res.RHash),
-					Exists:           true,
-					Paid:             res.State == lnrpc.Invoice_SETTLED,
-					MSatoshiReceived: res.AmtPaidMsat,
-				}
-			}(listener)
+	}
+
+	for _, htlc := range invoice.Htlcs {
+		if htlc.State != lnrpc.InvoiceHTLCState_SETTLED {
+			continue
+		}
+
+		records := customRecords(htlc.CustomRecords)
+		for typ, value := range records {
+			if status.CustomRecords == nil {
+				status.CustomRecords = make(map[uint64][]byte)
+			}
+			status.CustomRecords[typ] = value
+		}
+
+		status.HTLCs = append(status.HTLCs, rp.HTLC{
+			ChannelID:     htlc.ChanId,
+			ID:            htlc.HtlcIndex,
+			Msatoshi:      int64(htlc.AmtMsat),
+			AcceptedAt:    time.Unix(htlc.AcceptTime, 0),
+			SettledAt:     time.Unix(htlc.ResolveTime, 0),
+			CustomRecords: records,
+		})
+	}
+
+	return status
+}
+
+// customRecords are the records of an HTLC the sender chose, without the
+// keysend preimage.
+func customRecords(records map[uint64][]byte) map[uint64][]byte {
+	var custom map[uint64][]byte
+	for typ, value := range records {
+		if typ == rp.KeysendRecord {
+			continue
 		}
+		if custom == nil {
+			custom = make(map[uint64][]byte)
+		}
+		custom[typ] = value
 	}
+	return custom
 }
 
 func (l *LndWallet) startPaymentsStream() {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	TrackPendingPayments(l.life, l.pendingPayments, PaymentPollInterval, l.trackOutgoingPayment)
+}
+
+func (l *LndWallet) pendingPayments() ([]*lnrpc.Payment, error) {
+	ctx, cancel := context.WithTimeout(l.ctx, 5*time.Second)
 	defer cancel()
 
 	// get latest settled payment index
@@ -322,10 +760,10 @@ func (l *LndWallet) startPaymentsStream() {
 		Reversed:          true,
 	})
 	if err != nil {
-		panic(fmt.Errorf("error getting latest paid index: %w", err))
+		return nil, fmt.Errorf("error getting latest paid index: %w", err)
 	}
 	if len(res.Payments) == 0 {
-		return
+		return nil, nil
 	}
 	lastPaidIndex := res.Payments[0].PaymentIndex
 
@@ -336,67 +774,72 @@ func (l *LndWallet) startPaymentsStream() {
 		Reversed:          false,
 	})
 	if err != nil {
-		panic(fmt.Errorf("error listing pending payments: %w", err))
-	}
-
-	// track all these pending payments
-	for _, payment := range res.Payments {
-		go l.trackOutgoingPayment(payment.PaymentHash)
+		return nil, fmt.Errorf("error listing pending payments: %w", err)
 	}
+	return res.Payments, nil
 }
 
+// trackOutgoingPayment publishes the final status of a payment. Errors are
+// retried with backoff for up to TrackPaymentRetryLimit, after which the
+// payment is published with an Unknown status.
 func (l *LndWallet) trackOutgoingPayment(hash string) {
-	paymentHash, err := hex.DecodeString(hash)
-	if err != nil {
-		panic(fmt.Errorf("failed to decode hex on trackOutgoingPayment(%s): %w",
-			hash, err))
-	}
-
-	stream, err := l.Router.TrackPaymentV2(
-		context.Background(),
-		&routerrpc.TrackPaymentRequest{
+	TrackPayment(l.ctx, hash, func(ctx context.Context, paymentHash []byte) (PaymentRecv, error) {
+		stream, err := l.Router.TrackPaymentV2(ctx, &routerrpc.TrackPaymentRequest{
 			PaymentHash:       paymentHash,
 			NoInflightUpdates: true,
-		},
-	)
-	if err != nil {
-		panic(fmt.Errorf(
-			"call to TrackPaymentV2 failed on trackOutgoingPayment(%s): %w", hash, err))
-	}
-
-	status := rp.PaymentStatus{
-		Status:     rp.Unknown,
-		CheckingID: hash,
-	}
-
-checkPaymentStatus:
-	for {
-		payment, err := stream.Recv()
+		})
 		if err != nil {
-			panic(fmt.Errorf("failed to stream.Recv() on trackOutgoingPayment(%s): %w",
-				hash, err))
+			return nil, err
 		}
+		return stream.Recv, nil
+	}, PaymentPollInterval, TrackPaymentRetryLimit, l.payments.Publish, l.life.ReportError)
+}
 
-		switch payment.Status {
-		case lnrpc.Payment_UNKNOWN:
-			// was never attempted (but maybe it will still be in the next seconds?)
-			return
-		case lnrpc.Payment_SUCCEEDED:
-			status.Status = rp.Complete
-			status.FeePaid = payment.FeeMsat
-			status.Preimage = payment.PaymentPreimage
-			break checkPaymentStatus
-		case lnrpc.Payment_FAILED:
-			status.Status = rp.Failed
-			break checkPaymentStatus
-		default:
-			// all other cases are ignored
-			return
+// lndErrors are the messages lnd uses for the errors in the root package, as
+// it doesn't always give them a meaningful grpc code.
+var lndErrors = []struct {
+	message string
+	kind    error
+}{
+	{"unable to locate invoice", rp.ErrInvoiceNotFound},
+	{"invoice expired", rp.ErrInvoiceExpired},
+	{"invoice is already paid", rp.ErrAlreadyPaid},
+	{"invoice already settled", rp.ErrAlreadyPaid},
+	{"insufficient local balance", rp.ErrInsufficientBalance},
+	{"unable to find a path", rp.ErrNoRoute},
+	{"invalid payment request", rp.ErrInvalidInvoice},
+}
+
+// MapError wraps an error returned by lnd with the matching error from the
+// root package, if there is one.
+func MapError(err error) error {
+	switch status.Code(err) {
+	case codes.OK:
+		return err
+	case codes.NotFound:
+		return rp.WrapError(rp.ErrInvoiceNotFound, err)
+	case codes.Unavailable:
+		return rp.WrapError(rp.ErrBackendUnavailable, err)
+	}
+
+	message := err.Error()
+	for _, e := range lndErrors {
+		if strings.Contains(message, e.message) {
+			return rp.WrapError(e.kind, err)
 		}
 	}
+	return err
+}
 
-	// at this point we know this payment either failed or succeeded
-	for _, listener := range l.paymentStatusListeners {
-		listener <- status
-	}
+// FailureError is the error for a payment that failed for reason.
+func FailureError(reason lnrpc.PaymentFailureReason) error {
+	name := strings.TrimPrefix(reason.String(), "FAILURE_REASON_")
+	err := errors.New(strings.ToLower(strings.ReplaceAll(name, "_", " ")))
+	switch reason {
+	case lnrpc.PaymentFailureReason_FAILURE_REASON_NO_ROUTE:
+		return rp.WrapError(rp.ErrNoRoute, err)
+	case lnrpc.PaymentFailureReason_FAILURE_REASON_INSUFFICIENT_BALANCE:
+		return rp.WrapError(rp.ErrInsufficientBalance, err)
+	}
+	return err
 }
@@ -1,15 +1,29 @@
 package lnd
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
 	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
 	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/socks5test"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	macaroon "gopkg.in/macaroon.v2"
 )
 
 //###############//
@@ -20,16 +34,44 @@ func TestGetInfo(t *testing.T) {
 	lightning, _, lnd := setupMocks()
 	lightning.ChannelBalanceMock = func(_ *lnrpc.ChannelBalanceRequest) (*lnrpc.ChannelBalanceResponse, error) {
 		return &lnrpc.ChannelBalanceResponse{
-			LocalBalance: &lnrpc.Amount{Sat: 10},
+			LocalBalance:            &lnrpc.Amount{Sat: 10, Msat: 10000},
+			RemoteBalance:           &lnrpc.Amount{Sat: 20, Msat: 20000},
+			PendingOpenLocalBalance: &lnrpc.Amount{Sat: 5, Msat: 5000},
 		}, nil
 	}
+	lightning.GetInfoMock = func(_ *lnrpc.GetInfoRequest) (*lnrpc.GetInfoResponse, error) {
+		return &lnrpc.GetInfoResponse{
+			IdentityPubkey: "02aa",
+			Alias:          "alice",
+			Chains:         []*lnrpc.Chain{{Chain: "bitcoin", Network: "regtest"}},
+			BlockHeight:    800,
+			SyncedToChain:  true,
+			Version:        "0.15.0-beta",
+		}, nil
+	}
+	lightning.WalletBalanceMock = func(_ *lnrpc.WalletBalanceRequest) (*lnrpc.WalletBalanceResponse, error) {
+		return &lnrpc.WalletBalanceResponse{ConfirmedBalance: 3}, nil
+	}
 
+	want := rp.WalletInfo{
+		Balance:      10000,
+		Pubkey:       "02aa",
+		Alias:        "alice",
+		Network:      rp.Regtest,
+		BlockHeight:  800,
+		Synced:       true,
+		Version:      "0.15.0-beta",
+		OutboundMsat: 10000,
+		InboundMsat:  20000,
+		PendingMsat:  5000,
+		OnchainMsat:  3000,
+	}
 	got, err := lnd.GetInfo()
 	if err != nil {
 		t.Errorf("got %v, wanted %v", err, nil)
 	}
-	if got.Balance != 10 {
-		t.Errorf("got %v, wanted %v", got.Balance, 10)
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
 	}
 }
 
@@ -79,6 +121,115 @@ func TestCreateInvoice(t *testing.T) {
 	}
 }
 
+func TestHoldInvoice(t *testing.T) {
+	lightning, _, lnd := setupMocks()
+	defer lnd.Close()
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = time.Millisecond
+
+	preimage := bytes.Repeat([]byte{5}, 32)
+	hash := sha256.Sum256(preimage)
+	var settled, cancelled []byte
+	lnd.Invoices = &MockInvoicesClient{
+		AddHoldInvoiceMock: func(req *invoicesrpc.AddHoldInvoiceRequest) (*invoicesrpc.AddHoldInvoiceResp, error) {
+			if !bytes.Equal(req.Hash, hash[:]) || req.ValueMsat != 10000 || req.Memo != "escrow" {
+				t.Errorf("got %v, wanted the hash, amount and memo", req)
+			}
+			return &invoicesrpc.AddHoldInvoiceResp{PaymentRequest: "ln000"}, nil
+		},
+		SettleInvoiceMock: func(req *invoicesrpc.SettleInvoiceMsg) (*invoicesrpc.SettleInvoiceResp, error) {
+			settled = req.Preimage
+			return &invoicesrpc.SettleInvoiceResp{}, nil
+		},
+		CancelInvoiceMock: func(req *invoicesrpc.CancelInvoiceMsg) (*invoicesrpc.CancelInvoiceResp, error) {
+			cancelled = req.PaymentHash
+			return nil, status.Error(codes.Unknown, "invoice already settled")
+		},
+	}
+	lightning.SubscribeInvoicesMock = func(_ *lnrpc.InvoiceSubscription) ([]*lnrpc.Invoice, error) {
+		return []*lnrpc.Invoice{{
+			RHash:       hash[:],
+			State:       lnrpc.Invoice_ACCEPTED,
+			AmtPaidMsat: 10000,
+		}, {
+			RHash:       hash[:],
+			State:       lnrpc.Invoice_SETTLED,
+			AmtPaidMsat: 10000,
+			SettleIndex: 3,
+		}}, nil
+	}
+
+	checkingID := hex.EncodeToString(hash[:])
+	got, err := lnd.CreateHoldInvoice(rp.InvoiceParams{Msatoshi: 10000, Description: "escrow"}, checkingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (rp.InvoiceData{CheckingID: checkingID, Invoice: "ln000"}); got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	if _, err := lnd.CreateHoldInvoice(rp.InvoiceParams{}, "ff"); err == nil {
+		t.Errorf("got %v, wanted an error for a short hash", err)
+	}
+
+	held, err := lnd.HeldInvoicesStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid, err := lnd.PaidInvoicesStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnd.life.Spawn(lnd.startInvoicesStream)
+
+	// the mock sends the two updates in no particular order
+	var gotHeld, gotPaid rp.InvoiceStatus
+	for i := 0; i < 2; i++ {
+		select {
+		case gotHeld = <-held:
+		case gotPaid = <-paid:
+		}
+	}
+	want := rp.InvoiceStatus{
+		CheckingID:       checkingID,
+		Exists:           true,
+		MSatoshiReceived: 10000,
+		State:            rp.InvoiceAccepted,
+	}
+	if !reflect.DeepEqual(gotHeld, want) {
+		t.Errorf("got %v, wanted %v", gotHeld, want)
+	}
+
+	// only settled invoices are paid, and they are all that is replayed
+	want.Paid = true
+	want.State = rp.InvoiceSettled
+	want.Cursor = 3
+	if !reflect.DeepEqual(gotPaid, want) {
+		t.Errorf("got %v, wanted %v", gotPaid, want)
+	}
+	replay, err := lnd.PaidInvoicesStreamFrom(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-replay; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	if err := lnd.SettleHoldInvoice(hex.EncodeToString(preimage)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(settled, preimage) {
+		t.Errorf("got %x, wanted %x", settled, preimage)
+	}
+	err = lnd.CancelHoldInvoice(checkingID)
+	if !errors.Is(err, rp.ErrAlreadyPaid) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrAlreadyPaid)
+	}
+	if !bytes.Equal(cancelled, hash[:]) {
+		t.Errorf("got %x, wanted %x", cancelled, hash)
+	}
+}
+
 func TestGetInvoiceStatus(t *testing.T) {
 	lightning, _, lnd := setupMocks()
 	lightning.LookupInvoiceMock = func(_ *lnrpc.PaymentHash) (*lnrpc.Invoice, error) {
@@ -88,6 +239,9 @@ func TestGetInvoiceStatus(t *testing.T) {
 			PaymentRequest: "ln000",
 			State:          lnrpc.Invoice_SETTLED,
 			AmtPaidMsat:    10000,
+			CreationDate:   1000,
+			Expiry:         3600,
+			SettleDate:     1100,
 		}, nil
 	}
 	checkingID := "ff"
@@ -96,12 +250,73 @@ func TestGetInvoiceStatus(t *testing.T) {
 		Exists:           true,
 		Paid:             true,
 		MSatoshiReceived: 10000,
+		State:            rp.InvoiceSettled,
+		Invoice:          "ln000",
+		CreatedAt:        time.Unix(1000, 0),
+		ExpiresAt:        time.Unix(4600, 0),
+		SettledAt:        time.Unix(1100, 0),
 	}
 	got, err := lnd.GetInvoiceStatus(checkingID)
 	if err != nil {
 		t.Errorf("got %v, wanted %v", err, nil)
 	}
-	if got != want {
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestGetInvoiceStatus_Keysend(t *testing.T) {
+	lightning, _, lnd := setupMocks()
+	lightning.LookupInvoiceMock = func(_ *lnrpc.PaymentHash) (*lnrpc.Invoice, error) {
+		return &lnrpc.Invoice{
+			RHash:       []byte{255},
+			State:       lnrpc.Invoice_SETTLED,
+			AmtPaidMsat: 10000,
+			IsKeysend:   true,
+			Htlcs: []*lnrpc.InvoiceHTLC{
+				{
+					ChanId:    7,
+					HtlcIndex: 1,
+					AmtMsat:   3000,
+					State:     lnrpc.InvoiceHTLCState_CANCELED,
+				},
+				{
+					ChanId:      7,
+					HtlcIndex:   2,
+					AmtMsat:     10000,
+					AcceptTime:  100,
+					ResolveTime: 101,
+					State:       lnrpc.InvoiceHTLCState_SETTLED,
+					CustomRecords: map[uint64][]byte{
+						rp.KeysendRecord: {5},
+						7629169:          []byte(`{"podcast":"x"}`),
+					},
+				},
+			},
+		}, nil
+	}
+	want := rp.InvoiceStatus{
+		CheckingID:       "ff",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 10000,
+		State:            rp.InvoiceSettled,
+		Keysend:          true,
+		CustomRecords:    map[uint64][]byte{7629169: []byte(`{"podcast":"x"}`)},
+		HTLCs: []rp.HTLC{{
+			ChannelID:     7,
+			ID:            2,
+			Msatoshi:      10000,
+			AcceptedAt:    time.Unix(100, 0),
+			SettledAt:     time.Unix(101, 0),
+			CustomRecords: map[uint64][]byte{7629169: []byte(`{"podcast":"x"}`)},
+		}},
+	}
+	got, err := lnd.GetInvoiceStatus("ff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, wanted %v", got, want)
 	}
 }
@@ -123,12 +338,14 @@ func TestGetInvoiceStatus_NotPaid(t *testing.T) {
 		Exists:           true,
 		Paid:             false,
 		MSatoshiReceived: 0,
+		State:            rp.InvoiceOpen,
+		Invoice:          "ln000",
 	}
 	got, err := lnd.GetInvoiceStatus(checkingID)
 	if err != nil {
 		t.Errorf("got %v, wanted %v", err, nil)
 	}
-	if got != want {
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, wanted %v", got, want)
 	}
 }
@@ -136,7 +353,7 @@ func TestGetInvoiceStatus_NotPaid(t *testing.T) {
 func TestGetInvoiceStatus_NotFound(t *testing.T) {
 	lightning, _, lnd := setupMocks()
 	lightning.LookupInvoiceMock = func(_ *lnrpc.PaymentHash) (*lnrpc.Invoice, error) {
-		return nil, errors.New("not found")
+		return nil, status.Error(codes.NotFound, "unable to locate invoice")
 	}
 	checkingID := "ff"
 	want := rp.InvoiceStatus{
@@ -149,15 +366,28 @@ func TestGetInvoiceStatus_NotFound(t *testing.T) {
 	if err != nil {
 		t.Errorf("got %v, wanted %v", err, nil)
 	}
-	if got != want {
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, wanted %v", got, want)
 	}
 }
 
+func TestGetInvoiceStatus_Error(t *testing.T) {
+	lightning, _, lnd := setupMocks()
+	lightning.LookupInvoiceMock = func(_ *lnrpc.PaymentHash) (*lnrpc.Invoice, error) {
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	}
+
+	_, err := lnd.GetInvoiceStatus("ff")
+	if !errors.Is(err, rp.ErrBackendUnavailable) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrBackendUnavailable)
+	}
+}
+
 func TestMakePayment(t *testing.T) {
 	_, router, lnd := setupMocks()
+	defer lnd.Close()
 	router.SendPaymentV2Mock = func(req *routerrpc.SendPaymentRequest) ([]*lnrpc.Payment, error) {
-		return []*lnrpc.Payment{}, nil
+		return []*lnrpc.Payment{{Status: lnrpc.Payment_IN_FLIGHT}}, nil
 	}
 	router.TrackPaymentV2Mock = func(req *routerrpc.TrackPaymentRequest) ([]*lnrpc.Payment, error) {
 		return []*lnrpc.Payment{}, nil
@@ -179,6 +409,7 @@ func TestMakePayment(t *testing.T) {
 
 func TestMakePayment_CustomAmount(t *testing.T) {
 	_, router, lnd := setupMocks()
+	defer lnd.Close()
 	var called *routerrpc.SendPaymentRequest
 	router.SendPaymentV2Mock = func(req *routerrpc.SendPaymentRequest) ([]*lnrpc.Payment, error) {
 		called = req
@@ -205,8 +436,75 @@ func TestMakePayment_CustomAmount(t *testing.T) {
 	}
 }
 
+func TestSendPaymentRequest(t *testing.T) {
+	tests := []struct {
+		params      rp.PaymentParams
+		wantFee     int64
+		wantTimeout int32
+	}{
+		{rp.PaymentParams{}, 175001, 30},
+		{rp.PaymentParams{CustomAmount: 10000}, 2000, 30},
+		{rp.PaymentParams{MaxFeeMsat: 1000}, 1000, 30},
+		{rp.PaymentParams{MaxFeePercent: 0.5}, 87500, 30},
+		{rp.PaymentParams{MaxFeeMsat: 100000, MaxFeePercent: 1}, 100000, 30},
+		{rp.PaymentParams{Timeout: 1500 * time.Millisecond}, 175001, 2},
+	}
+	for _, tt := range tests {
+		req := SendPaymentRequest(tt.params, 17500100)
+		if req.FeeLimitMsat != tt.wantFee {
+			t.Errorf("got %v, wanted %v", req.FeeLimitMsat, tt.wantFee)
+		}
+		if req.TimeoutSeconds != tt.wantTimeout {
+			t.Errorf("got %v, wanted %v", req.TimeoutSeconds, tt.wantTimeout)
+		}
+	}
+}
+
+func TestMakeKeysend(t *testing.T) {
+	_, router, lnd := setupMocks()
+	defer lnd.Close()
+	var called *routerrpc.SendPaymentRequest
+	router.SendPaymentV2Mock = func(req *routerrpc.SendPaymentRequest) ([]*lnrpc.Payment, error) {
+		called = req
+		return []*lnrpc.Payment{{Status: lnrpc.Payment_IN_FLIGHT}}, nil
+	}
+	router.TrackPaymentV2Mock = func(req *routerrpc.TrackPaymentRequest) ([]*lnrpc.Payment, error) {
+		return []*lnrpc.Payment{}, nil
+	}
+
+	dest := "02" + strings.Repeat("ab", 32)
+	got, err := lnd.MakeKeysend(rp.KeysendParams{
+		Destination:   dest,
+		Msatoshi:      21000,
+		CustomRecords: map[uint64][]byte{7629169: []byte(`{"podcast":"x"}`)},
+	})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+
+	preimage := called.DestCustomRecords[rp.KeysendRecord]
+	hash := sha256.Sum256(preimage)
+	if got.CheckingID != hex.EncodeToString(hash[:]) {
+		t.Errorf("got %v, wanted %x", got.CheckingID, hash)
+	}
+	if !bytes.Equal(called.PaymentHash, hash[:]) {
+		t.Errorf("got %x, wanted %x", called.PaymentHash, hash)
+	}
+	if hex.EncodeToString(called.Dest) != dest || called.AmtMsat != 21000 {
+		t.Errorf("got %x %v, wanted %v %v", called.Dest, called.AmtMsat, dest, 21000)
+	}
+	if got := string(called.DestCustomRecords[7629169]); got != `{"podcast":"x"}` {
+		t.Errorf("got %v, wanted %v", got, `{"podcast":"x"}`)
+	}
+
+	if _, err := lnd.MakeKeysend(rp.KeysendParams{Destination: "ab", Msatoshi: 1}); err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+}
+
 func TestMakePayment_SendPaymentError(t *testing.T) {
 	_, router, lnd := setupMocks()
+	defer lnd.Close()
 	router.SendPaymentV2Mock = func(req *routerrpc.SendPaymentRequest) ([]*lnrpc.Payment, error) {
 		return nil, errors.New("error")
 	}
@@ -224,6 +522,61 @@ func TestMakePayment_SendPaymentError(t *testing.T) {
 	}
 }
 
+func TestMakePayment_NoRoute(t *testing.T) {
+	_, router, lnd := setupMocks()
+	defer lnd.Close()
+	router.SendPaymentV2Mock = func(req *routerrpc.SendPaymentRequest) ([]*lnrpc.Payment, error) {
+		return []*lnrpc.Payment{{
+			Status:        lnrpc.Payment_FAILED,
+			FailureReason: lnrpc.PaymentFailureReason_FAILURE_REASON_NO_ROUTE,
+		}}, nil
+	}
+
+	params := rp.PaymentParams{
+		Invoice: "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3",
+	}
+	_, err := lnd.MakePayment(params)
+	if !errors.Is(err, rp.ErrNoRoute) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrNoRoute)
+	}
+
+	_, err = lnd.MakePayment(rp.PaymentParams{Invoice: "lnbc1garbage"})
+	if !errors.Is(err, rp.ErrInvalidInvoice) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrInvalidInvoice)
+	}
+}
+
+func TestMapError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{status.Error(codes.NotFound, "payment isn't initiated"), rp.ErrInvoiceNotFound},
+		{errors.New("unable to locate invoice"), rp.ErrInvoiceNotFound},
+		{status.Error(codes.Unavailable, "connection refused"), rp.ErrBackendUnavailable},
+		{status.Error(codes.Unknown, "invoice expired. Valid until 2022-01-01"), rp.ErrInvoiceExpired},
+		{status.Error(codes.AlreadyExists, "invoice is already paid"), rp.ErrAlreadyPaid},
+		{errors.New("insufficient local balance"), rp.ErrInsufficientBalance},
+		{errors.New("unable to find a path to destination"), rp.ErrNoRoute},
+		{errors.New("invalid payment request: checksum failed"), rp.ErrInvalidInvoice},
+		{FailureError(lnrpc.PaymentFailureReason_FAILURE_REASON_INSUFFICIENT_BALANCE), rp.ErrInsufficientBalance},
+		{errors.New("something else"), nil},
+	}
+
+	for _, test := range tests {
+		got := MapError(test.err)
+		if test.want == nil {
+			if got != test.err {
+				t.Errorf("got %v, wanted %v", got, test.err)
+			}
+			continue
+		}
+		if !errors.Is(got, test.want) {
+			t.Errorf("got %v, wanted %v for '%v'", got, test.want, test.err)
+		}
+	}
+}
+
 func TestGetPaymentStatus(t *testing.T) {
 	_, router, lnd := setupMocks()
 	router.TrackPaymentV2Mock = func(req *routerrpc.TrackPaymentRequest) ([]*lnrpc.Payment, error) {
@@ -286,8 +639,83 @@ func TestGetPaymentStatus_NotFound(t *testing.T) {
 	}
 }
 
+func TestTrackPayment_Errors(t *testing.T) {
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = time.Millisecond
+	limit := TrackPaymentRetryLimit
+	t.Cleanup(func() { TrackPaymentRetryLimit = limit })
+	TrackPaymentRetryLimit = 50 * time.Millisecond
+
+	errs := make(chan error, 100)
+	onError := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	router := &MockRouterClient{}
+	lnd := newLndWallet(Params{OnError: onError}, nil, &MockLightningClient{}, router, nil)
+	defer lnd.Close()
+	router.TrackPaymentV2Mock = func(req *routerrpc.TrackPaymentRequest) ([]*lnrpc.Payment, error) {
+		return nil, errors.New("lnd is restarting")
+	}
+
+	payments, err := lnd.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	// a bad hash and a payment lnd can't tell us about are both reported as
+	// unknown instead of crashing
+	for _, hash := range []string{"not hex", "3f06"} {
+		lnd.life.Spawn(func() { lnd.trackOutgoingPayment(hash) })
+
+		want := rp.PaymentStatus{CheckingID: hash, Status: rp.Unknown}
+		if got := <-payments; got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	}
+
+	if len(errs) < 2 {
+		t.Errorf("got %v errors, wanted at least %v", len(errs), 2)
+	}
+}
+
+func TestTrackPayment_InFlight(t *testing.T) {
+	router := &MockRouterClient{}
+	lnd := newLndWallet(Params{}, nil, &MockLightningClient{}, router, nil)
+	defer lnd.Close()
+	router.TrackPaymentV2Mock = func(req *routerrpc.TrackPaymentRequest) ([]*lnrpc.Payment, error) {
+		return []*lnrpc.Payment{
+			{Status: lnrpc.Payment_IN_FLIGHT},
+			{Status: lnrpc.Payment_SUCCEEDED, FeeMsat: 3, PaymentPreimage: "05"},
+		}, nil
+	}
+
+	payments, err := lnd.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	lnd.life.Spawn(func() { lnd.trackOutgoingPayment("3f06") })
+
+	// the update of it being in flight is waited through
+	want := rp.PaymentStatus{CheckingID: "3f06", Status: rp.Complete, FeePaid: 3, Preimage: "05"}
+	select {
+	case got := <-payments:
+		if got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("got nothing, wanted %v", want)
+	}
+}
+
 func TestPaidInvoicesStream(t *testing.T) {
 	lightning, _, lnd := setupMocks()
+	defer lnd.Close()
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
 	PaymentPollInterval = time.Millisecond
 	lightning.SubscribeInvoicesMock = func(sub *lnrpc.InvoiceSubscription) ([]*lnrpc.Invoice, error) {
 		return []*lnrpc.Invoice{
@@ -312,18 +740,193 @@ func TestPaidInvoicesStream(t *testing.T) {
 		Exists:           true,
 		Paid:             true,
 		MSatoshiReceived: 1000,
+		State:            rp.InvoiceSettled,
 	}
 
-	go lnd.startInvoicesStream()
+	lnd.life.Spawn(lnd.startInvoicesStream)
 
 	stream, err := lnd.PaidInvoicesStream()
 	if err != nil {
 		t.Errorf("got %v, wanted %v", err, nil)
 	}
 	got := <-stream
-	if got != want {
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestPaidInvoicesStreamFrom(t *testing.T) {
+	lightning, _, lnd := setupMocks()
+	defer lnd.Close()
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = time.Millisecond
+
+	requested := make(chan uint64, 2)
+	lightning.SubscribeInvoicesMock = func(sub *lnrpc.InvoiceSubscription) ([]*lnrpc.Invoice, error) {
+		requested <- sub.SettleIndex
+		if len(requested) == 1 {
+			return nil, errors.New("lnd is restarting")
+		}
+		return []*lnrpc.Invoice{{
+			RHash:       []byte{18},
+			State:       lnrpc.Invoice_SETTLED,
+			AmtPaidMsat: 2000,
+			SettleIndex: 8,
+		}}, nil
+	}
+
+	stream, err := lnd.PaidInvoicesStreamFrom(context.Background(), 7)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "12",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 2000,
+		State:            rp.InvoiceSettled,
+		Cursor:           8,
+	}
+	if got := <-stream; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	// it subscribed again after the error, from the same cursor
+	for i := 0; i < 2; i++ {
+		if got := <-requested; got != 7 {
+			t.Errorf("got %v, wanted %v", got, 7)
+		}
+	}
+}
+
+func TestPaidInvoicesStreamCtx(t *testing.T) {
+	_, _, lnd := setupMocks()
+	defer lnd.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	detached, err := lnd.PaidInvoicesStreamCtx(ctx)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	stream, err := lnd.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	cancel()
+	if _, ok := <-detached; ok {
+		t.Errorf("detached stream wasn't closed")
+	}
+
+	// the remaining listener still gets everything, nothing blocks on the
+	// one that went away
+	want := rp.InvoiceStatus{CheckingID: "11", Exists: true, Paid: true, MSatoshiReceived: 1000}
+	go lnd.invoices.Publish(want)
+	if got := <-stream; !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, wanted %v", got, want)
 	}
+
+	invoices, _ := lnd.StreamStats()
+	if invoices.Subscribers != 1 {
+		t.Errorf("got %v listeners, wanted %v", invoices.Subscribers, 1)
+	}
+}
+
+func TestClose(t *testing.T) {
+	lightning, router, lnd := setupMocks()
+	lightning.SubscribeInvoicesMock = func(sub *lnrpc.InvoiceSubscription) ([]*lnrpc.Invoice, error) {
+		return []*lnrpc.Invoice{}, nil
+	}
+	lightning.ListPaymentsMock = func(req *lnrpc.ListPaymentsRequest) (*lnrpc.ListPaymentsResponse, error) {
+		return &lnrpc.ListPaymentsResponse{Payments: []*lnrpc.Payment{{
+			PaymentHash:  "3f06a81e0a0c2ad34ee9df2a30d87a810da9e3c3881f780755ace5e5e64d30a7",
+			PaymentIndex: 1,
+		}}}, nil
+	}
+	router.TrackPaymentV2Mock = func(req *routerrpc.TrackPaymentRequest) ([]*lnrpc.Payment, error) {
+		return []*lnrpc.Payment{}, nil
+	}
+
+	before := runtime.NumGoroutine()
+
+	lnd.life.Spawn(lnd.startInvoicesStream)
+	lnd.life.Spawn(lnd.startPaymentsStream)
+	invoices, err := lnd.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	payments, err := lnd.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	if err := lnd.Close(); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if _, ok := <-invoices; ok {
+		t.Errorf("invoices stream wasn't closed")
+	}
+	if _, ok := <-payments; ok {
+		t.Errorf("payments stream wasn't closed")
+	}
+	if _, err := lnd.PaidInvoicesStream(); err != rp.ErrClosed {
+		t.Errorf("got %v, wanted %v", err, rp.ErrClosed)
+	}
+	if err := lnd.Close(); err != nil {
+		t.Errorf("got %v, wanted %v on second Close", err, nil)
+	}
+
+	// every goroutine started by the wallet should be gone by now
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("got %v goroutines, wanted %v", got, before)
+	}
+}
+
+func TestStart_Proxy(t *testing.T) {
+	der, key := testCertificate(t)
+	server := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	})))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Stop()
+
+	proxy := socks5test.NewServer(t, "", "")
+	proxy.AddHost("lnd.onion:10009", listener.Addr().String())
+
+	m, _ := macaroon.New([]byte("root key"), []byte("id"), "lnd", macaroon.LatestVersion)
+	mac, _ := m.MarshalBinary()
+	l, err := Start(Params{
+		Host:           "lnd.onion:10009",
+		Cert:           der,
+		Macaroon:       mac,
+		ConnectTimeout: time.Second,
+		Proxy:          proxy.URL(),
+		OnError:        func(error) {},
+	})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	l.Close()
+
+	targets := proxy.Targets()
+	if len(targets) == 0 {
+		t.Errorf("nothing went through the proxy")
+	}
+	for _, target := range targets {
+		if target != "lnd.onion:10009" {
+			t.Errorf("got %v, wanted %v", target, "lnd.onion:10009")
+		}
+	}
 }
 
 //#############//
@@ -332,26 +935,40 @@ func TestPaidInvoicesStream(t *testing.T) {
 
 type PaymentStreamMock struct {
 	grpc.ClientStream
+	ctx  context.Context
 	Data chan *lnrpc.Payment
 }
 
 type InvoiceStreamMock struct {
 	grpc.ClientStream
+	ctx  context.Context
 	Data chan *lnrpc.Invoice
 }
 
 func (s PaymentStreamMock) Recv() (*lnrpc.Payment, error) {
-	return <-s.Data, nil
+	select {
+	case d := <-s.Data:
+		return d, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
 }
 
 func (s InvoiceStreamMock) Recv() (*lnrpc.Invoice, error) {
-	return <-s.Data, nil
+	select {
+	case d := <-s.Data:
+		return d, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
 }
 
 type MockLightningClient struct {
 	lnrpc.LightningClient
 
 	ChannelBalanceMock    func(*lnrpc.ChannelBalanceRequest) (*lnrpc.ChannelBalanceResponse, error)
+	GetInfoMock           func(*lnrpc.GetInfoRequest) (*lnrpc.GetInfoResponse, error)
+	WalletBalanceMock     func(*lnrpc.WalletBalanceRequest) (*lnrpc.WalletBalanceResponse, error)
 	AddInvoiceMock        func(*lnrpc.Invoice) (*lnrpc.AddInvoiceResponse, error)
 	LookupInvoiceMock     func(*lnrpc.PaymentHash) (*lnrpc.Invoice, error)
 	ListPaymentsMock      func(*lnrpc.ListPaymentsRequest) (*lnrpc.ListPaymentsResponse, error)
@@ -365,12 +982,50 @@ type MockRouterClient struct {
 	TrackPaymentV2Mock func(request *routerrpc.TrackPaymentRequest) ([]*lnrpc.Payment, error)
 }
 
+type MockInvoicesClient struct {
+	invoicesrpc.InvoicesClient
+
+	AddHoldInvoiceMock func(*invoicesrpc.AddHoldInvoiceRequest) (*invoicesrpc.AddHoldInvoiceResp, error)
+	SettleInvoiceMock  func(*invoicesrpc.SettleInvoiceMsg) (*invoicesrpc.SettleInvoiceResp, error)
+	CancelInvoiceMock  func(*invoicesrpc.CancelInvoiceMsg) (*invoicesrpc.CancelInvoiceResp, error)
+}
+
+func (m *MockInvoicesClient) AddHoldInvoice(
+	_ context.Context, req *invoicesrpc.AddHoldInvoiceRequest, _ ...grpc.CallOption,
+) (*invoicesrpc.AddHoldInvoiceResp, error) {
+	return m.AddHoldInvoiceMock(req)
+}
+
+func (m *MockInvoicesClient) SettleInvoice(
+	_ context.Context, req *invoicesrpc.SettleInvoiceMsg, _ ...grpc.CallOption,
+) (*invoicesrpc.SettleInvoiceResp, error) {
+	return m.SettleInvoiceMock(req)
+}
+
+func (m *MockInvoicesClient) CancelInvoice(
+	_ context.Context, req *invoicesrpc.CancelInvoiceMsg, _ ...grpc.CallOption,
+) (*invoicesrpc.CancelInvoiceResp, error) {
+	return m.CancelInvoiceMock(req)
+}
+
 func (m *MockLightningClient) ChannelBalance(
 	_ context.Context, req *lnrpc.ChannelBalanceRequest, _ ...grpc.CallOption,
 ) (*lnrpc.ChannelBalanceResponse, error) {
 	return m.ChannelBalanceMock(req)
 }
 
+func (m *MockLightningClient) GetInfo(
+	_ context.Context, req *lnrpc.GetInfoRequest, _ ...grpc.CallOption,
+) (*lnrpc.GetInfoResponse, error) {
+	return m.GetInfoMock(req)
+}
+
+func (m *MockLightningClient) WalletBalance(
+	_ context.Context, req *lnrpc.WalletBalanceRequest, _ ...grpc.CallOption,
+) (*lnrpc.WalletBalanceResponse, error) {
+	return m.WalletBalanceMock(req)
+}
+
 func (m *MockLightningClient) AddInvoice(
 	_ context.Context, req *lnrpc.Invoice, _ ...grpc.CallOption,
 ) (*lnrpc.AddInvoiceResponse, error) {
@@ -390,9 +1045,9 @@ func (m *MockLightningClient) ListPayments(
 }
 
 func (m *MockLightningClient) SubscribeInvoices(
-	_ context.Context, req *lnrpc.InvoiceSubscription, _ ...grpc.CallOption,
+	ctx context.Context, req *lnrpc.InvoiceSubscription, _ ...grpc.CallOption,
 ) (lnrpc.Lightning_SubscribeInvoicesClient, error) {
-	client := InvoiceStreamMock{Data: make(chan *lnrpc.Invoice)}
+	client := InvoiceStreamMock{ctx: ctx, Data: make(chan *lnrpc.Invoice)}
 	data, err := m.SubscribeInvoicesMock(req)
 	if err != nil {
 		return nil, err
@@ -405,9 +1060,9 @@ func (m *MockLightningClient) SubscribeInvoices(
 }
 
 func (m *MockRouterClient) SendPaymentV2(
-	_ context.Context, req *routerrpc.SendPaymentRequest, _ ...grpc.CallOption,
+	ctx context.Context, req *routerrpc.SendPaymentRequest, _ ...grpc.CallOption,
 ) (routerrpc.Router_SendPaymentV2Client, error) {
-	client := PaymentStreamMock{Data: make(chan *lnrpc.Payment)}
+	client := PaymentStreamMock{ctx: ctx, Data: make(chan *lnrpc.Payment)}
 	data, err := m.SendPaymentV2Mock(req)
 	if err != nil {
 		return nil, err
@@ -420,9 +1075,9 @@ func (m *MockRouterClient) SendPaymentV2(
 }
 
 func (m *MockRouterClient) TrackPaymentV2(
-	_ context.Context, req *routerrpc.TrackPaymentRequest, _ ...grpc.CallOption,
+	ctx context.Context, req *routerrpc.TrackPaymentRequest, _ ...grpc.CallOption,
 ) (routerrpc.Router_TrackPaymentV2Client, error) {
-	client := PaymentStreamMock{Data: make(chan *lnrpc.Payment)}
+	client := PaymentStreamMock{ctx: ctx, Data: make(chan *lnrpc.Payment)}
 	data, err := m.TrackPaymentV2Mock(req)
 	if err != nil {
 		return nil, err
@@ -434,11 +1089,8 @@ func (m *MockRouterClient) TrackPaymentV2(
 	return client, nil
 }
 
-func setupMocks() (*MockLightningClient, *MockRouterClient, LndWallet) {
+func setupMocks() (*MockLightningClient, *MockRouterClient, *LndWallet) {
 	lightning := &MockLightningClient{}
 	router := &MockRouterClient{}
-	return lightning, router, LndWallet{
-		Lightning: lightning,
-		Router:    router,
-	}
+	return lightning, router, newLndWallet(Params{}, nil, lightning, router, nil)
 }
@@ -0,0 +1,205 @@
+package lnd
+
+// The functions in this file follow lnd's invoice and payment streams,
+// regardless of how lnd is reached, so the lndrest backend uses them too.
+// Backends only open the streams and give back how to receive from them.
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	rp "github.com/lnbits/relampago"
+	backoff "gopkg.in/cenkalti/backoff.v1"
+)
+
+// InvoiceRecv receives the next update of an invoices subscription.
+type InvoiceRecv func() (*lnrpc.Invoice, error)
+
+// PaymentRecv receives the next update of a TrackPaymentV2 stream.
+type PaymentRecv func() (*lnrpc.Payment, error)
+
+// SubscribeInvoices gives emit every invoice settled after settleIndex, and
+// the hold invoices accepted meanwhile, until ctx is done. subscribe opens a
+// subscription from a settle index, which is done with once its ctx is. It is
+// reopened with backoff from retry whenever it breaks, from the last settle
+// index seen, so nothing settled in between is missed.
+func SubscribeInvoices(
+	ctx context.Context,
+	settleIndex uint64,
+	subscribe func(ctx context.Context, settleIndex uint64) (InvoiceRecv, error),
+	retry time.Duration,
+	emit func(rp.InvoiceStatus),
+	report func(error),
+) {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = retry
+	b.MaxElapsedTime = 0 // never give up
+	b.Reset()
+
+	for {
+		subCtx, cancel := context.WithCancel(ctx)
+		recv, err := subscribe(subCtx, settleIndex)
+		for err == nil {
+			var res *lnrpc.Invoice
+			res, err = recv()
+			if err != nil {
+				break
+			}
+			b.Reset()
+
+			if res.State != lnrpc.Invoice_SETTLED && res.State != lnrpc.Invoice_ACCEPTED {
+				continue // Only notify for paid and held invoices
+			}
+			if res.SettleIndex > settleIndex {
+				settleIndex = res.SettleIndex
+			}
+			emit(InvoiceToInvoiceStatus(res))
+		}
+		cancel()
+
+		if ctx.Err() != nil {
+			return
+		}
+		report(fmt.Errorf("invoices subscription broke, reconnecting: %w", err))
+		select {
+		case <-time.After(b.NextBackOff()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TrackPendingPayments gets the payments in flight from pending, retrying
+// with backoff from retry until life is closed, and has each followed by
+// track in a goroutine of life.
+func TrackPendingPayments(
+	life *rp.Lifecycle,
+	pending func() ([]*lnrpc.Payment, error),
+	retry time.Duration,
+	track func(hash string),
+) {
+	var payments []*lnrpc.Payment
+	err := backoff.RetryNotify(func() (err error) {
+		payments, err = pending()
+		return err
+	}, RetryBackOff(life.Context(), retry, 0), func(err error, _ time.Duration) {
+		life.ReportError(err)
+	})
+	if err != nil {
+		return
+	}
+
+	for _, payment := range payments {
+		hash := payment.PaymentHash
+		life.Spawn(func() { track(hash) })
+	}
+}
+
+// TrackPayment gives publish the final status of the payment with hash, from
+// the TrackPaymentV2 streams track opens, which are done with once their ctx
+// is. Errors go to report and are retried with backoff from retry for up to
+// limit, after which the payment is published with an Unknown status.
+// Nothing is published when ctx is done first or lnd never attempted it.
+func TrackPayment(
+	ctx context.Context,
+	hash string,
+	track func(ctx context.Context, paymentHash []byte) (PaymentRecv, error),
+	retry, limit time.Duration,
+	publish func(rp.PaymentStatus),
+	report func(error),
+) {
+	status := rp.PaymentStatus{
+		Status:     rp.Unknown,
+		CheckingID: hash,
+	}
+
+	paymentHash, err := hex.DecodeString(hash)
+	if err != nil {
+		report(fmt.Errorf("failed to decode hex on trackOutgoingPayment(%s): %w",
+			hash, err))
+		publish(status)
+		return
+	}
+
+	var done bool
+	err = backoff.RetryNotify(func() (err error) {
+		trackCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		status, done, err = waitPayment(trackCtx, hash, paymentHash, track)
+		return err
+	}, RetryBackOff(ctx, retry, limit), func(err error, _ time.Duration) {
+		report(err)
+	})
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		// we don't know what happened, but listeners shouldn't wait forever
+		publish(status)
+		return
+	}
+	if !done {
+		return
+	}
+
+	// at this point we know this payment either failed or succeeded
+	publish(status)
+}
+
+// waitPayment follows a payment until it either failed or succeeded, which is
+// when done is true, waiting through the updates of it being in flight.
+func waitPayment(
+	ctx context.Context,
+	hash string,
+	paymentHash []byte,
+	track func(ctx context.Context, paymentHash []byte) (PaymentRecv, error),
+) (status rp.PaymentStatus, done bool, err error) {
+	status = rp.PaymentStatus{
+		Status:     rp.Unknown,
+		CheckingID: hash,
+	}
+
+	recv, err := track(ctx, paymentHash)
+	if err != nil {
+		return status, false, fmt.Errorf(
+			"failed to track payment on trackOutgoingPayment(%s): %w", hash, err)
+	}
+
+	for {
+		payment, err := recv()
+		if err != nil {
+			return status, false, fmt.Errorf(
+				"failed to receive payment update on trackOutgoingPayment(%s): %w", hash, err)
+		}
+
+		switch payment.Status {
+		case lnrpc.Payment_SUCCEEDED:
+			status.Status = rp.Complete
+			status.FeePaid = payment.FeeMsat
+			status.Preimage = payment.PaymentPreimage
+			return status, true, nil
+		case lnrpc.Payment_FAILED:
+			status.Status = rp.Failed
+			return status, true, nil
+		case lnrpc.Payment_UNKNOWN:
+			// was never attempted (but maybe it will still be in the next seconds?)
+			return status, false, nil
+		default:
+			// still in flight, wait for the next update
+		}
+	}
+}
+
+// RetryBackOff is how the background streams retry after errors from lnd,
+// starting at interval, for up to limit or forever if it is zero, stopping
+// when ctx is done.
+func RetryBackOff(ctx context.Context, interval, limit time.Duration) backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = interval
+	b.MaxElapsedTime = limit
+	b.Reset()
+	return backoff.WithContext(b, ctx)
+}
@@ -0,0 +1,732 @@
+package lndrest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/invoicesrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/lnd"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// PaymentPollInterval is how long the event streams wait before trying again
+// after an error from lnd.
+var PaymentPollInterval = 5 * time.Second
+
+// TrackPaymentRetryLimit is for how long tracking a payment is retried after
+// errors before it is reported with an Unknown status.
+var TrackPaymentRetryLimit = 15 * time.Minute
+
+type Params struct {
+	Host           string // the REST endpoint, like https://127.0.0.1:8080
+	CertPath       string // optional, if set only this exact certificate is accepted
+	MacaroonPath   string
+	Cert           []byte // optional, PEM, pinned instead of the one at CertPath
+	Macaroon       []byte // optional, binary, used instead of reading MacaroonPath
+	ConnectTimeout time.Duration
+	Proxy          string // optional, a SOCKS5 proxy every connection goes through
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, errors from background streams, logged otherwise
+}
+
+type LndRestWallet struct {
+	Params
+
+	client   *http.Client
+	macaroon string // hex, as lnd wants it in the header
+
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+	held     *rp.Broadcaster[rp.InvoiceStatus] // accepted hold invoices
+}
+
+func Start(params Params) (*LndRestWallet, error) {
+	// checks
+	if !strings.HasPrefix(params.Host, "http") {
+		params.Host = "https://" + params.Host
+	}
+	params.Host = strings.TrimSuffix(params.Host, "/")
+
+	// TLS
+	tlsConfig := &tls.Config{}
+	if params.CertPath != "" || len(params.Cert) > 0 {
+		certPEM := params.Cert
+		if len(certPEM) == 0 {
+			var err error
+			certPEM, err = ioutil.ReadFile(params.CertPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+		pinned, err := parseCertificate(certPEM)
+		if err != nil {
+			return nil, err
+		}
+
+		// lnd's certificate is self-signed and often doesn't name the host we
+		// reach it by, so instead of the usual checks we only accept this one
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 || !bytes.Equal(certs[0], pinned) {
+				return errors.New("lnd presented a certificate other than the pinned one")
+			}
+			return nil
+		}
+	}
+
+	// Macaroon Auth
+	macBytes := params.Macaroon
+	if len(macBytes) == 0 {
+		var err error
+		macBytes, err = ioutil.ReadFile(params.MacaroonPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := rp.HTTPClient(params.Proxy, params.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+
+	l := newLndRestWallet(params, client, hex.EncodeToString(macBytes))
+	l.life.Spawn(l.startPaymentsStream)
+	l.life.Spawn(l.startInvoicesStream)
+
+	return l, nil
+}
+
+func newLndRestWallet(params Params, client *http.Client, macaroon string) *LndRestWallet {
+	life := rp.NewLifecycle("lndrest", params.OnError)
+	return &LndRestWallet{
+		Params:   params,
+		client:   client,
+		macaroon: macaroon,
+		life:     life,
+		ctx:      life.Context(),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+		held:     rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+	}
+}
+
+// parseCertificate returns the DER bytes of the first certificate in PEM data.
+func parseCertificate(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found")
+	}
+	return block.Bytes, nil
+}
+
+// Compile time check to ensure that LndRestWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*LndRestWallet)(nil)
+var _ rp.HoldInvoiceWallet = (*LndRestWallet)(nil)
+var _ rp.KeysendWallet = (*LndRestWallet)(nil)
+var _ rp.ResumableWallet = (*LndRestWallet)(nil)
+var _ rp.StreamStatsReporter = (*LndRestWallet)(nil)
+
+func (l *LndRestWallet) Kind() string {
+	return "lndrest"
+}
+
+func (l *LndRestWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		Keysend:               true,
+		HoldInvoices:          true,
+		MPP:                   true,
+		FeeLimits:             true,
+		PaymentTimeout:        true,
+		InvoicePaymentHashIDs: true,
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Close stops all background streams and closes every listener channel. It is
+// safe to call more than once.
+func (l *LndRestWallet) Close() error {
+	if !l.life.Close(l.invoices.Close, l.payments.Close, l.held.Close) {
+		return nil
+	}
+
+	l.client.CloseIdleConnections()
+	return nil
+}
+
+// restError is how the REST gateway reports grpc errors, in responses and as
+// lines of streams.
+type restError struct {
+	Code     int    `json:"code"`
+	GrpcCode int    `json:"grpc_code"`
+	Message  string `json:"message"`
+}
+
+func (e restError) err() error {
+	code := e.Code
+	if code == 0 {
+		code = e.GrpcCode
+	}
+	return lnd.MapError(status.Error(codes.Code(code), e.Message))
+}
+
+// request sends body, if any, to path and returns the response once it is
+// known to be successful. The caller must close its body.
+func (l *LndRestWallet) request(
+	ctx context.Context,
+	method string,
+	path string,
+	body proto.Message,
+) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request to %s: %w", path, err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, l.Host+path, reader)
+	if err != nil {
+		return nil, fmt.Errorf("error creating http request to %s: %w", path, err)
+	}
+	r.Header.Set("Grpc-Metadata-macaroon", l.macaroon)
+
+	w, err := l.client.Do(r)
+	if err != nil {
+		err = fmt.Errorf("call to %s errored: %w", path, err)
+		if ctx.Err() == nil {
+			err = rp.WrapError(rp.ErrBackendUnavailable, err)
+		}
+		return nil, err
+	}
+
+	if w.StatusCode >= 300 {
+		defer w.Body.Close()
+		b, _ := ioutil.ReadAll(w.Body)
+
+		var e restError
+		if err := json.Unmarshal(b, &e); err != nil || e.Message == "" {
+			text := string(b)
+			if len(text) > 200 {
+				text = text[:200]
+			}
+			err = fmt.Errorf("%s returned %s: '%s'", path, w.Status, text)
+			if w.StatusCode >= 500 {
+				err = rp.WrapError(rp.ErrBackendUnavailable, err)
+			}
+			return nil, err
+		}
+		return nil, e.err()
+	}
+
+	return w, nil
+}
+
+// call is a request whose response is a single message, decoded into result.
+func (l *LndRestWallet) call(
+	ctx context.Context,
+	method string,
+	path string,
+	body proto.Message,
+	result proto.Message,
+) error {
+	w, err := l.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer w.Body.Close()
+
+	b, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if err := unmarshal(b, result); err != nil {
+		return fmt.Errorf("failed to decode response from %s: %w", path, err)
+	}
+	return nil
+}
+
+func unmarshal(b []byte, result proto.Message) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, result)
+}
+
+// stream is a request whose response is a stream of messages, one JSON object
+// per line, each either a result or an error.
+type stream struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (l *LndRestWallet) stream(
+	ctx context.Context,
+	method string,
+	path string,
+	body proto.Message,
+) (*stream, error) {
+	w, err := l.request(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{body: w.Body, decoder: json.NewDecoder(w.Body)}, nil
+}
+
+func (s *stream) Recv(result proto.Message) error {
+	var line struct {
+		Result json.RawMessage `json:"result"`
+		Error  *restError      `json:"error"`
+	}
+	if err := s.decoder.Decode(&line); err != nil {
+		return err
+	}
+	if line.Error != nil {
+		return line.Error.err()
+	}
+	return unmarshal(line.Result, result)
+}
+
+func (s *stream) Close() error {
+	return s.body.Close()
+}
+
+// followStream opens a stream for the loops shared with lnd, which are done
+// with it once ctx is, so it is closed then.
+func (l *LndRestWallet) followStream(ctx context.Context, path string) (*stream, error) {
+	s, err := l.stream(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+	return s, nil
+}
+
+func (l *LndRestWallet) GetInfo() (rp.WalletInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.GetInfoCtx(ctx)
+}
+
+func (l *LndRestWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	var balance lnrpc.ChannelBalanceResponse
+	if err := l.call(ctx, "GET", "/v1/balance/channels", nil, &balance); err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling /v1/balance/channels: %w", err)
+	}
+	var info lnrpc.GetInfoResponse
+	if err := l.call(ctx, "GET", "/v1/getinfo", nil, &info); err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling /v1/getinfo: %w", err)
+	}
+	var onchain lnrpc.WalletBalanceResponse
+	if err := l.call(ctx, "GET", "/v1/balance/blockchain", nil, &onchain); err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling /v1/balance/blockchain: %w", err)
+	}
+
+	var network rp.Network
+	if len(info.Chains) > 0 {
+		network = rp.Network(info.Chains[0].Network)
+	}
+
+	return rp.WalletInfo{
+		Balance:      int64(balance.GetLocalBalance().GetMsat()),
+		Pubkey:       info.IdentityPubkey,
+		Alias:        info.Alias,
+		Network:      network,
+		BlockHeight:  info.BlockHeight,
+		Synced:       info.SyncedToChain,
+		Version:      info.Version,
+		OutboundMsat: int64(balance.GetLocalBalance().GetMsat()),
+		InboundMsat:  int64(balance.GetRemoteBalance().GetMsat()),
+		PendingMsat:  int64(balance.GetPendingOpenLocalBalance().GetMsat()),
+		OnchainMsat:  onchain.ConfirmedBalance * 1000,
+	}, nil
+}
+
+func (l *LndRestWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.CreateInvoiceCtx(ctx, params)
+}
+
+func (l *LndRestWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	args := &lnrpc.Invoice{
+		Memo:            params.Description,
+		DescriptionHash: params.DescriptionHash,
+		ValueMsat:       params.Msatoshi,
+	}
+	if params.Expiry != nil {
+		args.Expiry = int64(params.Expiry.Seconds())
+	}
+	var res lnrpc.AddInvoiceResponse
+	if err := l.call(ctx, "POST", "/v1/invoices", args, &res); err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error calling /v1/invoices: %w", err)
+	}
+
+	// fetch the invoice back so we get the preimage lnd generated for it
+	var inv lnrpc.Invoice
+	if err := l.call(ctx, "GET", "/v1/invoice/"+hex.EncodeToString(res.RHash), nil, &inv); err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error calling /v1/invoice: %w", err)
+	}
+
+	return rp.InvoiceData{
+		CheckingID: hex.EncodeToString(inv.RHash),
+		Preimage:   hex.EncodeToString(inv.RPreimage),
+		Invoice:    inv.PaymentRequest,
+	}, nil
+}
+
+func (l *LndRestWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.GetInvoiceStatusCtx(ctx, checkingID)
+}
+
+func (l *LndRestWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	if _, err := hex.DecodeString(checkingID); err != nil {
+		return rp.InvoiceStatus{}, fmt.Errorf("invalid checkingID: %w", err)
+	}
+
+	var inv lnrpc.Invoice
+	if err := l.call(ctx, "GET", "/v1/invoice/"+checkingID, nil, &inv); err != nil {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.InvoiceStatus{
+				CheckingID: checkingID,
+				Exists:     false,
+			}, nil
+		}
+		return rp.InvoiceStatus{}, fmt.Errorf("error calling /v1/invoice: %w", err)
+	}
+	return lnd.InvoiceToInvoiceStatus(&inv), nil
+}
+
+func (l *LndRestWallet) CreateHoldInvoice(params rp.InvoiceParams, paymentHash string) (rp.InvoiceData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.CreateHoldInvoiceCtx(ctx, params, paymentHash)
+}
+
+func (l *LndRestWallet) CreateHoldInvoiceCtx(
+	ctx context.Context,
+	params rp.InvoiceParams,
+	paymentHash string,
+) (rp.InvoiceData, error) {
+	args, err := lnd.HoldInvoiceRequest(params, paymentHash)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+	var res invoicesrpc.AddHoldInvoiceResp
+	if err := l.call(ctx, "POST", "/v2/invoices/hodl", args, &res); err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error calling /v2/invoices/hodl: %w", err)
+	}
+
+	return rp.InvoiceData{
+		CheckingID: paymentHash,
+		Invoice:    res.PaymentRequest,
+	}, nil
+}
+
+func (l *LndRestWallet) SettleHoldInvoice(preimage string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.SettleHoldInvoiceCtx(ctx, preimage)
+}
+
+func (l *LndRestWallet) SettleHoldInvoiceCtx(ctx context.Context, preimage string) error {
+	p, err := lnd.DecodeHash(preimage)
+	if err != nil {
+		return fmt.Errorf("invalid preimage: %w", err)
+	}
+	args := &invoicesrpc.SettleInvoiceMsg{Preimage: p}
+	if err := l.call(ctx, "POST", "/v2/invoices/settle", args, &invoicesrpc.SettleInvoiceResp{}); err != nil {
+		return fmt.Errorf("error calling /v2/invoices/settle: %w", err)
+	}
+	return nil
+}
+
+func (l *LndRestWallet) CancelHoldInvoice(paymentHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.CancelHoldInvoiceCtx(ctx, paymentHash)
+}
+
+func (l *LndRestWallet) CancelHoldInvoiceCtx(ctx context.Context, paymentHash string) error {
+	hash, err := lnd.DecodeHash(paymentHash)
+	if err != nil {
+		return err
+	}
+	args := &invoicesrpc.CancelInvoiceMsg{PaymentHash: hash}
+	if err := l.call(ctx, "POST", "/v2/invoices/cancel", args, &invoicesrpc.CancelInvoiceResp{}); err != nil {
+		return fmt.Errorf("error calling /v2/invoices/cancel: %w", err)
+	}
+	return nil
+}
+
+func (l *LndRestWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.MakePaymentCtx(ctx, params)
+}
+
+func (l *LndRestWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+	}
+
+	return l.sendPayment(ctx, lnd.SendPaymentRequest(params, inv.MSatoshi), inv.PaymentHash)
+}
+
+func (l *LndRestWallet) MakeKeysend(params rp.KeysendParams) (rp.PaymentData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.MakeKeysendCtx(ctx, params)
+}
+
+func (l *LndRestWallet) MakeKeysendCtx(ctx context.Context, params rp.KeysendParams) (rp.PaymentData, error) {
+	req, hash, err := lnd.KeysendRequest(params)
+	if err != nil {
+		return rp.PaymentData{}, err
+	}
+	return l.sendPayment(ctx, req, hash)
+}
+
+// sendPayment starts the payment of req, with the given hash, and follows it
+// in the background once lnd has taken it.
+func (l *LndRestWallet) sendPayment(
+	ctx context.Context,
+	req *routerrpc.SendPaymentRequest,
+	hash string,
+) (rp.PaymentData, error) {
+	stream, err := l.stream(ctx, "POST", "/v2/router/send", req)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("error calling /v2/router/send: %w", err)
+	}
+	defer stream.Close()
+
+	// listen to the first notification, which should be "in_flight"
+	var first lnrpc.Payment
+	if err := stream.Recv(&first); err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to read /v2/router/send on payment %s: %w",
+			hash, err)
+	}
+	if first.Status == lnrpc.Payment_FAILED {
+		// failed before even trying, like when there's no route
+		return rp.PaymentData{}, fmt.Errorf("payment %s failed: %w",
+			hash, lnd.FailureError(first.FailureReason))
+	}
+
+	// track this so it can emit payment notifications
+	l.life.Spawn(func() { l.trackOutgoingPayment(hash) })
+
+	return rp.PaymentData{
+		CheckingID: hash,
+	}, nil
+}
+
+func (l *LndRestWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.GetPaymentStatusCtx(ctx, checkingID)
+}
+
+func (l *LndRestWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	paymentHash, err := hex.DecodeString(checkingID)
+	if err != nil {
+		return rp.PaymentStatus{}, fmt.Errorf("checkingID must be a valid payment hash 32-byte hex, got '%s': %w", checkingID, err)
+	}
+
+	stream, err := l.stream(ctx, "GET", trackPath(paymentHash), nil)
+	if err != nil {
+		return rp.PaymentStatus{}, fmt.Errorf("error calling /v2/router/track: %w", err)
+	}
+	defer stream.Close()
+
+	// the first event will always be the current state of the payment from the db
+	var payment lnrpc.Payment
+	if err := stream.Recv(&payment); err != nil {
+		return rp.PaymentStatus{},
+			fmt.Errorf("error reading /v2/router/track: %w", err)
+	}
+
+	return lnd.PaymentToPaymentStatus(&payment), nil
+}
+
+// trackPath is where the REST gateway serves TrackPaymentV2, which wants the
+// hash in base64 in the path.
+func trackPath(paymentHash []byte) string {
+	return "/v2/router/track/" + base64.URLEncoding.EncodeToString(paymentHash) +
+		"?no_inflight_updates=true"
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (l *LndRestWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return l.invoices.Stats(), l.payments.Stats()
+}
+
+func (l *LndRestWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return l.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (l *LndRestWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return l.invoices.Subscribe(ctx)
+}
+
+// PaidInvoicesStreamFrom opens a subscription of its own to lnd, replaying
+// every invoice with a settle index after cursor.
+func (l *LndRestWallet) PaidInvoicesStreamFrom(ctx context.Context, cursor uint64) (<-chan rp.InvoiceStatus, error) {
+	listener := make(chan rp.InvoiceStatus)
+	ctx, cancel := context.WithCancel(ctx)
+
+	started := l.life.Spawn(func() {
+		defer close(listener)
+		defer cancel()
+
+		// the subscription also ends when the wallet is closed
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-l.ctx.Done():
+				cancel()
+			}
+		}()
+
+		l.subscribeInvoices(ctx, cursor, func(status rp.InvoiceStatus) {
+			if status.State != rp.InvoiceSettled {
+				return // held ones have no settle index yet
+			}
+			select {
+			case listener <- status:
+			case <-ctx.Done():
+			}
+		})
+	})
+	if !started {
+		cancel()
+		return nil, rp.ErrClosed
+	}
+
+	return listener, nil
+}
+
+func (l *LndRestWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
+	return l.PaymentsStreamCtx(context.Background())
+}
+
+func (l *LndRestWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return l.payments.Subscribe(ctx)
+}
+
+// HeldInvoicesStream gets the hold invoices whose payments are accepted.
+func (l *LndRestWallet) HeldInvoicesStream(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return l.held.Subscribe(ctx)
+}
+
+func (l *LndRestWallet) startInvoicesStream() {
+	l.subscribeInvoices(l.ctx, 0, func(status rp.InvoiceStatus) {
+		if status.State == rp.InvoiceAccepted {
+			l.held.Publish(status)
+		} else {
+			l.invoices.Publish(status)
+		}
+	})
+}
+
+func (l *LndRestWallet) subscribeInvoices(
+	ctx context.Context,
+	settleIndex uint64,
+	emit func(rp.InvoiceStatus),
+) {
+	lnd.SubscribeInvoices(ctx, settleIndex, func(ctx context.Context, settleIndex uint64) (lnd.InvoiceRecv, error) {
+		stream, err := l.followStream(ctx,
+			fmt.Sprintf("/v1/invoices/subscribe?settle_index=%d", settleIndex))
+		if err != nil {
+			return nil, err
+		}
+		return func() (*lnrpc.Invoice, error) {
+			var res lnrpc.Invoice
+			if err := stream.Recv(&res); err != nil {
+				return nil, err
+			}
+			return &res, nil
+		}, nil
+	}, PaymentPollInterval, emit, l.life.ReportError)
+}
+
+func (l *LndRestWallet) startPaymentsStream() {
+	lnd.TrackPendingPayments(l.life, l.pendingPayments, PaymentPollInterval, l.trackOutgoingPayment)
+}
+
+// pendingPayments lists the payments still in flight among the latest ones.
+func (l *LndRestWallet) pendingPayments() ([]*lnrpc.Payment, error) {
+	ctx, cancel := context.WithTimeout(l.ctx, 5*time.Second)
+	defer cancel()
+
+	query := url.Values{
+		"include_incomplete": {"true"},
+		"reversed":           {"true"},
+		"max_payments":       {"100"},
+	}
+	var res lnrpc.ListPaymentsResponse
+	if err := l.call(ctx, "GET", "/v1/payments?"+query.Encode(), nil, &res); err != nil {
+		return nil, fmt.Errorf("error listing pending payments: %w", err)
+	}
+
+	var pending []*lnrpc.Payment
+	for _, payment := range res.Payments {
+		if payment.Status == lnrpc.Payment_IN_FLIGHT {
+			pending = append(pending, payment)
+		}
+	}
+	return pending, nil
+}
+
+// trackOutgoingPayment publishes the final status of a payment. Errors are
+// retried with backoff for up to TrackPaymentRetryLimit, after which the
+// payment is published with an Unknown status.
+func (l *LndRestWallet) trackOutgoingPayment(hash string) {
+	lnd.TrackPayment(l.ctx, hash, func(ctx context.Context, paymentHash []byte) (lnd.PaymentRecv, error) {
+		stream, err := l.followStream(ctx, trackPath(paymentHash))
+		if err != nil {
+			return nil, err
+		}
+		return func() (*lnrpc.Payment, error) {
+			var payment lnrpc.Payment
+			if err := stream.Recv(&payment); err != nil {
+				return nil, err
+			}
+			return &payment, nil
+		}, nil
+	}, PaymentPollInterval, TrackPaymentRetryLimit, l.payments.Publish, l.life.ReportError)
+}
@@ -0,0 +1,384 @@
+package lndrest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/socks5test"
+	"github.com/tidwall/gjson"
+)
+
+const invoice = "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3"
+
+func TestGetInfo(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Grpc-Metadata-macaroon"); got != "0201" {
+			t.Errorf("got %v, wanted %v", got, "0201")
+		}
+
+		switch r.URL.Path {
+		case "/v1/balance/channels":
+			fmt.Fprint(w, `{"local_balance":{"sat":"10","msat":"10000"},"remote_balance":{"sat":"20","msat":"20000"},"pending_open_local_balance":{"sat":"5","msat":"5000"}}`)
+		case "/v1/getinfo":
+			fmt.Fprint(w, `{"identity_pubkey":"02aa","alias":"alice","chains":[{"chain":"bitcoin","network":"regtest"}],"block_height":800,"synced_to_chain":true,"version":"0.15.0-beta"}`)
+		case "/v1/balance/blockchain":
+			fmt.Fprint(w, `{"confirmed_balance":"3"}`)
+		}
+	})
+
+	want := rp.WalletInfo{
+		Balance:      10000,
+		Pubkey:       "02aa",
+		Alias:        "alice",
+		Network:      rp.Regtest,
+		BlockHeight:  800,
+		Synced:       true,
+		Version:      "0.15.0-beta",
+		OutboundMsat: 10000,
+		InboundMsat:  20000,
+		PendingMsat:  5000,
+		OnchainMsat:  3000,
+	}
+	got, err := l.GetInfo()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestCreateInvoice(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/invoices":
+			body, _ := io.ReadAll(r.Body)
+			if got := gjson.GetBytes(body, "value_msat").Int(); got != 1000 {
+				t.Errorf("got %v, wanted %v", got, 1000)
+			}
+			fmt.Fprint(w, `{"r_hash":"/w==","payment_request":"lnbc10n1"}`)
+		case "/v1/invoice/ff":
+			fmt.Fprint(w, `{"r_hash":"/w==","r_preimage":"7g==","payment_request":"lnbc10n1"}`)
+		}
+	})
+
+	want := rp.InvoiceData{CheckingID: "ff", Preimage: "ee", Invoice: "lnbc10n1"}
+	got, err := l.CreateInvoice(rp.InvoiceParams{Msatoshi: 1000})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestGetInvoiceStatus(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/invoice/ff":
+			fmt.Fprint(w, `{"r_hash":"/w==","state":"SETTLED","amt_paid_msat":"1000","settle_index":"3"}`)
+		case "/v1/invoice/ee":
+			w.WriteHeader(500)
+			fmt.Fprint(w, `{"code":2,"message":"unable to locate invoice","details":[]}`)
+		case "/v1/invoice/dd":
+			w.WriteHeader(503)
+			fmt.Fprint(w, `{"code":14,"message":"the RPC server is in the process of starting up"}`)
+		}
+	})
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "ff",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 1000,
+		State:            rp.InvoiceSettled,
+		Cursor:           3,
+	}
+	got, err := l.GetInvoiceStatus("ff")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	want = rp.InvoiceStatus{CheckingID: "ee", Exists: false}
+	got, err = l.GetInvoiceStatus("ee")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	_, err = l.GetInvoiceStatus("dd")
+	if !errors.Is(err, rp.ErrBackendUnavailable) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrBackendUnavailable)
+	}
+}
+
+func TestHoldInvoice(t *testing.T) {
+	hash := strings.Repeat("01", 32)
+	preimage := strings.Repeat("02", 32)
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/v2/invoices/hodl":
+			if got := gjson.GetBytes(body, "hash").String(); got != "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=" {
+				t.Errorf("got %v, wanted the payment hash", got)
+			}
+			if got := gjson.GetBytes(body, "value_msat").Int(); got != 1000 {
+				t.Errorf("got %v, wanted %v", got, 1000)
+			}
+			fmt.Fprint(w, `{"payment_request":"lnbc10n1"}`)
+		case "/v2/invoices/settle":
+			if got := gjson.GetBytes(body, "preimage").String(); got != "AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=" {
+				t.Errorf("got %v, wanted the preimage", got)
+			}
+			fmt.Fprint(w, `{}`)
+		case "/v2/invoices/cancel":
+			w.WriteHeader(500)
+			fmt.Fprint(w, `{"code":2,"message":"invoice already settled"}`)
+		}
+	})
+
+	want := rp.InvoiceData{CheckingID: hash, Invoice: "lnbc10n1"}
+	got, err := l.CreateHoldInvoice(rp.InvoiceParams{Msatoshi: 1000}, hash)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	if err := l.SettleHoldInvoice(preimage); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if err := l.CancelHoldInvoice(hash); !errors.Is(err, rp.ErrAlreadyPaid) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrAlreadyPaid)
+	}
+}
+
+func TestMakePayment(t *testing.T) {
+	track := make(chan string)
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/router/send":
+			body, _ := io.ReadAll(r.Body)
+			if got := gjson.GetBytes(body, "payment_request").String(); got != invoice {
+				t.Errorf("got %v, wanted %v", got, invoice)
+			}
+			fmt.Fprintln(w, `{"result":{"status":"IN_FLIGHT"}}`)
+		case "/v2/router/track/PwaoHgoMKtNO6d8qMNh6gQ2p48OIH3gHVazl5eZNMKc=":
+			w.(http.Flusher).Flush()
+			for line := range track {
+				fmt.Fprintln(w, line)
+				w.(http.Flusher).Flush()
+			}
+		}
+	})
+
+	payments, err := l.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	got, err := l.MakePayment(rp.PaymentParams{Invoice: invoice})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	hash := "3f06a81e0a0c2ad34ee9df2a30d87a810da9e3c3881f780755ace5e5e64d30a7"
+	if got.CheckingID != hash {
+		t.Errorf("got %v, wanted %v", got.CheckingID, hash)
+	}
+
+	// in flight updates are skipped until the payment is done
+	track <- `{"result":{"status":"IN_FLIGHT"}}`
+	track <- `{"result":{"status":"SUCCEEDED","fee_msat":"12","payment_preimage":"ee"}}`
+	close(track)
+
+	want := rp.PaymentStatus{
+		CheckingID: hash,
+		Status:     rp.Complete,
+		FeePaid:    12,
+		Preimage:   "ee",
+	}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_NoRoute(t *testing.T) {
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"result":{"status":"FAILED","failure_reason":"FAILURE_REASON_NO_ROUTE"}}`)
+	})
+
+	_, err := l.MakePayment(rp.PaymentParams{Invoice: invoice})
+	if !errors.Is(err, rp.ErrNoRoute) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrNoRoute)
+	}
+}
+
+func TestPaidInvoicesStream(t *testing.T) {
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = 10 * time.Millisecond
+
+	settleIndexes := make(chan string, 10)
+	l := setupServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/invoices/subscribe" {
+			return
+		}
+		settleIndexes <- r.URL.Query().Get("settle_index")
+		if r.URL.Query().Get("settle_index") == "0" {
+			fmt.Fprintln(w, `{"result":{"r_hash":"7g==","state":"OPEN"}}`)
+			fmt.Fprintln(w, `{"result":{"r_hash":"/w==","state":"SETTLED","amt_paid_msat":"1000","settle_index":"4"}}`)
+			return // breaks the subscription
+		}
+		<-r.Context().Done()
+	})
+
+	invoices, err := l.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	l.life.Spawn(l.startInvoicesStream)
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "ff",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 1000,
+		State:            rp.InvoiceSettled,
+		Cursor:           4,
+	}
+	if got := <-invoices; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	// resubscribed from where it was
+	for _, want := range []string{"0", "4"} {
+		if got := <-settleIndexes; got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	}
+}
+
+func TestPinnedCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	// any other certificate, like one lnd made after being reinstalled
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, err := x509.CreateCertificate(rand.Reader,
+		&x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)},
+		&x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	macaroonPath := filepath.Join(dir, "admin.macaroon")
+	os.WriteFile(macaroonPath, []byte{2, 1}, 0600)
+
+	for _, test := range []struct {
+		cert []byte
+		ok   bool
+	}{{server.Certificate().Raw, true}, {other, false}} {
+		certPath := writeCertificate(t, test.cert)
+		l, err := Start(Params{
+			Host:         server.URL,
+			CertPath:     certPath,
+			MacaroonPath: macaroonPath,
+			OnError:      func(error) {},
+		})
+		if err != nil {
+			t.Fatalf("got %v, wanted %v", err, nil)
+		}
+
+		_, err = l.GetInvoiceStatus("ff")
+		if (err == nil) != test.ok {
+			t.Errorf("got %v, wanted ok=%v", err, test.ok)
+		}
+		l.Close()
+	}
+}
+
+func TestStart_Proxy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	proxy := socks5test.NewServer(t, "", "")
+	proxy.AddHost("lnd.onion:8080", server.Listener.Addr().String())
+
+	l, err := Start(Params{
+		Host:     "https://lnd.onion:8080",
+		Cert:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		Macaroon: []byte{2, 1},
+		Proxy:    proxy.URL(),
+		OnError:  func(error) {},
+	})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer l.Close()
+
+	if _, err := l.GetInvoiceStatus("ff"); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	targets := proxy.Targets()
+	if len(targets) == 0 {
+		t.Errorf("nothing went through the proxy")
+	}
+	for _, target := range targets {
+		if target != "lnd.onion:8080" {
+			t.Errorf("got %v, wanted %v", target, "lnd.onion:8080")
+		}
+	}
+}
+
+// setupServer starts a TLS server answering with handler and a wallet that
+// talks to it, trusting its certificate. Neither of the background streams is
+// started, tests that want them spawn them.
+func setupServer(t *testing.T, handler http.HandlerFunc) *LndRestWallet {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	l := newLndRestWallet(Params{Host: server.URL, OnError: func(error) {}}, server.Client(), "0201")
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func writeCertificate(t *testing.T, cert []byte) string {
+	path := filepath.Join(t.TempDir(), "tls.cert")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
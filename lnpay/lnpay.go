@@ -0,0 +1,412 @@
+package lnpay
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/httpjson"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+)
+
+// DefaultHost is where the LNPay API is, unless Params says otherwise.
+const DefaultHost = "https://api.lnpay.co/v1"
+
+// PaymentPollInterval is how often the invoices made by this wallet, and the
+// payments that are still pending, are checked.
+var PaymentPollInterval = 5 * time.Second
+
+// TrackPaymentRetryLimit is for how long a payment is followed before it is
+// published with an Unknown status.
+var TrackPaymentRetryLimit = 15 * time.Minute
+
+// PayTimeout is how long the call that pays an invoice, which only returns
+// once it is done, is waited for.
+var PayTimeout = time.Minute
+
+type Params struct {
+	Host           string // optional, defaults to DefaultHost
+	APIKey         string // the public api key, pak_...
+	WalletKey      string // the wallet access key, waka_... to be able to pay
+	ConnectTimeout time.Duration
+	Proxy          string // optional, a SOCKS5 proxy every connection goes through
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, gets errors from the background streams
+}
+
+type LNPayWallet struct {
+	Params
+	api *httpjson.Client
+
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	open rp.InvoicePoller // the invoices made by this wallet
+
+	mu     sync.Mutex
+	lntxes map[string]string // of the payments made, by hash, empty while paying
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+}
+
+func Start(params Params) (*LNPayWallet, error) {
+	if params.Host == "" {
+		params.Host = DefaultHost
+	}
+	params.Host = strings.TrimSuffix(params.Host, "/")
+
+	client, err := rp.HTTPClient(params.Proxy, params.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLNPayWallet(params, client)
+	if _, err := l.GetInfo(); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to get wallet: %w", err)
+	}
+	l.life.Spawn(l.pollInvoices)
+
+	return l, nil
+}
+
+func newLNPayWallet(params Params, client *http.Client) *LNPayWallet {
+	life := rp.NewLifecycle("lnpay", params.OnError)
+	return &LNPayWallet{
+		Params: params,
+		api: &httpjson.Client{
+			HTTP:         client,
+			Host:         params.Host,
+			Name:         "lnpay",
+			Header:       "X-Api-Key",
+			MessageField: "message",
+			Errors:       lnpayErrors,
+			Timeout:      params.ConnectTimeout,
+		},
+		life:     life,
+		ctx:      life.Context(),
+		lntxes:   make(map[string]string),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+	}
+}
+
+// Compile time check to ensure that LNPayWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*LNPayWallet)(nil)
+var _ rp.StreamStatsReporter = (*LNPayWallet)(nil)
+
+func (l *LNPayWallet) Kind() string {
+	return "lnpay"
+}
+
+func (l *LNPayWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		InvoicePaymentHashIDs: false, // invoices are checked by their lntx id
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Close stops polling and closes every listener channel. It is safe to call
+// more than once.
+func (l *LNPayWallet) Close() error {
+	l.life.Close(l.invoices.Close, l.payments.Close)
+	return nil
+}
+
+// lnpayErrors are the messages LNPay uses for the errors in the root package,
+// checked in order.
+var lnpayErrors = httpjson.Errors{
+	{"insufficient", rp.ErrInsufficientBalance},
+	{"already paid", rp.ErrAlreadyPaid},
+	{"expired", rp.ErrInvoiceExpired},
+	{"no route", rp.ErrNoRoute},
+	{"payment_request", rp.ErrInvalidInvoice},
+}
+
+// call makes a request to the LNPay API, bounded by ctx or by ConnectTimeout
+// when ctx has no deadline. body is sent as JSON.
+func (l *LNPayWallet) call(ctx context.Context, method, path string, body interface{}) (gjson.Result, error) {
+	return l.api.Call(ctx, method, path, l.APIKey, body)
+}
+
+func (l *LNPayWallet) GetInfo() (rp.WalletInfo, error) {
+	return l.GetInfoCtx(context.Background())
+}
+
+func (l *LNPayWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	wallet, err := l.call(ctx, "GET", "/wallet/"+l.WalletKey, nil)
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error getting wallet: %w", err)
+	}
+
+	// LNPay runs the node, all we know is the balance of this wallet on it
+	balance := wallet.Get("balance").Int() * 1000
+	return rp.WalletInfo{
+		Balance:      balance,
+		Alias:        wallet.Get("user_label").String(),
+		Network:      rp.Mainnet,
+		Synced:       true,
+		OutboundMsat: balance,
+	}, nil
+}
+
+func (l *LNPayWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return l.CreateInvoiceCtx(context.Background(), params)
+}
+
+func (l *LNPayWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	if params.Msatoshi%1000 != 0 {
+		return rp.InvoiceData{},
+			fmt.Errorf("lnpay can only make invoices for whole satoshis, not %d msat", params.Msatoshi)
+	}
+
+	args := map[string]interface{}{
+		"num_satoshis": params.Msatoshi / 1000,
+	}
+	if params.DescriptionHash == nil {
+		args["memo"] = params.Description
+	} else {
+		args["description_hash"] = hex.EncodeToString(params.DescriptionHash)
+	}
+	if params.Expiry != nil {
+		args["expiry"] = int64(params.Expiry.Seconds())
+	}
+
+	lntx, err := l.call(ctx, "POST", "/wallet/"+l.WalletKey+"/invoice", args)
+	if err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error creating invoice: %w", err)
+	}
+
+	id := lntx.Get("id").String()
+	l.open.Add(id, time.Unix(lntx.Get("expires_at").Int(), 0))
+
+	return rp.InvoiceData{
+		CheckingID: id,
+		Preimage:   lntx.Get("payment_preimage").String(),
+		Invoice:    lntx.Get("payment_request").String(),
+	}, nil
+}
+
+func (l *LNPayWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
+	return l.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (l *LNPayWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	lntx, err := l.call(ctx, "GET", "/lntx/"+checkingID, nil)
+	if err != nil {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.InvoiceStatus{CheckingID: checkingID, Exists: false}, nil
+		}
+		return rp.InvoiceStatus{}, fmt.Errorf("error getting invoice %s: %w", checkingID, err)
+	}
+
+	status := rp.InvoiceStatus{
+		CheckingID: checkingID,
+		Exists:     true,
+		Paid:       lntx.Get("settled").Int() == 1,
+		Invoice:    lntx.Get("payment_request").String(),
+		CreatedAt:  unixTime(lntx.Get("created_at")),
+		ExpiresAt:  unixTime(lntx.Get("expires_at")),
+	}
+	if status.Paid {
+		status.State = rp.InvoiceSettled
+		status.MSatoshiReceived = lntx.Get("num_satoshis").Int() * 1000
+		status.SettledAt = unixTime(lntx.Get("settled_at"))
+	} else {
+		status.State = rp.UnpaidState(status.ExpiresAt)
+	}
+	return status, nil
+}
+
+// unixTime reads the timestamps of lntx, which are zero when not set.
+func unixTime(ts gjson.Result) time.Time {
+	if ts.Int() <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts.Int(), 0)
+}
+
+// pollInvoices checks the invoices made by this wallet every
+// PaymentPollInterval, publishing them when they are paid.
+func (l *LNPayWallet) pollInvoices() {
+	l.open.Run(l.ctx, PaymentPollInterval,
+		l.GetInvoiceStatusCtx, l.invoices.Publish, l.life.ReportError)
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (l *LNPayWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return l.invoices.Stats(), l.payments.Stats()
+}
+
+// PaidInvoicesStream only has the invoices made by this wallet since it was
+// started, as they are found by polling them.
+func (l *LNPayWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return l.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (l *LNPayWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return l.invoices.Subscribe(ctx)
+}
+
+func (l *LNPayWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	return l.MakePaymentCtx(context.Background(), params)
+}
+
+// MakePaymentCtx starts paying the invoice in the background, as LNPay only
+// replies once the payment is done. Its CheckingID is the payment hash, which
+// GetPaymentStatus only knows for the payments made since Start.
+func (l *LNPayWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if err := ctx.Err(); err != nil {
+		return rp.PaymentData{}, err
+	}
+	if params.CustomAmount != 0 {
+		return rp.PaymentData{}, errors.New("lnpay can't pay a custom amount")
+	}
+	if params.MaxFeeMsat != 0 || params.MaxFeePercent != 0 || params.Timeout != 0 {
+		return rp.PaymentData{}, errors.New("lnpay can't limit the fees or time of a payment")
+	}
+
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+	}
+
+	l.mu.Lock()
+	l.lntxes[inv.PaymentHash] = ""
+	l.mu.Unlock()
+	if !l.life.Spawn(func() { l.pay(inv.PaymentHash, params.Invoice) }) {
+		return rp.PaymentData{}, rp.ErrClosed
+	}
+
+	return rp.PaymentData{
+		CheckingID: inv.PaymentHash,
+	}, nil
+}
+
+// pay pays invoice and publishes how it went.
+func (l *LNPayWallet) pay(hash, invoice string) {
+	ctx, cancel := context.WithTimeout(l.ctx, PayTimeout)
+	res, err := l.call(ctx, "POST", "/wallet/"+l.WalletKey+"/withdraw", map[string]interface{}{
+		"payment_request": invoice,
+	})
+	timedOut := ctx.Err() != nil
+	cancel()
+	if l.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		status := rp.PaymentStatus{CheckingID: hash, Status: rp.Failed}
+		if errors.Is(err, rp.ErrBackendUnavailable) || timedOut {
+			// it may be paid, but without its lntx there is no following it
+			status.Status = rp.Unknown
+		}
+		l.life.ReportError(fmt.Errorf("payment %s failed: %w", hash, err))
+		l.payments.Publish(status)
+		return
+	}
+
+	status := lntxToPaymentStatus(res.Get("lnTx"))
+	l.mu.Lock()
+	l.lntxes[hash] = status.CheckingID
+	l.mu.Unlock()
+
+	status.CheckingID = hash
+	l.trackPayment(status)
+}
+
+// trackPayment polls status every PaymentPollInterval while it is pending and
+// publishes it once it isn't, or after TrackPaymentRetryLimit, when it is
+// published as Unknown.
+func (l *LNPayWallet) trackPayment(status rp.PaymentStatus) {
+	if status.Status == rp.Pending {
+		ctx, cancel := context.WithTimeout(l.ctx, TrackPaymentRetryLimit)
+		defer cancel()
+
+		done := rp.Poll(ctx, PaymentPollInterval, func() (bool, error) {
+			current, err := l.GetPaymentStatusCtx(ctx, status.CheckingID)
+			if err != nil {
+				return false, err
+			}
+			status = current
+			return status.Status != rp.Pending, nil
+		}, l.life.ReportError)
+		if l.ctx.Err() != nil {
+			return
+		}
+		if !done {
+			status.Status = rp.Unknown
+		}
+	}
+
+	l.payments.Publish(status)
+}
+
+func (l *LNPayWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
+	return l.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+// GetPaymentStatusCtx looks up the payment by its lntx id, found from the
+// payment hash in checkingID. The payments made before Start aren't known.
+func (l *LNPayWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	l.mu.Lock()
+	id, ok := l.lntxes[checkingID]
+	l.mu.Unlock()
+	switch {
+	case !ok:
+		return rp.PaymentStatus{CheckingID: checkingID, Status: rp.Unknown}, nil
+	case id == "":
+		// still waiting for LNPay to reply
+		return rp.PaymentStatus{CheckingID: checkingID, Status: rp.Pending}, nil
+	}
+
+	lntx, err := l.call(ctx, "GET", "/lntx/"+id, nil)
+	if err != nil {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.PaymentStatus{CheckingID: checkingID, Status: rp.NeverTried}, nil
+		}
+		return rp.PaymentStatus{}, fmt.Errorf("error getting payment %s: %w", checkingID, err)
+	}
+
+	status := lntxToPaymentStatus(lntx)
+	status.CheckingID = checkingID
+	return status, nil
+}
+
+// lntxToPaymentStatus reads an outgoing lntx, in which settled is 1 when it
+// was paid, -1 when it failed and 0 while it is pending.
+func lntxToPaymentStatus(lntx gjson.Result) rp.PaymentStatus {
+	status := rp.PaymentStatus{CheckingID: lntx.Get("id").String()}
+	switch lntx.Get("settled").Int() {
+	case 1:
+		status.Status = rp.Complete
+		status.FeePaid = lntx.Get("fee_msat").Int()
+		status.Preimage = lntx.Get("payment_preimage").String()
+	case -1:
+		status.Status = rp.Failed
+	default:
+		status.Status = rp.Pending
+	}
+	return status
+}
+
+func (l *LNPayWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
+	return l.PaymentsStreamCtx(context.Background())
+}
+
+func (l *LNPayWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return l.payments.Subscribe(ctx)
+}
@@ -0,0 +1,192 @@
+package lnpay
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/replaytest"
+)
+
+func TestGetInfo(t *testing.T) {
+	l := setupServer(t, replaytest.Responses{
+		"GET /wallet/waka_test": {200, "wallet.json"},
+	})
+
+	want := rp.WalletInfo{
+		Balance:      1234000,
+		Alias:        "relampago",
+		Network:      rp.Mainnet,
+		Synced:       true,
+		OutboundMsat: 1234000,
+	}
+	got, err := l.GetInfo()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestPaidInvoicesStream(t *testing.T) {
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = 10 * time.Millisecond
+
+	l := setupServer(t, replaytest.Responses{
+		"POST /wallet/waka_test/invoice":           {201, "invoice.json"},
+		"GET /lntx/lntx_82yveCX2Wn0EXFRGvbjSCKsLh": {200, "lntx_settled.json"},
+	})
+
+	invoices, err := l.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	l.life.Spawn(l.pollInvoices)
+
+	data, err := l.CreateInvoice(rp.InvoiceParams{Msatoshi: 2000, Description: "relampago test"})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if want := "lntx_82yveCX2Wn0EXFRGvbjSCKsLh"; data.CheckingID != want {
+		t.Errorf("got %v, wanted %v", data.CheckingID, want)
+	}
+	if want := "0b6c7b4c9a3e62b0fd7db8f5f1b2e8e9c02a6c3b8c9b8b6b3a2a1a0a9a8a7a6a"; data.Preimage != want {
+		t.Errorf("got %v, wanted %v", data.Preimage, want)
+	}
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "lntx_82yveCX2Wn0EXFRGvbjSCKsLh",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 2000,
+		State:            rp.InvoiceSettled,
+		Invoice:          "lnbc20n1p0tj2zppp5d0utsqjw2qu8c9amjw8tndlh0m7kklmdgyhrpzzfxw8egscfm0fsdqjwfjkcctpd9c8qctdvdjscqzpgxqrrss9qy9qsqsp5t7yxxqu3x3fnefsqu6lqn5wc82nmxspzaefy8k6ur6ngx3mtpxsqymd6jxzcrzl6wfq0h8a8qglw4s2t7e44y35c6eyy5m3rq0t2wgz2v7kdpyysx6f7gxyz6v9znk52ywwhqpmn5lg5c6n2hhtcduvs5gcqgaftzc",
+		CreatedAt:        time.Unix(1587505548, 0),
+		ExpiresAt:        time.Unix(1587591948, 0),
+		SettledAt:        time.Unix(1587505602, 0),
+	}
+	select {
+	case got := <-invoices:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("invoice wasn't published")
+	}
+
+	// it is only published once
+	select {
+	case got := <-invoices:
+		t.Errorf("got %v, wanted nothing", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGetInvoiceStatus_NotFound(t *testing.T) {
+	l := setupServer(t, replaytest.Responses{
+		"GET /lntx/lntx_nope": {404, "not_found.json"},
+	})
+
+	want := rp.InvoiceStatus{CheckingID: "lntx_nope", Exists: false}
+	got, err := l.GetInvoiceStatus("lntx_nope")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+const invoice = "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3"
+
+const paymentHash = "3f06a81e0a0c2ad34ee9df2a30d87a810da9e3c3881f780755ace5e5e64d30a7"
+
+func TestMakePayment(t *testing.T) {
+	l := setupServer(t, replaytest.Responses{
+		"POST /wallet/waka_test/withdraw": {201, "withdraw.json"},
+	})
+
+	payments, err := l.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	got, err := l.MakePayment(rp.PaymentParams{Invoice: invoice})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got.CheckingID != paymentHash {
+		t.Errorf("got %v, wanted %v", got.CheckingID, paymentHash)
+	}
+
+	want := rp.PaymentStatus{
+		CheckingID: paymentHash,
+		Status:     rp.Complete,
+		FeePaid:    3000,
+		Preimage:   "e5cc4a6ee3b1e1f0f1b8d2bdc4e0ee2b4b1bd5f6e7d8c9b0a1f2e3d4c5b6a798",
+	}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_InsufficientBalance(t *testing.T) {
+	l := setupServer(t, replaytest.Responses{
+		"POST /wallet/waka_test/withdraw": {400, "insufficient.json"},
+	})
+
+	payments, err := l.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	// it is only known once LNPay replies, in the background
+	if _, err := l.MakePayment(rp.PaymentParams{Invoice: invoice}); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	want := rp.PaymentStatus{CheckingID: paymentHash, Status: rp.Failed}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_InvalidInvoice(t *testing.T) {
+	l := setupServer(t, replaytest.Responses{})
+
+	_, err := l.MakePayment(rp.PaymentParams{Invoice: "lnbc175001..."})
+	if !errors.Is(err, rp.ErrInvalidInvoice) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrInvalidInvoice)
+	}
+}
+
+// setupServer starts a server replaying the recorded responses, by method and
+// path, and a wallet that talks to it. Invoices aren't polled, tests that want
+// that spawn it.
+func setupServer(t *testing.T, responses replaytest.Responses) *LNPayWallet {
+	server := replaytest.Server(t, "X-Api-Key", "pak_test", responses)
+
+	l := newLNPayWallet(Params{
+		Host:      server.URL,
+		APIKey:    "pak_test",
+		WalletKey: "waka_test",
+		OnError:   func(error) {},
+	}, http.DefaultClient)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
@@ -0,0 +1,98 @@
+package relampago
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Poll calls check right away and then every interval until it says it is
+// done, giving the errors it returns to report. It returns false if ctx is
+// done first.
+func Poll(ctx context.Context, interval time.Duration, check func() (done bool, err error), report func(error)) bool {
+	for {
+		done, err := check()
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			report(err)
+		} else if done {
+			return true
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// InvoicePoller finds the invoices that are paid on backends that can only
+// be polled for it. The zero value is ready to use.
+type InvoicePoller struct {
+	mu   sync.Mutex
+	open map[string]time.Time // by CheckingID, with when they expire
+}
+
+// Add has the invoice with checkingID checked until it is paid or past
+// expiresAt.
+func (p *InvoicePoller) Add(checkingID string, expiresAt time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.open == nil {
+		p.open = make(map[string]time.Time)
+	}
+	p.open[checkingID] = expiresAt
+}
+
+// Run checks every invoice added with get every interval until ctx is done,
+// giving the paid ones to publish and errors to report. Invoices are
+// forgotten once they are paid, gone or expired.
+func (p *InvoicePoller) Run(
+	ctx context.Context,
+	interval time.Duration,
+	get func(ctx context.Context, checkingID string) (InvoiceStatus, error),
+	publish func(InvoiceStatus),
+	report func(error),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		p.mu.Lock()
+		open := make(map[string]time.Time, len(p.open))
+		for id, expiresAt := range p.open {
+			open[id] = expiresAt
+		}
+		p.mu.Unlock()
+
+		for id, expiresAt := range open {
+			status, err := get(ctx, id)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				report(err)
+				continue
+			}
+
+			if status.Paid {
+				publish(status)
+			}
+			if status.Paid || !status.Exists || time.Now().After(expiresAt) {
+				p.mu.Lock()
+				delete(p.open, id)
+				p.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package relampago
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPoll(t *testing.T) {
+	var reported []error
+	report := func(err error) { reported = append(reported, err) }
+
+	calls := 0
+	done := Poll(context.Background(), time.Millisecond, func() (bool, error) {
+		calls++
+		if calls == 1 {
+			return false, errors.New("unavailable")
+		}
+		return calls == 3, nil
+	}, report)
+	if !done || calls != 3 || len(reported) != 1 {
+		t.Errorf("got %v after %v calls and %v errors, wanted %v after %v and %v",
+			done, calls, len(reported), true, 3, 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if Poll(ctx, time.Millisecond, func() (bool, error) { return false, nil }, report) {
+		t.Errorf("got %v, wanted %v", true, false)
+	}
+}
+
+func TestInvoicePoller(t *testing.T) {
+	var poller InvoicePoller
+	poller.Add("paid", time.Now().Add(time.Hour))
+	poller.Add("gone", time.Now().Add(time.Hour))
+	poller.Add("expired", time.Now())
+	poller.Add("open", time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	checked := make(map[string]int)
+	published := make(chan InvoiceStatus, 10)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		poller.Run(ctx, time.Millisecond, func(_ context.Context, id string) (InvoiceStatus, error) {
+			checked[id]++
+			if checked["open"] == 3 {
+				cancel()
+			}
+			return InvoiceStatus{CheckingID: id, Exists: id != "gone", Paid: id == "paid"}, nil
+		}, func(status InvoiceStatus) {
+			published <- status
+		}, func(err error) {
+			t.Errorf("got %v, wanted no errors", err)
+		})
+	}()
+
+	if got := <-published; got.CheckingID != "paid" {
+		t.Errorf("got %v, wanted %v", got.CheckingID, "paid")
+	}
+	<-stopped
+
+	// only the open one is still checked after the first time
+	for id, want := range map[string]int{"paid": 1, "gone": 1, "expired": 1, "open": 3} {
+		if got := checked[id]; got != want {
+			t.Errorf("got %v checks of %s, wanted %v", got, id, want)
+		}
+	}
+	if len(published) != 0 {
+		t.Errorf("got %v more published, wanted none", len(published))
+	}
+}
@@ -0,0 +1,56 @@
+package relampago
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lnbits/relampago/internal/socks5test"
+)
+
+func TestHTTPClient_Proxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	proxy := socks5test.NewServer(t, "user", "secret")
+	proxy.AddHost("node.onion:80", server.Listener.Addr().String())
+
+	client, err := HTTPClient(proxy.URL(), time.Second)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	resp, err := client.Get("http://node.onion/")
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("got %v, wanted %v", string(body), "hello")
+	}
+	if got := proxy.Targets(); len(got) != 1 || got[0] != "node.onion:80" {
+		t.Errorf("got %v, wanted %v", got, []string{"node.onion:80"})
+	}
+
+	// with the wrong password nothing goes through
+	client, err = HTTPClient(strings.Replace(proxy.URL(), "secret", "nope", 1), time.Second)
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	if _, err := client.Get("http://node.onion/"); err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+}
+
+func TestProxyDialer_Invalid(t *testing.T) {
+	for _, proxy := range []string{"http://127.0.0.1:8080", "socks5://", "socks5://%zz"} {
+		if _, err := ProxyDialer(proxy, time.Second); err == nil {
+			t.Errorf("%s: got %v, wanted an error", proxy, err)
+		}
+	}
+}
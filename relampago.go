@@ -1,9 +1,14 @@
 package relampago
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type Wallet interface {
 	Kind() string
+	Capabilities() Capabilities
+	Close() error
 	GetInfo() (WalletInfo, error)
 
 	CreateInvoice(InvoiceParams) (InvoiceData, error)
@@ -15,10 +20,93 @@ type Wallet interface {
 	PaymentsStream() (<-chan PaymentStatus, error)
 }
 
+// ResumableWallet is a Wallet whose paid invoices stream can pick up where an
+// earlier one left off: every invoice paid after cursor, the Cursor of the
+// last InvoiceStatus the consumer handled, is sent before the live ones.
+// A zero cursor replays nothing. Delivery is at-least-once, the same invoice
+// may come again after a reconnection. Only settled invoices with a Cursor are
+// sent, so hold invoices settled where the backend doesn't give them one
+// (CLN's hold plugin) only come through PaidInvoicesStream.
+type ResumableWallet interface {
+	Wallet
+	PaidInvoicesStreamFrom(ctx context.Context, cursor uint64) (<-chan InvoiceStatus, error)
+}
+
+// KeysendWallet is a Wallet that can pay a node without an invoice, sending
+// along the preimage for the node to claim it.
+type KeysendWallet interface {
+	Wallet
+	MakeKeysend(KeysendParams) (PaymentData, error)
+	MakeKeysendCtx(context.Context, KeysendParams) (PaymentData, error)
+}
+
+// HoldInvoiceWallet is a Wallet that can make invoices for a payment hash
+// whose preimage it doesn't know, so payments to them are held until it is
+// given to SettleHoldInvoice, or refunded by CancelHoldInvoice. Their
+// CheckingIDs are the payment hashes. Held payments come through
+// HeldInvoicesStream in the InvoiceAccepted state, and only once they are
+// settled through the paid invoices stream, like any other invoice.
+type HoldInvoiceWallet interface {
+	Wallet
+	CreateHoldInvoice(params InvoiceParams, paymentHash string) (InvoiceData, error)
+	CreateHoldInvoiceCtx(ctx context.Context, params InvoiceParams, paymentHash string) (InvoiceData, error)
+	SettleHoldInvoice(preimage string) error
+	SettleHoldInvoiceCtx(ctx context.Context, preimage string) error
+	CancelHoldInvoice(paymentHash string) error
+	CancelHoldInvoiceCtx(ctx context.Context, paymentHash string) error
+	HeldInvoicesStream(ctx context.Context) (<-chan InvoiceStatus, error)
+}
+
+// Capabilities tell what a wallet supports, so apps can turn features on and
+// off depending on the backend they're connected to.
+type Capabilities struct {
+	DescriptionHash bool `json:"descriptionHash"` // InvoiceParams.DescriptionHash is honored
+	CustomExpiry    bool `json:"customExpiry"`    // InvoiceParams.Expiry is honored
+	Keysend         bool `json:"keysend"`         // it is a KeysendWallet
+	HoldInvoices    bool `json:"holdInvoices"`    // it is a HoldInvoiceWallet
+	MPP             bool `json:"mpp"`             // payments can be split over many paths
+	BOLT12          bool `json:"bolt12"`          // offers
+
+	FeeLimits      bool `json:"feeLimits"`      // PaymentParams.MaxFeeMsat and MaxFeePercent are honored
+	PaymentTimeout bool `json:"paymentTimeout"` // PaymentParams.Timeout is honored
+
+	// the CheckingIDs of invoices and payments are their payment hashes,
+	// otherwise they are backend-specific labels or ids
+	InvoicePaymentHashIDs bool `json:"invoicePaymentHashIDs"`
+	PaymentPaymentHashIDs bool `json:"paymentPaymentHashIDs"`
+
+	// the streams are fed by events from the backend as they happen, otherwise
+	// there are no events at all and the statuses must be polled
+	Streaming bool `json:"streaming"`
+}
+
+// WalletInfo describes the node behind a wallet. All the amounts are in
+// millisatoshis.
 type WalletInfo struct {
-	Balance int64 `json:"balance"`
+	Balance int64 `json:"balance"` // the same as OutboundMsat
+
+	Pubkey      string  `json:"pubkey"`
+	Alias       string  `json:"alias"`
+	Network     Network `json:"network"`
+	BlockHeight uint32  `json:"blockHeight"`
+	Synced      bool    `json:"synced"` // to the chain
+	Version     string  `json:"version"`
+
+	OutboundMsat int64 `json:"outboundMsat"` // what we can send over our channels
+	InboundMsat  int64 `json:"inboundMsat"`  // what we can receive over them
+	PendingMsat  int64 `json:"pendingMsat"`  // ours on channels still being opened
+	OnchainMsat  int64 `json:"onchainMsat"`  // confirmed, not on any channel
 }
 
+type Network string
+
+const (
+	Mainnet Network = "mainnet"
+	Testnet Network = "testnet"
+	Regtest Network = "regtest"
+	Signet  Network = "signet"
+)
+
 type InvoiceParams struct {
 	Msatoshi        int64          `json:"msatoshi"`
 	Description     string         `json:"description"`
@@ -35,15 +123,104 @@ type InvoiceData struct {
 type InvoiceStatus struct {
 	CheckingID       string `json:"checkingID"`
 	Exists           bool   `json:"exists"`
-	Paid             bool   `json:"paid"`
+	Paid             bool   `json:"paid"` // the same as being InvoiceSettled
 	MSatoshiReceived int64  `json:"msatoshiReceived"`
+
+	// State is empty for invoices that don't exist. The times are zero when
+	// the backend doesn't tell them.
+	State     InvoiceState `json:"state,omitempty"`
+	Invoice   string       `json:"invoice,omitempty"` // the bolt11, or bolt12
+	CreatedAt time.Time    `json:"createdAt"`
+	ExpiresAt time.Time    `json:"expiresAt"`
+	SettledAt time.Time    `json:"settledAt"`
+
+	// Cursor is the position of a paid invoice in the backend's stream (lnd
+	// settle index, CLN pay index, eclair timestamp), zero if there's none.
+	Cursor uint64 `json:"cursor,omitempty"`
+
+	// Keysend is set for payments made without an invoice, and CustomRecords
+	// are the TLV records the payer sent along, by type, like 7629169 for
+	// podcast boostagrams. HTLCs are the settled parts of the payment. All
+	// of them are only filled by backends that tell.
+	Keysend       bool              `json:"keysend,omitempty"`
+	CustomRecords map[uint64][]byte `json:"customRecords,omitempty"`
+	HTLCs         []HTLC            `json:"htlcs,omitempty"`
+}
+
+type InvoiceState string
+
+const (
+	InvoiceOpen      InvoiceState = "open"
+	InvoiceAccepted  InvoiceState = "accepted" // a payment to a hold invoice is held
+	InvoiceSettled   InvoiceState = "settled"
+	InvoiceExpired   InvoiceState = "expired"
+	InvoiceCancelled InvoiceState = "cancelled" // a hold invoice was given up on
+)
+
+// HTLC is a settled part of an incoming payment.
+type HTLC struct {
+	ChannelID     uint64            `json:"channelID"` // short channel id
+	ID            uint64            `json:"id"`        // index in the channel
+	Msatoshi      int64             `json:"msatoshi"`
+	AcceptedAt    time.Time         `json:"acceptedAt"`
+	SettledAt     time.Time         `json:"settledAt"`
+	CustomRecords map[uint64][]byte `json:"customRecords,omitempty"`
 }
 
 type PaymentParams struct {
 	Invoice      string `json:"invoice"`
 	CustomAmount int64  `json:"customAmount"`
+
+	// optional limits, the backend defaults are used for the ones left zero.
+	// When both fee limits are set the smaller one applies.
+	MaxFeeMsat    int64         `json:"maxFeeMsat,omitempty"`
+	MaxFeePercent float64       `json:"maxFeePercent,omitempty"` // of the amount paid
+	Timeout       time.Duration `json:"timeout,omitempty"`       // to give up finding a route
 }
 
+// FeeLimit is the most params allow paying in fees for an amount of msatoshi,
+// and false when they don't limit fees at all.
+func (p PaymentParams) FeeLimit(msatoshi int64) (int64, bool) {
+	switch {
+	case p.MaxFeeMsat > 0 && p.MaxFeePercent > 0:
+		if percent := percentOf(msatoshi, p.MaxFeePercent); percent < p.MaxFeeMsat {
+			return percent, true
+		}
+		return p.MaxFeeMsat, true
+	case p.MaxFeeMsat > 0:
+		return p.MaxFeeMsat, true
+	case p.MaxFeePercent > 0:
+		return percentOf(msatoshi, p.MaxFeePercent), true
+	}
+	return 0, false
+}
+
+func percentOf(msatoshi int64, percent float64) int64 {
+	return int64(float64(msatoshi) * percent / 100)
+}
+
+type KeysendParams struct {
+	Destination   string            `json:"destination"` // the node pubkey, in hex
+	Msatoshi      int64             `json:"msatoshi"`
+	CustomRecords map[uint64][]byte `json:"customRecords,omitempty"` // extra TLV records, by type
+
+	// optional limits, as in PaymentParams
+	MaxFeeMsat    int64         `json:"maxFeeMsat,omitempty"`
+	MaxFeePercent float64       `json:"maxFeePercent,omitempty"`
+	Timeout       time.Duration `json:"timeout,omitempty"`
+}
+
+// FeeLimit is the most params allow paying in fees, and false when they don't
+// limit fees at all.
+func (p KeysendParams) FeeLimit() (int64, bool) {
+	limits := PaymentParams{MaxFeeMsat: p.MaxFeeMsat, MaxFeePercent: p.MaxFeePercent}
+	return limits.FeeLimit(p.Msatoshi)
+}
+
+// KeysendRecord is the TLV record type keysend payments carry their preimage
+// in.
+const KeysendRecord = 5482373484
+
 type PaymentData struct {
 	CheckingID string `json:"checkingID"`
 }
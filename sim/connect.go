@@ -0,0 +1,31 @@
+package sim
+
+import (
+	"sync"
+
+	rp "github.com/lnbits/relampago"
+	relampago_connect "github.com/lnbits/relampago/connect"
+)
+
+// Settings of the sim backend, for relampago_connect. Its wallets are started
+// on DefaultNetwork, so every sim backend of a process can pay the others.
+type Settings struct {
+	Alias       string `envconfig:"SIM_ALIAS"`
+	BalanceMsat int64  `envconfig:"SIM_BALANCE_MSAT"`
+}
+
+var registerOnce sync.Once
+
+// Register makes the sim backend available to relampago_connect as "sim". It
+// isn't registered otherwise, so a LIGHTNING_BACKEND_TYPE of "sim" can't start
+// a fake wallet where it isn't expected. It can be called more than once.
+func Register() {
+	registerOnce.Do(func() {
+		relampago_connect.Register("sim", func(s Settings) (rp.Wallet, error) {
+			return Start(Params{
+				Alias:   s.Alias,
+				Balance: s.BalanceMsat,
+			})
+		})
+	})
+}
@@ -0,0 +1,70 @@
+package sim
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultNetwork is the network of wallets started without one.
+var DefaultNetwork = NewNetwork()
+
+// Network is an in-memory Lightning network: every wallet on it can pay the
+// invoices of any other. Latency, fees and failures can be set at any time and
+// apply to the payments made after.
+type Network struct {
+	mu    sync.Mutex
+	nodes map[string]*SimWallet // by pubkey
+
+	latency  time.Duration
+	baseFee  int64 // msat
+	feePPM   int64 // parts per million of the amount
+	failure  func(Payment) error
+	failNext []error
+}
+
+// Payment is a payment about to be routed, as failure hooks see it.
+type Payment struct {
+	From        string // pubkeys
+	To          string
+	PaymentHash string
+	Msatoshi    int64
+}
+
+func NewNetwork() *Network {
+	return &Network{nodes: make(map[string]*SimWallet)}
+}
+
+// SetLatency is how long payments are in flight before they settle or fail.
+func (n *Network) SetLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = latency
+}
+
+// SetFees makes payments cost baseMsat plus ppm parts per million of the
+// amount, paid by the sender and not received by anyone.
+func (n *Network) SetFees(baseMsat, ppm int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.baseFee, n.feePPM = baseMsat, ppm
+}
+
+// SetFailure makes every payment fn returns an error for fail. A nil fn lets
+// them all through again.
+func (n *Network) SetFailure(fn func(Payment) error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failure = fn
+}
+
+// FailNext makes the next payment fail with err, after any others queued
+// before it.
+func (n *Network) FailNext(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.failNext = append(n.failNext, err)
+}
+
+func (n *Network) fee(msatoshi int64) int64 {
+	return n.baseFee + msatoshi*n.feePPM/1_000_000
+}
@@ -0,0 +1,860 @@
+package sim
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+type Params struct {
+	Network *Network // optional, DefaultNetwork otherwise
+	Alias   string   // optional, the node key is derived from it when set
+	Balance int64    // msat the wallet starts with
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+}
+
+// SimWallet is a node on an in-memory Network. Its invoices are real regtest
+// BOLT11 invoices signed with its node key, and paying one made by another
+// wallet on the same network settles it there.
+type SimWallet struct {
+	Params
+	key    *btcec.PrivateKey
+	pubkey string
+
+	// life runs every payment in flight until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	// guarded by Network.mu
+	balance     int64
+	received    map[string]*invoice          // by payment hash
+	sent        map[string]*rp.PaymentStatus // by payment hash
+	settled     []rp.InvoiceStatus           // in settle order
+	settleIndex uint64
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+	held     *rp.Broadcaster[rp.InvoiceStatus] // accepted hold invoices
+}
+
+type invoice struct {
+	status   rp.InvoiceStatus
+	preimage string // unknown for hold invoices until they are settled
+	msatoshi int64  // zero when any amount can be paid
+
+	hold      bool
+	held      *heldPayment // the accepted payment of a hold invoice
+	cancelled bool
+}
+
+// heldPayment is a payment to a hold invoice, still pending for its payer.
+type heldPayment struct {
+	payer    *SimWallet
+	msatoshi int64
+	fee      int64
+}
+
+// refund gives the payment for paymentHash back to its payer, failing it, and
+// returns its status for the payer to publish. It is called with n.mu held.
+func (held *heldPayment) refund(paymentHash string) rp.PaymentStatus {
+	held.payer.balance += held.msatoshi + held.fee
+	status := held.payer.sent[paymentHash]
+	status.Status = rp.Failed
+	return *status
+}
+
+// DefaultExpiry is the expiry of invoices made without one.
+const DefaultExpiry = time.Hour
+
+func Start(params Params) (*SimWallet, error) {
+	if params.Network == nil {
+		params.Network = DefaultNetwork
+	}
+
+	var key *btcec.PrivateKey
+	if params.Alias != "" {
+		seed := sha256.Sum256([]byte("relampago sim " + params.Alias))
+		key, _ = btcec.PrivKeyFromBytes(seed[:])
+	} else {
+		var err error
+		key, err = btcec.NewPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	life := rp.NewLifecycle("sim", nil)
+	s := &SimWallet{
+		Params:   params,
+		key:      key,
+		pubkey:   hex.EncodeToString(key.PubKey().SerializeCompressed()),
+		life:     life,
+		ctx:      life.Context(),
+		balance:  params.Balance,
+		received: make(map[string]*invoice),
+		sent:     make(map[string]*rp.PaymentStatus),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+		held:     rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+	}
+	if s.Alias == "" {
+		s.Alias = s.pubkey[:8]
+	}
+
+	n := params.Network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, taken := n.nodes[s.pubkey]; taken {
+		s.life.Close()
+		return nil, fmt.Errorf("a node named %q is already on the network", s.Alias)
+	}
+	n.nodes[s.pubkey] = s
+
+	return s, nil
+}
+
+// Compile time check to ensure that SimWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*SimWallet)(nil)
+var _ rp.HoldInvoiceWallet = (*SimWallet)(nil)
+var _ rp.KeysendWallet = (*SimWallet)(nil)
+var _ rp.ResumableWallet = (*SimWallet)(nil)
+var _ rp.StreamStatsReporter = (*SimWallet)(nil)
+
+func (s *SimWallet) Kind() string {
+	return "sim"
+}
+
+func (s *SimWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		Keysend:               true,
+		HoldInvoices:          true,
+		FeeLimits:             true,
+		PaymentTimeout:        true,
+		InvoicePaymentHashIDs: true,
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Pubkey is the node key of the wallet, the payee of its invoices.
+func (s *SimWallet) Pubkey() string {
+	return s.pubkey
+}
+
+// Close takes the wallet off the network, failing the payments it has in
+// flight and giving back the ones its hold invoices are holding, and closes
+// every listener channel. It is safe to call more than once.
+func (s *SimWallet) Close() error {
+	s.life.Close(s.leave, s.invoices.Close, s.payments.Close, s.held.Close)
+	return nil
+}
+
+// leave takes the wallet off the network and gives the payments held by its
+// hold invoices back to their payers.
+func (s *SimWallet) leave() {
+	n := s.Network
+	n.mu.Lock()
+	delete(n.nodes, s.pubkey)
+	var refunded []func()
+	for paymentHash, inv := range s.received {
+		held := inv.held
+		if held == nil {
+			continue
+		}
+		inv.held = nil
+		paymentStatus := held.refund(paymentHash)
+		refunded = append(refunded, func() {
+			held.payer.life.Spawn(func() { held.payer.payments.Publish(paymentStatus) })
+		})
+	}
+	n.mu.Unlock()
+
+	for _, publish := range refunded {
+		publish()
+	}
+}
+
+func (s *SimWallet) GetInfo() (rp.WalletInfo, error) {
+	return s.GetInfoCtx(context.Background())
+}
+
+func (s *SimWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	if err := s.check(ctx); err != nil {
+		return rp.WalletInfo{}, err
+	}
+
+	n := s.Network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return rp.WalletInfo{
+		Balance: s.balance,
+		Pubkey:  s.pubkey,
+		Alias:   s.Alias,
+		Network: rp.Regtest,
+		Synced:  true,
+		Version: "sim",
+	}, nil
+}
+
+func (s *SimWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return s.CreateInvoiceCtx(context.Background(), params)
+}
+
+func (s *SimWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	if err := s.check(ctx); err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	var preimage [32]byte
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return rp.InvoiceData{}, err
+	}
+	hash := sha256.Sum256(preimage[:])
+	bolt11, createdAt, expiresAt, err := s.encodeInvoice(params, hash)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	checkingID := hex.EncodeToString(hash[:])
+	preimageHex := hex.EncodeToString(preimage[:])
+	n := s.Network
+	n.mu.Lock()
+	s.received[checkingID] = &invoice{
+		status: rp.InvoiceStatus{
+			CheckingID: checkingID,
+			Exists:     true,
+			State:      rp.InvoiceOpen,
+			Invoice:    bolt11,
+			CreatedAt:  createdAt,
+			ExpiresAt:  expiresAt,
+		},
+		preimage: preimageHex,
+		msatoshi: params.Msatoshi,
+	}
+	n.mu.Unlock()
+
+	return rp.InvoiceData{
+		CheckingID: checkingID,
+		Preimage:   preimageHex,
+		Invoice:    bolt11,
+	}, nil
+}
+
+// encodeInvoice makes the signed invoice for params and hash, and tells when
+// it was created and when it expires.
+func (s *SimWallet) encodeInvoice(params rp.InvoiceParams, hash [32]byte) (
+	bolt11 string, createdAt, expiresAt time.Time, err error,
+) {
+	var paymentAddr [32]byte
+	if _, err := rand.Read(paymentAddr[:]); err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+
+	expiry := DefaultExpiry
+	if params.Expiry != nil {
+		expiry = *params.Expiry
+	}
+	options := []func(*zpay32.Invoice){
+		zpay32.PaymentAddr(paymentAddr),
+		zpay32.Expiry(expiry),
+	}
+	if params.Msatoshi > 0 {
+		options = append(options, zpay32.Amount(lnwire.MilliSatoshi(params.Msatoshi)))
+	}
+	if len(params.DescriptionHash) > 0 {
+		if len(params.DescriptionHash) != 32 {
+			return "", time.Time{}, time.Time{}, errors.New("description hash must be 32 bytes")
+		}
+		var descriptionHash [32]byte
+		copy(descriptionHash[:], params.DescriptionHash)
+		options = append(options, zpay32.DescriptionHash(descriptionHash))
+	} else {
+		options = append(options, zpay32.Description(params.Description))
+	}
+
+	// the invoice only has seconds
+	now := time.Unix(time.Now().Unix(), 0)
+	inv, err := zpay32.NewInvoice(&chaincfg.RegressionNetParams, hash, now, options...)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("failed to create invoice: %w", err)
+	}
+	bolt11, err = inv.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			digest := sha256.Sum256(msg)
+			return ecdsa.SignCompact(s.key, digest[:], true)
+		},
+	})
+	if err != nil {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("failed to sign invoice: %w", err)
+	}
+
+	return bolt11, now, now.Add(expiry), nil
+}
+
+func (s *SimWallet) CreateHoldInvoice(params rp.InvoiceParams, paymentHash string) (rp.InvoiceData, error) {
+	return s.CreateHoldInvoiceCtx(context.Background(), params, paymentHash)
+}
+
+// CreateHoldInvoiceCtx makes an invoice whose payments are only taken from
+// the payer, and stay pending for it, until they are settled or cancelled.
+func (s *SimWallet) CreateHoldInvoiceCtx(
+	ctx context.Context,
+	params rp.InvoiceParams,
+	paymentHash string,
+) (rp.InvoiceData, error) {
+	if err := s.check(ctx); err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	b, err := hex.DecodeString(paymentHash)
+	if err != nil || len(b) != 32 {
+		return rp.InvoiceData{}, fmt.Errorf("invalid payment hash %s", paymentHash)
+	}
+	var hash [32]byte
+	copy(hash[:], b)
+	bolt11, createdAt, expiresAt, err := s.encodeInvoice(params, hash)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	n := s.Network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := s.received[paymentHash]; ok {
+		return rp.InvoiceData{}, fmt.Errorf("there is an invoice for %s already", paymentHash)
+	}
+	s.received[paymentHash] = &invoice{
+		status: rp.InvoiceStatus{
+			CheckingID: paymentHash,
+			Exists:     true,
+			State:      rp.InvoiceOpen,
+			Invoice:    bolt11,
+			CreatedAt:  createdAt,
+			ExpiresAt:  expiresAt,
+		},
+		msatoshi: params.Msatoshi,
+		hold:     true,
+	}
+
+	return rp.InvoiceData{
+		CheckingID: paymentHash,
+		Invoice:    bolt11,
+	}, nil
+}
+
+func (s *SimWallet) SettleHoldInvoice(preimage string) error {
+	return s.SettleHoldInvoiceCtx(context.Background(), preimage)
+}
+
+// SettleHoldInvoiceCtx pays the held payment of the invoice for the hash of
+// preimage, completing it for its payer.
+func (s *SimWallet) SettleHoldInvoiceCtx(ctx context.Context, preimage string) error {
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+	p, err := hex.DecodeString(preimage)
+	if err != nil {
+		return fmt.Errorf("invalid preimage: %w", err)
+	}
+	hash := sha256.Sum256(p)
+	checkingID := hex.EncodeToString(hash[:])
+
+	n := s.Network
+	n.mu.Lock()
+	inv, err := s.holdInvoice(checkingID)
+	if err == nil && inv.held == nil {
+		err = errors.New("no payment is held for the invoice")
+	}
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	held := inv.held
+	inv.held = nil
+	inv.preimage = preimage
+	s.credit(inv, held.msatoshi)
+	status := held.payer.sent[checkingID]
+	status.Status = rp.Complete
+	status.FeePaid = held.fee
+	status.Preimage = preimage
+	paymentStatus := *status
+	invoiceStatus := inv.status
+	n.mu.Unlock()
+
+	// published in the background, the caller may be the one listening
+	s.life.Spawn(func() { s.invoices.Publish(invoiceStatus) })
+	held.payer.life.Spawn(func() { held.payer.payments.Publish(paymentStatus) })
+	return nil
+}
+
+func (s *SimWallet) CancelHoldInvoice(paymentHash string) error {
+	return s.CancelHoldInvoiceCtx(context.Background(), paymentHash)
+}
+
+// CancelHoldInvoiceCtx gives the held payment of the invoice back to its payer,
+// failing it, and makes the invoice unpayable.
+func (s *SimWallet) CancelHoldInvoiceCtx(ctx context.Context, paymentHash string) error {
+	if err := s.check(ctx); err != nil {
+		return err
+	}
+
+	n := s.Network
+	n.mu.Lock()
+	inv, err := s.holdInvoice(paymentHash)
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+
+	inv.cancelled = true
+	inv.status.State = rp.InvoiceCancelled
+	inv.status.MSatoshiReceived = 0
+	held := inv.held
+	inv.held = nil
+	if held == nil {
+		n.mu.Unlock()
+		return nil
+	}
+	paymentStatus := held.refund(paymentHash)
+	n.mu.Unlock()
+
+	held.payer.life.Spawn(func() { held.payer.payments.Publish(paymentStatus) })
+	return nil
+}
+
+// holdInvoice is the unsettled hold invoice for paymentHash. It is called
+// with n.mu held.
+func (s *SimWallet) holdInvoice(paymentHash string) (*invoice, error) {
+	inv, ok := s.received[paymentHash]
+	switch {
+	case !ok || !inv.hold:
+		return nil, rp.WrapError(rp.ErrInvoiceNotFound,
+			fmt.Errorf("no hold invoice for %s", paymentHash))
+	case inv.status.Paid:
+		return nil, rp.WrapError(rp.ErrAlreadyPaid, errors.New("invoice already settled"))
+	}
+	return inv, nil
+}
+
+func (s *SimWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
+	return s.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (s *SimWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	if err := s.check(ctx); err != nil {
+		return rp.InvoiceStatus{}, err
+	}
+
+	n := s.Network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if inv, ok := s.received[checkingID]; ok {
+		status := inv.status
+		if status.State == rp.InvoiceOpen {
+			status.State = rp.UnpaidState(status.ExpiresAt)
+		}
+		return status, nil
+	}
+	return rp.InvoiceStatus{CheckingID: checkingID, Exists: false}, nil
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (s *SimWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return s.invoices.Stats(), s.payments.Stats()
+}
+
+func (s *SimWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return s.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (s *SimWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return s.invoices.Subscribe(ctx)
+}
+
+// HeldInvoicesStream gets the hold invoices whose payments are accepted.
+func (s *SimWallet) HeldInvoicesStream(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return s.held.Subscribe(ctx)
+}
+
+// PaidInvoicesStreamFrom replays every invoice settled after cursor, then
+// follows the live stream.
+func (s *SimWallet) PaidInvoicesStreamFrom(ctx context.Context, cursor uint64) (<-chan rp.InvoiceStatus, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	live, err := s.invoices.Subscribe(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// so settling isn't held up while the replay is being read, up to a limit
+	live = rp.Queue(ctx, live, rp.DefaultQueueLimit)
+
+	// settled after subscribing, so nothing falls in between
+	n := s.Network
+	n.mu.Lock()
+	var replay []rp.InvoiceStatus
+	for _, status := range s.settled {
+		if status.Cursor > cursor {
+			replay = append(replay, status)
+		}
+	}
+	n.mu.Unlock()
+
+	listener := make(chan rp.InvoiceStatus)
+	started := s.life.Spawn(func() {
+		defer close(listener)
+		defer cancel()
+		for _, status := range replay {
+			select {
+			case listener <- status:
+			case <-ctx.Done():
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+		for status := range live {
+			select {
+			case listener <- status:
+			case <-ctx.Done():
+				return
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	})
+	if !started {
+		cancel()
+		return nil, rp.ErrClosed
+	}
+
+	return listener, nil
+}
+
+func (s *SimWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	return s.MakePaymentCtx(context.Background(), params)
+}
+
+// MakePaymentCtx takes the amount and the network fee from the balance and
+// routes the payment in the background, after the network latency. It fails
+// right away for expired or already paid invoices and when the balance isn't
+// enough, or the fee over the limit of params, and later, with a Failed status,
+// when the network is told to fail it, the payee isn't on the network anymore
+// or the latency is over params.Timeout.
+func (s *SimWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if err := s.check(ctx); err != nil {
+		return rp.PaymentData{}, err
+	}
+
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+	}
+
+	amount := inv.MSatoshi
+	switch {
+	case amount == 0 && params.CustomAmount <= 0:
+		return rp.PaymentData{}, rp.WrapError(rp.ErrInvalidInvoice,
+			errors.New("invoice has no amount and no custom amount was given"))
+	case amount == 0:
+		amount = params.CustomAmount
+	case params.CustomAmount != 0 && params.CustomAmount != amount:
+		return rp.PaymentData{}, rp.WrapError(rp.ErrInvalidInvoice,
+			fmt.Errorf("invoice is for %d msat, can't pay %d", amount, params.CustomAmount))
+	}
+	if time.Now().After(time.Unix(int64(inv.CreatedAt), 0).Add(time.Duration(inv.Expiry) * time.Second)) {
+		return rp.PaymentData{}, rp.WrapError(rp.ErrInvoiceExpired, errors.New("invoice expired"))
+	}
+
+	payment := Payment{
+		From:        s.pubkey,
+		To:          inv.Payee,
+		PaymentHash: inv.PaymentHash,
+		Msatoshi:    amount,
+	}
+	limit, hasLimit := params.FeeLimit(amount)
+	if err := s.send(payment, limit, hasLimit, params.Timeout, nil); err != nil {
+		return rp.PaymentData{}, err
+	}
+
+	return rp.PaymentData{
+		CheckingID: inv.PaymentHash,
+	}, nil
+}
+
+func (s *SimWallet) MakeKeysend(params rp.KeysendParams) (rp.PaymentData, error) {
+	return s.MakeKeysendCtx(context.Background(), params)
+}
+
+// MakeKeysendCtx pays like MakePaymentCtx does, and the payee gets an invoice
+// made up for it, already paid.
+func (s *SimWallet) MakeKeysendCtx(ctx context.Context, params rp.KeysendParams) (rp.PaymentData, error) {
+	if err := s.check(ctx); err != nil {
+		return rp.PaymentData{}, err
+	}
+	if params.Msatoshi <= 0 {
+		return rp.PaymentData{}, errors.New("keysend needs an amount")
+	}
+
+	var preimage [32]byte
+	if _, err := rand.Read(preimage[:]); err != nil {
+		return rp.PaymentData{}, err
+	}
+	hash := sha256.Sum256(preimage[:])
+	checkingID := hex.EncodeToString(hash[:])
+
+	payment := Payment{
+		From:        s.pubkey,
+		To:          params.Destination,
+		PaymentHash: checkingID,
+		Msatoshi:    params.Msatoshi,
+	}
+	spontaneous := &invoice{
+		status: rp.InvoiceStatus{
+			CheckingID:    checkingID,
+			Exists:        true,
+			State:         rp.InvoiceOpen,
+			Keysend:       true,
+			CustomRecords: copyRecords(params.CustomRecords),
+		},
+		preimage: hex.EncodeToString(preimage[:]),
+	}
+	limit, hasLimit := params.FeeLimit()
+	if err := s.send(payment, limit, hasLimit, params.Timeout, spontaneous); err != nil {
+		return rp.PaymentData{}, err
+	}
+
+	return rp.PaymentData{
+		CheckingID: checkingID,
+	}, nil
+}
+
+// send takes payment and its fee from the balance and routes it in the
+// background. spontaneous is the invoice keysend payments settle.
+func (s *SimWallet) send(
+	payment Payment,
+	feeLimit int64,
+	hasFeeLimit bool,
+	timeout time.Duration,
+	spontaneous *invoice,
+) error {
+	n := s.Network
+	n.mu.Lock()
+	if status, ok := s.sent[payment.PaymentHash]; ok && status.Status != rp.Failed {
+		n.mu.Unlock()
+		return rp.WrapError(rp.ErrAlreadyPaid,
+			fmt.Errorf("invoice already paid or being paid"))
+	}
+	fee := n.fee(payment.Msatoshi)
+	if hasFeeLimit && fee > feeLimit {
+		n.mu.Unlock()
+		return rp.WrapError(rp.ErrNoRoute,
+			fmt.Errorf("fee of %d msat is over the limit of %d msat", fee, feeLimit))
+	}
+	if s.balance < payment.Msatoshi+fee {
+		n.mu.Unlock()
+		return rp.WrapError(rp.ErrInsufficientBalance,
+			fmt.Errorf("balance of %d msat can't pay %d msat plus %d msat fee",
+				s.balance, payment.Msatoshi, fee))
+	}
+	s.balance -= payment.Msatoshi + fee
+	s.sent[payment.PaymentHash] = &rp.PaymentStatus{
+		CheckingID: payment.PaymentHash,
+		Status:     rp.Pending,
+	}
+	latency := n.latency
+	n.mu.Unlock()
+
+	if !s.life.Spawn(func() { s.route(payment, fee, spontaneous, latency, timeout) }) {
+		return rp.ErrClosed
+	}
+	return nil
+}
+
+// route settles payment on the payee after latency, or fails it and gives the
+// money back. Payments slower than a non-zero timeout fail once it is over.
+func (s *SimWallet) route(
+	payment Payment,
+	fee int64,
+	spontaneous *invoice,
+	latency, timeout time.Duration,
+) {
+	timedOut := timeout > 0 && latency > timeout
+	if timedOut {
+		latency = timeout
+	}
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-s.ctx.Done():
+		}
+	}
+
+	n := s.Network
+	n.mu.Lock()
+	var payee *SimWallet
+	var inv *invoice
+	var err error
+	switch {
+	case s.ctx.Err() != nil:
+		err = rp.ErrClosed
+	case timedOut:
+		err = errors.New("payment timed out")
+	default:
+		payee, inv, err = n.settle(payment, spontaneous)
+	}
+
+	if err == nil && inv.hold {
+		// pending until the payee settles or cancels it
+		inv.held = &heldPayment{payer: s, msatoshi: payment.Msatoshi, fee: fee}
+		invoiceStatus := inv.status
+		n.mu.Unlock()
+
+		payee.life.Spawn(func() { payee.held.Publish(invoiceStatus) })
+		return
+	}
+
+	status := s.sent[payment.PaymentHash]
+	if err != nil {
+		s.balance += payment.Msatoshi + fee
+		status.Status = rp.Failed
+	} else {
+		status.Status = rp.Complete
+		status.FeePaid = fee
+		status.Preimage = inv.preimage
+	}
+	paymentStatus := *status
+	var invoiceStatus rp.InvoiceStatus
+	if err == nil {
+		invoiceStatus = inv.status
+	}
+	n.mu.Unlock()
+
+	// the payee's listeners are left to its own goroutines, so a slow one
+	// doesn't hold up the payer
+	if err == nil {
+		payee.life.Spawn(func() { payee.invoices.Publish(invoiceStatus) })
+	}
+	s.payments.Publish(paymentStatus)
+}
+
+func copyRecords(records map[uint64][]byte) map[uint64][]byte {
+	if len(records) == 0 {
+		return nil
+	}
+	copied := make(map[uint64][]byte, len(records))
+	for typ, value := range records {
+		copied[typ] = append([]byte(nil), value...)
+	}
+	return copied
+}
+
+// settle pays the invoice of payment on its payee, or spontaneous when it
+// isn't nil, unless the network is set to fail it. Hold invoices are only
+// accepted, for the caller to hold the payment. It is called with n.mu held.
+func (n *Network) settle(payment Payment, spontaneous *invoice) (*SimWallet, *invoice, error) {
+	if len(n.failNext) > 0 {
+		err := n.failNext[0]
+		n.failNext = n.failNext[1:]
+		return nil, nil, err
+	}
+	if n.failure != nil {
+		if err := n.failure(payment); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	payee, ok := n.nodes[payment.To]
+	if !ok {
+		return nil, nil, rp.WrapError(rp.ErrNoRoute, fmt.Errorf("no node %s", payment.To))
+	}
+	inv, ok := payee.received[payment.PaymentHash]
+	switch {
+	case spontaneous != nil && ok:
+		return nil, nil, rp.ErrAlreadyPaid
+	case spontaneous != nil:
+		inv = spontaneous
+		payee.received[payment.PaymentHash] = inv
+	case !ok:
+		return nil, nil, rp.ErrInvoiceNotFound
+	case inv.status.Paid, inv.held != nil:
+		return nil, nil, rp.ErrAlreadyPaid
+	case inv.cancelled:
+		return nil, nil, errors.New("invoice cancelled")
+	case time.Now().After(inv.status.ExpiresAt):
+		return nil, nil, rp.ErrInvoiceExpired
+	case payment.Msatoshi < inv.msatoshi:
+		return nil, nil, fmt.Errorf("paid %d msat of %d", payment.Msatoshi, inv.msatoshi)
+	}
+
+	if inv.hold {
+		inv.status.State = rp.InvoiceAccepted
+		inv.status.MSatoshiReceived = payment.Msatoshi
+		return payee, inv, nil
+	}
+	payee.credit(inv, payment.Msatoshi)
+
+	return payee, inv, nil
+}
+
+// credit settles inv, paid with msatoshi. It is called with n.mu held.
+func (s *SimWallet) credit(inv *invoice, msatoshi int64) {
+	s.balance += msatoshi
+	s.settleIndex++
+	inv.status.Paid = true
+	inv.status.State = rp.InvoiceSettled
+	inv.status.SettledAt = time.Now()
+	inv.status.MSatoshiReceived = msatoshi
+	inv.status.Cursor = s.settleIndex
+	s.settled = append(s.settled, inv.status)
+}
+
+func (s *SimWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
+	return s.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+func (s *SimWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	if err := s.check(ctx); err != nil {
+		return rp.PaymentStatus{}, err
+	}
+
+	n := s.Network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if status, ok := s.sent[checkingID]; ok {
+		return *status, nil
+	}
+	return rp.PaymentStatus{CheckingID: checkingID, Status: rp.NeverTried}, nil
+}
+
+func (s *SimWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
+	return s.PaymentsStreamCtx(context.Background())
+}
+
+func (s *SimWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return s.payments.Subscribe(ctx)
+}
+
+// check fails calls on a closed wallet or with a done ctx.
+func (s *SimWallet) check(ctx context.Context) error {
+	if s.ctx.Err() != nil {
+		return rp.ErrClosed
+	}
+	return ctx.Err()
+}
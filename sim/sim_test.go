@@ -0,0 +1,616 @@
+package sim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	relampago_connect "github.com/lnbits/relampago/connect"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+// setupWallets starts two wallets on a network of their own, alice with
+// balance msat and bob with none.
+func setupWallets(t *testing.T, balance int64) (*Network, *SimWallet, *SimWallet) {
+	n := NewNetwork()
+	alice, err := Start(Params{Network: n, Alias: "alice", Balance: balance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := Start(Params{Network: n, Alias: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		alice.Close()
+		bob.Close()
+	})
+	return n, alice, bob
+}
+
+func balance(t *testing.T, s *SimWallet) int64 {
+	info, err := s.GetInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Balance
+}
+
+// settled checks that status has a settle time and clears it, so the rest can
+// be compared.
+func settled(t *testing.T, status rp.InvoiceStatus) rp.InvoiceStatus {
+	t.Helper()
+	if status.SettledAt.IsZero() {
+		t.Errorf("got %v, wanted a settle time", status.SettledAt)
+	}
+	status.SettledAt = time.Time{}
+	return status
+}
+
+func TestCreateInvoice(t *testing.T) {
+	_, _, bob := setupWallets(t, 0)
+
+	expiry := 10 * time.Minute
+	data, err := bob.CreateInvoice(rp.InvoiceParams{
+		Msatoshi:    21000,
+		Description: "coffee",
+		Expiry:      &expiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := decodepay.Decodepay(data.Invoice)
+	if err != nil {
+		t.Fatalf("got %v, wanted a decodable invoice", err)
+	}
+	if inv.Payee != bob.Pubkey() {
+		t.Errorf("got %v, wanted %v", inv.Payee, bob.Pubkey())
+	}
+	if inv.MSatoshi != 21000 {
+		t.Errorf("got %v, wanted %v", inv.MSatoshi, 21000)
+	}
+	if inv.Description != "coffee" {
+		t.Errorf("got %v, wanted %v", inv.Description, "coffee")
+	}
+	if inv.Expiry != 600 {
+		t.Errorf("got %v, wanted %v", inv.Expiry, 600)
+	}
+	if inv.PaymentHash != data.CheckingID {
+		t.Errorf("got %v, wanted %v", inv.PaymentHash, data.CheckingID)
+	}
+	preimage, _ := hex.DecodeString(data.Preimage)
+	if hash := sha256.Sum256(preimage); hex.EncodeToString(hash[:]) != data.CheckingID {
+		t.Errorf("got %x, wanted %v", hash, data.CheckingID)
+	}
+
+	descriptionHash := sha256.Sum256([]byte("metadata"))
+	data, err = bob.CreateInvoice(rp.InvoiceParams{DescriptionHash: descriptionHash[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err = decodepay.Decodepay(data.Invoice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := hex.EncodeToString(descriptionHash[:]); inv.DescriptionHash != want {
+		t.Errorf("got %v, wanted %v", inv.DescriptionHash, want)
+	}
+
+	status, err := bob.GetInvoiceStatus(data.CheckingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rp.InvoiceStatus{
+		CheckingID: data.CheckingID,
+		Exists:     true,
+		State:      rp.InvoiceOpen,
+		Invoice:    data.Invoice,
+	}
+	want.CreatedAt, want.ExpiresAt = rp.InvoiceTimes(data.Invoice)
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("got %v, wanted %v", status, want)
+	}
+}
+
+func TestMakePayment(t *testing.T) {
+	n, alice, bob := setupWallets(t, 100000)
+	n.SetFees(1000, 10000) // 1 sat and 1%
+
+	paid, err := bob.PaidInvoicesStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := alice.PaymentsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 50000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.CheckingID != data.CheckingID {
+		t.Errorf("got %v, wanted %v", payment.CheckingID, data.CheckingID)
+	}
+
+	wantInvoice := rp.InvoiceStatus{
+		CheckingID:       data.CheckingID,
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 50000,
+		State:            rp.InvoiceSettled,
+		Invoice:          data.Invoice,
+		Cursor:           1,
+	}
+	wantInvoice.CreatedAt, wantInvoice.ExpiresAt = rp.InvoiceTimes(data.Invoice)
+	if got := settled(t, <-paid); !reflect.DeepEqual(got, wantInvoice) {
+		t.Errorf("got %v, wanted %v", got, wantInvoice)
+	}
+	wantPayment := rp.PaymentStatus{
+		CheckingID: data.CheckingID,
+		Status:     rp.Complete,
+		FeePaid:    1500,
+		Preimage:   data.Preimage,
+	}
+	if got := <-payments; got != wantPayment {
+		t.Errorf("got %v, wanted %v", got, wantPayment)
+	}
+
+	if got := balance(t, alice); got != 48500 {
+		t.Errorf("got %v, wanted %v", got, 48500)
+	}
+	if got := balance(t, bob); got != 50000 {
+		t.Errorf("got %v, wanted %v", got, 50000)
+	}
+	if got, _ := bob.GetInvoiceStatus(data.CheckingID); !reflect.DeepEqual(settled(t, got), wantInvoice) {
+		t.Errorf("got %v, wanted %v", got, wantInvoice)
+	}
+	if got, _ := alice.GetPaymentStatus(data.CheckingID); got != wantPayment {
+		t.Errorf("got %v, wanted %v", got, wantPayment)
+	}
+
+	_, err = alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice})
+	if !errors.Is(err, rp.ErrAlreadyPaid) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrAlreadyPaid)
+	}
+
+	replay, err := bob.PaidInvoicesStreamFrom(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := settled(t, <-replay); !reflect.DeepEqual(got, wantInvoice) {
+		t.Errorf("got %v, wanted %v", got, wantInvoice)
+	}
+}
+
+func TestPaidInvoicesStreamFrom_Unread(t *testing.T) {
+	_, alice, bob := setupWallets(t, 10000)
+
+	// a replaying stream nobody reads doesn't hold up the payments
+	if _, err := bob.PaidInvoicesStreamFrom(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	payments, err := alice.PaymentsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		data, err := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-payments:
+			if got.Status != rp.Complete {
+				t.Errorf("got %v, wanted %v", got.Status, rp.Complete)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("payment wasn't published")
+		}
+	}
+}
+
+func TestMakePayment_Errors(t *testing.T) {
+	_, alice, bob := setupWallets(t, 1000)
+
+	expiry := time.Duration(0)
+	expired, _ := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 1, Expiry: &expiry})
+	big, _ := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 2000})
+	anyAmount, _ := bob.CreateInvoice(rp.InvoiceParams{})
+
+	tests := []struct {
+		params rp.PaymentParams
+		want   error
+	}{
+		{rp.PaymentParams{Invoice: "lnbc1"}, rp.ErrInvalidInvoice},
+		{rp.PaymentParams{Invoice: anyAmount.Invoice}, rp.ErrInvalidInvoice},
+		{rp.PaymentParams{Invoice: big.Invoice, CustomAmount: 1000}, rp.ErrInvalidInvoice},
+		{rp.PaymentParams{Invoice: big.Invoice}, rp.ErrInsufficientBalance},
+		{rp.PaymentParams{Invoice: expired.Invoice}, rp.ErrInvoiceExpired},
+	}
+	for _, tt := range tests {
+		if _, err := alice.MakePayment(tt.params); !errors.Is(err, tt.want) {
+			t.Errorf("got %v, wanted %v", err, tt.want)
+		}
+	}
+	if got := balance(t, alice); got != 1000 {
+		t.Errorf("got %v, wanted %v", got, 1000)
+	}
+}
+
+func TestMakePayment_Failures(t *testing.T) {
+	n, alice, bob := setupWallets(t, 10000)
+	n.SetLatency(20 * time.Millisecond)
+
+	payments, err := alice.PaymentsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// failed payments give the money back and can be tried again
+	n.FailNext(rp.ErrNoRoute)
+	data, _ := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 4000})
+	if _, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := alice.GetPaymentStatus(data.CheckingID); got.Status != rp.Pending {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Pending)
+	}
+	if got := balance(t, alice); got != 6000 {
+		t.Errorf("got %v, wanted %v", got, 6000)
+	}
+	if got := <-payments; got.Status != rp.Failed {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Failed)
+	}
+	if got := balance(t, alice); got != 10000 {
+		t.Errorf("got %v, wanted %v", got, 10000)
+	}
+
+	if _, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-payments; got.Status != rp.Complete {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Complete)
+	}
+
+	n.SetFailure(func(p Payment) error {
+		if p.Msatoshi > 1000 {
+			return errors.New("too big")
+		}
+		return nil
+	})
+	big, _ := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 2000})
+	small, _ := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 1000})
+	alice.MakePayment(rp.PaymentParams{Invoice: big.Invoice})
+	if got := <-payments; got.Status != rp.Failed {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Failed)
+	}
+	alice.MakePayment(rp.PaymentParams{Invoice: small.Invoice})
+	if got := <-payments; got.Status != rp.Complete {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Complete)
+	}
+
+	// payees that left the network can't be paid
+	n.SetFailure(nil)
+	gone, _ := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 1000})
+	bob.Close()
+	alice.MakePayment(rp.PaymentParams{Invoice: gone.Invoice})
+	if got := <-payments; got.Status != rp.Failed {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Failed)
+	}
+	if got := balance(t, alice); got != 5000 {
+		t.Errorf("got %v, wanted %v", got, 5000)
+	}
+}
+
+func TestMakePayment_Limits(t *testing.T) {
+	n, alice, bob := setupWallets(t, 100000)
+	n.SetFees(0, 10000) // 1%
+
+	payments, err := alice.PaymentsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 50000})
+	for _, params := range []rp.PaymentParams{
+		{Invoice: data.Invoice, MaxFeeMsat: 499},
+		{Invoice: data.Invoice, MaxFeePercent: 0.5},
+	} {
+		if _, err := alice.MakePayment(params); !errors.Is(err, rp.ErrNoRoute) {
+			t.Errorf("got %v, wanted %v", err, rp.ErrNoRoute)
+		}
+	}
+
+	n.SetLatency(time.Second)
+	_, err = alice.MakePayment(rp.PaymentParams{
+		Invoice:       data.Invoice,
+		MaxFeeMsat:    500,
+		MaxFeePercent: 2,
+		Timeout:       20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-payments:
+		if got.Status != rp.Failed {
+			t.Errorf("got %v, wanted %v", got.Status, rp.Failed)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("payment didn't time out")
+	}
+	if got := balance(t, alice); got != 100000 {
+		t.Errorf("got %v, wanted %v", got, 100000)
+	}
+}
+
+func TestMakeKeysend(t *testing.T) {
+	n, alice, bob := setupWallets(t, 10000)
+	n.SetFees(100, 0)
+
+	paid, err := bob.PaidInvoicesStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := alice.PaymentsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := map[uint64][]byte{7629169: []byte(`{"action":"boost"}`)}
+	data, err := alice.MakeKeysend(rp.KeysendParams{
+		Destination:   bob.Pubkey(),
+		Msatoshi:      3000,
+		CustomRecords: records,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := rp.InvoiceStatus{
+		CheckingID:       data.CheckingID,
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 3000,
+		State:            rp.InvoiceSettled,
+		Cursor:           1,
+		Keysend:          true,
+		CustomRecords:    records,
+	}
+	if got := settled(t, <-paid); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	payment := <-payments
+	if payment.Status != rp.Complete || payment.FeePaid != 100 {
+		t.Errorf("got %v, wanted a complete payment with a fee of %v", payment, 100)
+	}
+	preimage, _ := hex.DecodeString(payment.Preimage)
+	if hash := sha256.Sum256(preimage); hex.EncodeToString(hash[:]) != data.CheckingID {
+		t.Errorf("got %x, wanted %v", hash, data.CheckingID)
+	}
+	if got := balance(t, bob); got != 3000 {
+		t.Errorf("got %v, wanted %v", got, 3000)
+	}
+
+	// nodes that aren't on the network can't be paid
+	_, err = alice.MakeKeysend(rp.KeysendParams{Destination: "02abcd", Msatoshi: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-payments; got.Status != rp.Failed {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Failed)
+	}
+	if got := balance(t, alice); got != 6900 {
+		t.Errorf("got %v, wanted %v", got, 6900)
+	}
+}
+
+func TestHoldInvoice(t *testing.T) {
+	_, alice, bob := setupWallets(t, 10000)
+
+	paid, err := bob.PaidInvoicesStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := bob.HeldInvoicesStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := alice.PaymentsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preimage := strings.Repeat("05", 32)
+	p, _ := hex.DecodeString(preimage)
+	hash := sha256.Sum256(p)
+	checkingID := hex.EncodeToString(hash[:])
+	data, err := bob.CreateHoldInvoice(rp.InvoiceParams{Msatoshi: 4000}, checkingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.CheckingID != checkingID || data.Preimage != "" {
+		t.Errorf("got %v, wanted the payment hash and no preimage", data)
+	}
+
+	if _, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice}); err != nil {
+		t.Fatal(err)
+	}
+	want := rp.InvoiceStatus{
+		CheckingID:       checkingID,
+		Exists:           true,
+		MSatoshiReceived: 4000,
+		State:            rp.InvoiceAccepted,
+		Invoice:          data.Invoice,
+	}
+	want.CreatedAt, want.ExpiresAt = rp.InvoiceTimes(data.Invoice)
+	if got := <-held; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	if got, _ := alice.GetPaymentStatus(checkingID); got.Status != rp.Pending {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Pending)
+	}
+	if got := balance(t, bob); got != 0 {
+		t.Errorf("got %v, wanted %v", got, 0)
+	}
+
+	if err := bob.SettleHoldInvoice(strings.Repeat("06", 32)); !errors.Is(err, rp.ErrInvoiceNotFound) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrInvoiceNotFound)
+	}
+	if err := bob.SettleHoldInvoice(preimage); err != nil {
+		t.Fatal(err)
+	}
+	want.Paid = true
+	want.State = rp.InvoiceSettled
+	want.Cursor = 1
+	if got := settled(t, <-paid); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	wantPayment := rp.PaymentStatus{CheckingID: checkingID, Status: rp.Complete, Preimage: preimage}
+	if got := <-payments; got != wantPayment {
+		t.Errorf("got %v, wanted %v", got, wantPayment)
+	}
+	if got := balance(t, bob); got != 4000 {
+		t.Errorf("got %v, wanted %v", got, 4000)
+	}
+	if err := bob.CancelHoldInvoice(checkingID); !errors.Is(err, rp.ErrAlreadyPaid) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrAlreadyPaid)
+	}
+
+	// cancelling gives the payment back
+	hash = sha256.Sum256([]byte("another"))
+	checkingID = hex.EncodeToString(hash[:])
+	data, err = bob.CreateHoldInvoice(rp.InvoiceParams{Msatoshi: 1000}, checkingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice}); err != nil {
+		t.Fatal(err)
+	}
+	<-held
+	if err := bob.CancelHoldInvoice(checkingID); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-payments; got.Status != rp.Failed {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Failed)
+	}
+	if got := balance(t, alice); got != 6000 {
+		t.Errorf("got %v, wanted %v", got, 6000)
+	}
+	if got, _ := bob.GetInvoiceStatus(checkingID); got.State != rp.InvoiceCancelled || got.Paid {
+		t.Errorf("got %v, wanted a cancelled invoice", got)
+	}
+}
+
+func TestClose_HeldPayment(t *testing.T) {
+	_, alice, bob := setupWallets(t, 10000)
+
+	payments, err := alice.PaymentsStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bob's listeners are never read, which mustn't hold up alice
+	if _, err := bob.PaidInvoicesStream(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.HeldInvoicesStream(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := bob.CreateInvoice(rp.InvoiceParams{Msatoshi: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-payments; got.Status != rp.Complete {
+		t.Errorf("got %v, wanted %v", got.Status, rp.Complete)
+	}
+
+	hash := sha256.Sum256([]byte("held"))
+	checkingID := hex.EncodeToString(hash[:])
+	data, err = bob.CreateHoldInvoice(rp.InvoiceParams{Msatoshi: 4000}, checkingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.MakePayment(rp.PaymentParams{Invoice: data.Invoice}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if got, _ := bob.GetInvoiceStatus(checkingID); got.State == rp.InvoiceAccepted {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the held payment is given back once bob is gone
+	bob.Close()
+	if got := <-payments; got.CheckingID != checkingID || got.Status != rp.Failed {
+		t.Errorf("got %v, wanted a failed payment", got)
+	}
+	if got := balance(t, alice); got != 9000 {
+		t.Errorf("got %v, wanted %v", got, 9000)
+	}
+}
+
+func TestStart(t *testing.T) {
+	n := NewNetwork()
+	s, err := Start(Params{Network: n, Alias: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Start(Params{Network: n, Alias: "carol"}); err == nil {
+		t.Errorf("got %v, wanted an error", err)
+	}
+	s.Close()
+
+	// the same alias gives the same node once the first is gone
+	again, err := Start(Params{Network: n, Alias: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if again.Pubkey() != s.Pubkey() {
+		t.Errorf("got %v, wanted %v", again.Pubkey(), s.Pubkey())
+	}
+	if _, err := s.GetInfo(); !errors.Is(err, rp.ErrClosed) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrClosed)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	t.Setenv("LIGHTNING_BACKEND_TYPE", "sim")
+	t.Setenv("SIM_ALIAS", "dave")
+	t.Setenv("SIM_BALANCE_MSAT", "5000")
+
+	Register()
+	Register()
+	wallet, err := relampago_connect.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wallet.Close()
+	if got := wallet.(*SimWallet).Alias; got != "dave" {
+		t.Errorf("got %v, wanted %v", got, "dave")
+	}
+	if got := balance(t, wallet.(*SimWallet)); got != 5000 {
+		t.Errorf("got %v, wanted %v", got, 5000)
+	}
+}
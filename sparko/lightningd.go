@@ -0,0 +1,488 @@
+package sparko
+
+// The functions in this file translate between lightningd's JSON-RPC and
+// relampago, regardless of how lightningd is reached, so the clightning
+// backend uses them too.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	rp "github.com/lnbits/relampago"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+	backoff "gopkg.in/cenkalti/backoff.v1"
+)
+
+// Call makes a lightningd RPC call, however the backend reaches lightningd,
+// with params given the way lightning.Client takes them.
+type Call func(ctx context.Context, method string, params ...interface{}) (gjson.Result, error)
+
+// clnErrors are the lightningd error codes for the errors in the root package.
+var clnErrors = map[int]error{
+	201: rp.ErrAlreadyPaid,         // PAY_RHASH_ALREADY_USED
+	205: rp.ErrNoRoute,             // PAY_ROUTE_NOT_FOUND
+	207: rp.ErrInvoiceExpired,      // PAY_INVOICE_EXPIRED
+	208: rp.ErrInvoiceNotFound,     // PAY_NO_SUCH_PAYMENT
+	301: rp.ErrInsufficientBalance, // FUND_CANNOT_AFFORD
+	903: rp.ErrInvoiceExpired,      // INVOICE_EXPIRED_DURING_WAIT
+}
+
+// MapError wraps an error from a lightningd call with the matching error from
+// the root package, if there is one.
+func MapError(err error) error {
+	var (
+		cmderr    lightning.ErrorCommand
+		connerr   lightning.ErrorConnect
+		brokenerr lightning.ErrorConnectionBroken
+	)
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &cmderr):
+		if kind, ok := clnErrors[cmderr.Code]; ok {
+			return rp.WrapError(kind, err)
+		}
+		if cmderr.Code == -32602 && strings.Contains(cmderr.Message, "bolt11") {
+			// JSONRPC2_INVALID_PARAMS
+			return rp.WrapError(rp.ErrInvalidInvoice, err)
+		}
+	case errors.As(err, &connerr), errors.As(err, &brokenerr):
+		return rp.WrapError(rp.ErrBackendUnavailable, err)
+	}
+	return err
+}
+
+// WalletInfo is made from what getinfo and listfunds return.
+func WalletInfo(node, funds gjson.Result) rp.WalletInfo {
+	info := rp.WalletInfo{
+		Pubkey:      node.Get("id").String(),
+		Alias:       node.Get("alias").String(),
+		Network:     network(node.Get("network").String()),
+		BlockHeight: uint32(node.Get("blockheight").Uint()),
+		Version:     node.Get("version").String(),
+		// these warnings are only there while it's catching up
+		Synced: !node.Get("warning_bitcoind_sync").Exists() &&
+			!node.Get("warning_lightningd_sync").Exists(),
+	}
+	for _, channel := range funds.Get("channels").Array() {
+		ours := Msatoshi(channel.Get("our_amount_msat"))
+		switch channel.Get("state").String() {
+		case "CHANNELD_NORMAL":
+			info.OutboundMsat += ours
+			info.InboundMsat += Msatoshi(channel.Get("amount_msat")) - ours
+		case "CHANNELD_AWAITING_LOCKIN", "DUALOPEND_AWAITING_LOCKIN":
+			info.PendingMsat += ours
+		}
+	}
+	for _, output := range funds.Get("outputs").Array() {
+		if output.Get("status").String() == "confirmed" {
+			info.OnchainMsat += Msatoshi(output.Get("amount_msat"))
+		}
+	}
+	info.Balance = info.OutboundMsat
+
+	return info
+}
+
+// Msatoshi reads an amount lightningd gave either as a number or as a string
+// like "1000msat", which is how older versions did it.
+func Msatoshi(amount gjson.Result) int64 {
+	if amount.Type == gjson.String {
+		msat, _ := strconv.ParseInt(strings.TrimSuffix(amount.String(), "msat"), 10, 64)
+		return msat
+	}
+	return amount.Int()
+}
+
+// network is the rp.Network for lightningd's name for it.
+func network(name string) rp.Network {
+	if name == "bitcoin" {
+		return rp.Mainnet
+	}
+	return rp.Network(name)
+}
+
+// InvoiceRequest is the method and arguments that create the invoice described
+// by params. The label, which is its CheckingID, and the preimage are in args.
+func InvoiceRequest(params rp.InvoiceParams, labelPrefix string) (
+	method string, args map[string]interface{}, err error,
+) {
+	args = make(map[string]interface{})
+
+	args["msatoshi"] = params.Msatoshi
+	args["exposeprivatechannels"] = make([]struct{}, 0) // to suppress route hints
+
+	if params.DescriptionHash == nil {
+		method = "invoice"
+		args["description"] = params.Description
+	} else {
+		method = "invoicewithdescriptionhash"
+		args["description_hash"] = hex.EncodeToString(params.DescriptionHash)
+	}
+
+	if labelPrefix == "" {
+		labelPrefix = "relampago"
+	}
+	args["label"] = labelPrefix + "/" + strconv.FormatInt(time.Now().Unix(), 16)
+
+	preimage := make([]byte, 32)
+	if _, err := rand.Read(preimage); err != nil {
+		return "", nil, fmt.Errorf("failed to make random preimage: %w", err)
+	}
+	args["preimage"] = hex.EncodeToString(preimage)
+
+	if params.Expiry != nil {
+		args["expiry"] = params.Expiry.Seconds()
+	}
+
+	return method, args, nil
+}
+
+// PayArgs are the arguments of the pay call that pays params, for an invoice
+// of msatoshi. lightningd's own defaults apply to the limits left out.
+func PayArgs(params rp.PaymentParams, msatoshi int64) map[string]interface{} {
+	args := map[string]interface{}{
+		"bolt11": params.Invoice,
+	}
+	if params.CustomAmount != 0 {
+		args["msatoshi"] = params.CustomAmount
+		msatoshi = params.CustomAmount
+	}
+
+	limit, ok := params.FeeLimit(msatoshi)
+	setPayLimits(args, msatoshi, limit, ok, params.Timeout)
+	return args
+}
+
+// KeysendArgs are the arguments of the keysend call that pays params.
+func KeysendArgs(params rp.KeysendParams) map[string]interface{} {
+	args := map[string]interface{}{
+		"destination": params.Destination,
+		"msatoshi":    params.Msatoshi,
+	}
+	if len(params.CustomRecords) > 0 {
+		tlvs := make(map[string]string, len(params.CustomRecords))
+		for typ, value := range params.CustomRecords {
+			tlvs[strconv.FormatUint(typ, 10)] = hex.EncodeToString(value)
+		}
+		args["extratlvs"] = tlvs
+	}
+
+	limit, ok := params.FeeLimit()
+	setPayLimits(args, params.Msatoshi, limit, ok, params.Timeout)
+	return args
+}
+
+// setPayLimits adds the limits of a pay or keysend call to args.
+func setPayLimits(args map[string]interface{}, msatoshi, feeLimit int64, hasFeeLimit bool, timeout time.Duration) {
+	if hasFeeLimit && msatoshi > 0 {
+		// these calls only take a percentage, and fees under exemptfee would
+		// get past it
+		args["maxfeepercent"] = float64(feeLimit) * 100 / float64(msatoshi)
+		args["exemptfee"] = 0
+	}
+	if timeout > 0 {
+		args["retry_for"] = int64(math.Ceil(timeout.Seconds()))
+	}
+}
+
+// PayToPaymentStatus converts the result of a successful pay or keysend call.
+func PayToPaymentStatus(res gjson.Result) rp.PaymentStatus {
+	return rp.PaymentStatus{
+		CheckingID: res.Get("payment_hash").String(),
+		Status:     rp.Complete,
+		FeePaid:    Msatoshi(res.Get("amount_sent_msat")) - Msatoshi(res.Get("amount_msat")),
+		Preimage:   res.Get("payment_preimage").String(),
+	}
+}
+
+// KeysendLabelPrefix starts the labels of the invoices the keysend plugin
+// makes for the payments it receives.
+const KeysendLabelPrefix = "keysend-"
+
+// InvoiceToInvoiceStatus converts an invoice like listinvoices and
+// waitanyinvoice return them. lightningd doesn't keep the custom records of
+// keysend payments, so only the flag is set for them.
+func InvoiceToInvoiceStatus(invoice gjson.Result) rp.InvoiceStatus {
+	label := invoice.Get("label").String()
+	status := rp.InvoiceStatus{
+		CheckingID:       label,
+		Exists:           true,
+		Paid:             invoice.Get("status").String() == "paid",
+		MSatoshiReceived: invoice.Get("msatoshi_received").Int(),
+		Invoice:          invoice.Get("bolt11").String(),
+		Cursor:           invoice.Get("pay_index").Uint(),
+		Keysend:          strings.HasPrefix(label, KeysendLabelPrefix),
+	}
+	switch invoice.Get("status").String() {
+	case "paid":
+		status.State = rp.InvoiceSettled
+	case "expired":
+		status.State = rp.InvoiceExpired
+	default:
+		status.State = rp.InvoiceOpen
+	}
+
+	// the creation time is only in the bolt11, keysend ones have none
+	status.CreatedAt, _ = rp.InvoiceTimes(status.Invoice)
+	if status.Invoice == "" {
+		status.Invoice = invoice.Get("bolt12").String()
+	}
+	if expiresAt := invoice.Get("expires_at").Int(); expiresAt > 0 {
+		status.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+	if paidAt := invoice.Get("paid_at").Int(); paidAt > 0 {
+		status.SettledAt = time.Unix(paidAt, 0)
+	}
+	return status
+}
+
+// The hold invoice functions use the commands of Boltz's hold plugin, as
+// lightningd can't hold payments on its own.
+
+// HoldInvoicePollInterval is how often a hold invoice is looked up while
+// waiting for it to be paid, since the hold plugin sends no events.
+var HoldInvoicePollInterval = 5 * time.Second
+
+// GetHoldInvoiceStatus looks for a hold invoice, whose CheckingID is its
+// payment hash. There is none when the hold plugin isn't running.
+func GetHoldInvoiceStatus(ctx context.Context, call Call, checkingID string) (rp.InvoiceStatus, error) {
+	notFound := rp.InvoiceStatus{CheckingID: checkingID, Exists: false}
+	if len(checkingID) != 64 {
+		return notFound, nil
+	}
+
+	res, err := call(ctx, "listholdinvoices", map[string]interface{}{"payment_hash": checkingID})
+	if err != nil {
+		if IsMethodNotFound(err) {
+			return notFound, nil
+		}
+		return rp.InvoiceStatus{}, fmt.Errorf("error calling listholdinvoices: %w", err)
+	}
+
+	invoice := res.Get("holdinvoices.0")
+	if !invoice.Exists() {
+		return notFound, nil
+	}
+	return HoldInvoiceToInvoiceStatus(invoice), nil
+}
+
+// WatchHoldInvoice looks up the hold invoice with paymentHash every
+// HoldInvoicePollInterval until ctx is done, giving it to held when its
+// payment is accepted and to paid when it is settled. It gives up once the
+// invoice has expired or been cancelled.
+func WatchHoldInvoice(
+	ctx context.Context,
+	call Call,
+	paymentHash string,
+	held, paid func(rp.InvoiceStatus),
+	report func(error),
+) {
+	accepted := false
+	rp.Poll(ctx, HoldInvoicePollInterval, func() (bool, error) {
+		status, err := GetHoldInvoiceStatus(ctx, call, paymentHash)
+		switch {
+		case err != nil:
+			return false, fmt.Errorf("failed to look up hold invoice %s: %w", paymentHash, err)
+		case status.State == rp.InvoiceSettled:
+			paid(status)
+			return true, nil
+		case status.State == rp.InvoiceAccepted:
+			if !accepted {
+				accepted = true
+				held(status)
+			}
+		case status.State != rp.InvoiceOpen:
+			// expired, cancelled or gone
+			return true, nil
+		}
+		return false, nil
+	}, report)
+}
+
+// HoldInvoiceArgs are the arguments of the holdinvoice call that creates the
+// invoice described by params for paymentHash.
+func HoldInvoiceArgs(params rp.InvoiceParams, paymentHash string) (map[string]interface{}, error) {
+	if hash, err := hex.DecodeString(paymentHash); err != nil || len(hash) != 32 {
+		return nil, fmt.Errorf("invalid payment hash %s", paymentHash)
+	}
+	if params.DescriptionHash != nil {
+		return nil, errors.New("the hold plugin can't make invoices with a description hash")
+	}
+
+	args := map[string]interface{}{
+		"payment_hash": paymentHash,
+		"amount":       params.Msatoshi,
+		"description":  params.Description,
+	}
+	if params.Expiry != nil {
+		args["expiry"] = int64(params.Expiry.Seconds())
+	}
+	return args, nil
+}
+
+// HoldInvoiceToInvoiceStatus converts an invoice like listholdinvoices returns
+// them. The plugin doesn't tell when they were settled.
+func HoldInvoiceToInvoiceStatus(invoice gjson.Result) rp.InvoiceStatus {
+	status := rp.InvoiceStatus{
+		CheckingID: invoice.Get("payment_hash").String(),
+		Exists:     true,
+		Invoice:    invoice.Get("bolt11").String(),
+	}
+	status.CreatedAt, status.ExpiresAt = rp.InvoiceTimes(status.Invoice)
+	switch invoice.Get("state").String() {
+	case "accepted":
+		status.State = rp.InvoiceAccepted
+	case "paid":
+		status.State = rp.InvoiceSettled
+		status.Paid = true
+	case "cancelled":
+		status.State = rp.InvoiceCancelled
+		return status
+	default:
+		status.State = rp.UnpaidState(status.ExpiresAt)
+		return status
+	}
+
+	// the whole amount was received if the plugin took it
+	if inv, err := decodepay.Decodepay(status.Invoice); err == nil {
+		status.MSatoshiReceived = inv.MSatoshi
+	}
+	return status
+}
+
+// HoldPluginError explains errors from the hold plugin commands when they
+// failed because there is no such plugin.
+func HoldPluginError(method string, err error) error {
+	if IsMethodNotFound(err) {
+		return fmt.Errorf("error calling %s, the hold plugin isn't running: %w", method, err)
+	}
+	return fmt.Errorf("error calling %s: %w", method, err)
+}
+
+// IsMethodNotFound tells if err is lightningd not knowing the method called.
+func IsMethodNotFound(err error) bool {
+	var cmderr lightning.ErrorCommand
+	return errors.As(err, &cmderr) && cmderr.Code == -32601 // JSONRPC2_METHOD_NOT_FOUND
+}
+
+// LastPayIndex is the pay index of the latest invoice paid.
+func LastPayIndex(ctx context.Context, call Call) (uint64, error) {
+	res, err := call(ctx, "listinvoices")
+	if err != nil {
+		return 0, fmt.Errorf("error calling listinvoices: %w", err)
+	}
+
+	var payIndex uint64
+	for _, invoice := range res.Get("invoices").Array() {
+		if index := invoice.Get("pay_index").Uint(); index > payIndex {
+			payIndex = index
+		}
+	}
+	return payIndex, nil
+}
+
+// WaitInvoices gives emit every invoice paid after payIndex, or after the
+// latest one if it is zero, until ctx is done. Each waitanyinvoice call is
+// left waiting for wait. Errors go to report and are retried from the last
+// pay index seen, with a backoff that starts at retry.
+func WaitInvoices(
+	ctx context.Context,
+	call Call,
+	payIndex uint64,
+	wait, retry time.Duration,
+	emit func(rp.InvoiceStatus),
+	report func(error),
+) {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = retry
+	b.MaxElapsedTime = 0 // never give up
+	b.Reset()
+
+	start := payIndex == 0
+	for {
+		var err error
+		if start {
+			payIndex, err = LastPayIndex(ctx, call)
+			start = err != nil
+		} else {
+			callCtx, cancel := context.WithTimeout(ctx, wait+30*time.Second)
+			var res gjson.Result
+			res, err = call(callCtx, "waitanyinvoice", payIndex, wait.Seconds())
+			cancel()
+
+			var cmderr lightning.ErrorCommand
+			if errors.As(err, &cmderr) && cmderr.Code == 904 {
+				// timed out with nothing paid, just wait again
+				err = nil
+			} else if err == nil {
+				status := InvoiceToInvoiceStatus(res)
+				payIndex = status.Cursor
+				if status.Paid {
+					emit(status)
+				}
+			}
+		}
+
+		if err == nil {
+			b.Reset()
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		report(fmt.Errorf("waitanyinvoice failed, trying again: %w", err))
+		select {
+		case <-time.After(b.NextBackOff()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// InvoicesStreamFrom runs wait in a goroutine of life, for the
+// PaidInvoicesStreamFrom of a wallet, and returns a channel with what it
+// emits. The stream ends when ctx is done or the wallet is closed.
+func InvoicesStreamFrom(
+	ctx context.Context,
+	life *rp.Lifecycle,
+	wait func(ctx context.Context, emit func(rp.InvoiceStatus)),
+) (<-chan rp.InvoiceStatus, error) {
+	listener := make(chan rp.InvoiceStatus)
+	ctx, cancel := context.WithCancel(ctx)
+
+	started := life.Spawn(func() {
+		defer close(listener)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-life.Context().Done():
+				cancel()
+			}
+		}()
+
+		wait(ctx, func(status rp.InvoiceStatus) {
+			select {
+			case listener <- status:
+			case <-ctx.Done():
+			}
+		})
+	})
+	if !started {
+		cancel()
+		return nil, rp.ErrClosed
+	}
+
+	return listener, nil
+}
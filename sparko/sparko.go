@@ -1,10 +1,13 @@
 package sparko
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
+	"io"
+	"net/http"
 	"strings"
 	"time"
 
@@ -13,22 +16,38 @@ import (
 	rp "github.com/lnbits/relampago"
 	sse "github.com/r3labs/sse/v2"
 	"github.com/tidwall/gjson"
+	backoff "gopkg.in/cenkalti/backoff.v1"
 )
 
+// KeysendTimeout is how long a keysend call, which only returns once the
+// payment is done, is waited for when its context has no deadline.
+var KeysendTimeout = time.Minute
+
 type Params struct {
 	Host           string
 	Key            string
 	ConnectTimeout time.Duration
+	Proxy          string // optional, a SOCKS5 proxy every connection goes through
 
 	InvoiceLabelPrefix string // optional, defaults to 'relampago'
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, gets errors from the background streams
 }
 
 type SparkoWallet struct {
 	Params
-	client *lightning.Client
+	client *http.Client
+
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
 
-	invoiceStatusListeners []chan rp.InvoiceStatus
-	paymentStatusListeners []chan rp.PaymentStatus
+	health rp.HealthTracker
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+	held     *rp.Broadcaster[rp.InvoiceStatus] // accepted hold invoices
 }
 
 func Start(params Params) (*SparkoWallet, error) {
@@ -39,113 +58,259 @@ func Start(params Params) (*SparkoWallet, error) {
 	params.Host = strings.TrimSuffix(params.Host, "/")
 	params.Host = strings.TrimSuffix(params.Host, "/rpc")
 
-	spark := &lightning.Client{
-		SparkURL:    params.Host + "/rpc",
-		SparkToken:  params.Key,
-		CallTimeout: params.ConnectTimeout,
+	client, err := rp.HTTPClient(params.Proxy, params.ConnectTimeout)
+	if err != nil {
+		return nil, err
 	}
 
+	life := rp.NewLifecycle("sparko", params.OnError)
 	s := &SparkoWallet{
-		Params: params,
-		client: spark,
-	}
-
-	sseClient := sse.NewClient(params.Host + "/stream?access-key=" + params.Key)
-	go sseClient.Subscribe("", func(ev *sse.Event) {
-		data := gjson.ParseBytes(ev.Data)
-		switch string(ev.Event) {
-		case "sendpay_success":
-			success := data.Get("sendpay_success")
-			for _, listener := range s.paymentStatusListeners {
-				listener <- rp.PaymentStatus{
-					CheckingID: success.Get("payment_hash").String(),
-					Status:     rp.Complete,
-					FeePaid:    success.Get("msatoshi_sent").Int() - success.Get("msatoshi").Int(),
-					Preimage:   success.Get("payment_preimage").String(),
-				}
-			}
-		case "sendpay_failure":
-			hash := data.Get("sendpay_failure.data.payment_hash").String()
-			status, err := s.GetPaymentStatus(hash)
-			if err != nil {
-				return
-			}
-
-			for _, listener := range s.paymentStatusListeners {
-				listener <- status
-			}
-		case "invoice_payment":
-			label := data.Get("invoice_payment.label").String()
-			status, err := s.GetInvoiceStatus(label)
-			if err != nil {
-				return
-			}
-
-			for _, listener := range s.invoiceStatusListeners {
-				listener <- status
-			}
-		}
-	})
+		Params:   params,
+		client:   client,
+		life:     life,
+		ctx:      life.Context(),
+		invoices: rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments: rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+		held:     rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+	}
+
+	s.life.Spawn(s.followEvents)
 
 	return s, nil
 }
 
-// Compile time check to ensure that SparkoWallet fully implements rp.Wallet
-var _ rp.Wallet = (*SparkoWallet)(nil)
+// followEvents subscribes to the SSE stream and, whenever it drops, subscribes
+// again with backoff and looks for invoices paid in the gap.
+func (s *SparkoWallet) followEvents() {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // never give up
+
+	sseClient := sse.NewClient(s.Host + "/stream?access-key=" + s.Key)
+	sseClient.Connection = s.client
+	sseClient.ReconnectStrategy = &backoff.StopBackOff{} // we retry here instead
+	sseClient.ResponseValidator = func(_ *sse.Client, resp *http.Response) error {
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return fmt.Errorf("could not connect to stream: %s", resp.Status)
+		}
+
+		b.Reset()
+		if reconnected, lostAt := s.health.Connected(); reconnected {
+			s.life.Spawn(func() { s.reconcile(lostAt) })
+		}
+		return nil
+	}
+
+	for {
+		err := sseClient.SubscribeWithContext(s.ctx, "", s.handleEvent)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("stream ended")
+		}
+		s.life.ReportError(fmt.Errorf("stream disconnected, reconnecting: %w", err))
+		s.health.Disconnected(err)
+
+		select {
+		case <-time.After(b.NextBackOff()):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcile publishes the invoices paid since the stream was lost, as their
+// events were never received. Some may have been and are sent again.
+func (s *SparkoWallet) reconcile(lostAt time.Time) {
+	res, err := s.call(s.ctx, "listinvoices")
+	if err != nil {
+		s.life.ReportError(fmt.Errorf("failed to look for invoices paid while disconnected: %w", err))
+		return
+	}
+
+	for _, invoice := range res.Get("invoices").Array() {
+		if invoice.Get("status").String() == "paid" &&
+			invoice.Get("paid_at").Int() >= lostAt.Unix() {
+			s.invoices.Publish(InvoiceToInvoiceStatus(invoice))
+		}
+	}
+}
+
+// Health reports whether the SSE stream is currently connected.
+func (s *SparkoWallet) Health() rp.Health {
+	return s.health.Health()
+}
+
+func (s *SparkoWallet) handleEvent(ev *sse.Event) {
+	data := gjson.ParseBytes(ev.Data)
+	switch string(ev.Event) {
+	case "sendpay_success":
+		success := data.Get("sendpay_success")
+		s.payments.Publish(rp.PaymentStatus{
+			CheckingID: success.Get("payment_hash").String(),
+			Status:     rp.Complete,
+			FeePaid:    success.Get("msatoshi_sent").Int() - success.Get("msatoshi").Int(),
+			Preimage:   success.Get("payment_preimage").String(),
+		})
+	case "sendpay_failure":
+		hash := data.Get("sendpay_failure.data.payment_hash").String()
+		status, err := s.GetPaymentStatusCtx(s.ctx, hash)
+		if err != nil {
+			return
+		}
+
+		s.payments.Publish(status)
+	case "invoice_payment":
+		label := data.Get("invoice_payment.label").String()
+		status, err := s.GetInvoiceStatusCtx(s.ctx, label)
+		if err != nil {
+			return
+		}
+
+		s.invoices.Publish(status)
+	}
+}
+
+// Compile time check to ensure that SparkoWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*SparkoWallet)(nil)
+var _ rp.HoldInvoiceWallet = (*SparkoWallet)(nil)
+var _ rp.KeysendWallet = (*SparkoWallet)(nil)
+var _ rp.ResumableWallet = (*SparkoWallet)(nil)
+var _ rp.HealthReporter = (*SparkoWallet)(nil)
+var _ rp.StreamStatsReporter = (*SparkoWallet)(nil)
 
 func (s *SparkoWallet) Kind() string {
 	return "sparko"
 }
 
-func (s *SparkoWallet) GetInfo() (rp.WalletInfo, error) {
-	res, err := s.client.Call("listfunds")
-	if err != nil {
-		return rp.WalletInfo{}, fmt.Errorf("error calling listfunds: %w", err)
+func (s *SparkoWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		DescriptionHash:       true,
+		CustomExpiry:          true,
+		Keysend:               true,
+		HoldInvoices:          true, // with the hold plugin
+		MPP:                   true,
+		FeeLimits:             true,
+		PaymentTimeout:        true,
+		InvoicePaymentHashIDs: false, // invoices are checked by their label
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
 	}
+}
+
+// Close stops the SSE subscription and closes every listener channel. It is
+// safe to call more than once.
+func (s *SparkoWallet) Close() error {
+	s.life.Close(s.invoices.Close, s.payments.Close, s.held.Close)
+	return nil
+}
 
-	var balance int64
-	for _, channel := range res.Get("channels").Array() {
-		balance += channel.Get("channel_sat").Int()
+// call runs a sparko RPC method bounded by ctx, using the context deadline as
+// the call timeout when there is one.
+func (s *SparkoWallet) call(ctx context.Context, method string, params ...interface{}) (gjson.Result, error) {
+	timeout := s.ConnectTimeout
+	if timeout <= 0 {
+		timeout = lightning.DefaultTimeout
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	return rp.WalletInfo{balance}, nil
+	res, err := s.rpc(ctx, method, params...)
+	return res, MapError(err)
 }
 
-func (s *SparkoWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
-	var (
-		method string
-		args   = make(map[string]interface{})
-	)
+// rpc posts a call to sparko's /rpc endpoint, with params given the way
+// lightning.Client takes them, and fails with the same errors it does.
+func (s *SparkoWallet) rpc(ctx context.Context, method string, params ...interface{}) (gjson.Result, error) {
+	var payload interface{} = params
+	if len(params) == 0 {
+		payload = []interface{}{}
+	} else if named, ok := params[0].(map[string]interface{}); ok && len(params) == 1 {
+		payload = named
+	}
+	body, err := json.Marshal(lightning.JSONRPCMessage{
+		Version: "2.0",
+		Id:      "0",
+		Method:  method,
+		Params:  payload,
+	})
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("failed to encode request: %w", err)
+	}
 
-	args["msatoshi"] = params.Msatoshi
-	args["exposeprivatechannels"] = make([]struct{}, 0) // to suppress route hints
+	r, err := http.NewRequestWithContext(ctx, "POST", s.Host+"/rpc", bytes.NewReader(body))
+	if err != nil {
+		return gjson.Result{}, lightning.ErrorConnect{Path: s.Host, Message: err.Error()}
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Access", s.Key)
 
-	if params.DescriptionHash == nil {
-		method = "invoice"
-		args["description"] = params.Description
-	} else {
-		method = "invoicewithdescriptionhash"
-		args["description_hash"] = hex.EncodeToString(params.DescriptionHash)
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
 	}
+	w, err := s.client.Do(r)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return gjson.Result{}, lightning.ErrorTimeout{Seconds: int(timeout.Seconds())}
+		}
+		if ctx.Err() != nil {
+			return gjson.Result{}, ctx.Err()
+		}
+		return gjson.Result{}, lightning.ErrorConnect{Path: s.Host, Message: err.Error()}
+	}
+	defer w.Body.Close()
 
-	labelPrefix := s.InvoiceLabelPrefix
-	if labelPrefix == "" {
-		labelPrefix = "relampago"
+	data, err := io.ReadAll(w.Body)
+	if err != nil {
+		return gjson.Result{}, lightning.ErrorConnectionBroken{}
+	}
+	if w.StatusCode >= 300 {
+		var rpcErr lightning.JSONRPCError
+		if err := json.Unmarshal(data, &rpcErr); err != nil {
+			return gjson.Result{}, fmt.Errorf("sparko returned %s: %s", w.Status, data)
+		}
+		return gjson.Result{}, lightning.ErrorCommand{
+			Message: rpcErr.Message,
+			Code:    rpcErr.Code,
+			Data:    rpcErr.Data,
+		}
 	}
-	args["label"] = labelPrefix + "/" + strconv.FormatInt(time.Now().Unix(), 16)
+	return gjson.ParseBytes(data), nil
+}
+
+func (s *SparkoWallet) GetInfo() (rp.WalletInfo, error) {
+	return s.GetInfoCtx(context.Background())
+}
 
-	preimage := make([]byte, 32)
-	if _, err := rand.Read(preimage); err != nil {
-		return rp.InvoiceData{}, fmt.Errorf("failed to make random preimage: %w", err)
-	} else {
-		args["preimage"] = hex.EncodeToString(preimage)
+func (s *SparkoWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	funds, err := s.call(ctx, "listfunds")
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling listfunds: %w", err)
+	}
+	node, err := s.call(ctx, "getinfo")
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error calling getinfo: %w", err)
 	}
 
-	if params.Expiry != nil {
-		args["expiry"] = params.Expiry.Seconds()
+	return WalletInfo(node, funds), nil
+}
+
+func (s *SparkoWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return s.CreateInvoiceCtx(context.Background(), params)
+}
+
+func (s *SparkoWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	method, args, err := InvoiceRequest(params, s.InvoiceLabelPrefix)
+	if err != nil {
+		return rp.InvoiceData{}, err
 	}
 
-	inv, err := s.client.Call(method, args)
+	inv, err := s.call(ctx, method, args)
 	if err != nil {
 		return rp.InvoiceData{}, fmt.Errorf("%s call failed: %w", method, err)
 	}
@@ -157,51 +322,173 @@ func (s *SparkoWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, e
 }
 
 func (s *SparkoWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
-	res, err := s.client.Call("listinvoices", map[string]interface{}{"label": checkingID})
+	return s.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (s *SparkoWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	res, err := s.call(ctx, "listinvoices", map[string]interface{}{"label": checkingID})
 	if err != nil {
 		return rp.InvoiceStatus{}, fmt.Errorf("error getting invoice label=%s: %w", checkingID, err)
 	}
 
-	return rp.InvoiceStatus{
-		CheckingID:       checkingID,
-		Exists:           res.Get("invoices.#").Int() == 1,
-		Paid:             res.Get("invoices.0.status").String() == "paid",
-		MSatoshiReceived: res.Get("invoices.0.msatoshi_received").Int(),
+	if res.Get("invoices.#").Int() != 1 {
+		return GetHoldInvoiceStatus(ctx, s.call, checkingID)
+	}
+	return InvoiceToInvoiceStatus(res.Get("invoices.0")), nil
+}
+
+func (s *SparkoWallet) CreateHoldInvoice(params rp.InvoiceParams, paymentHash string) (rp.InvoiceData, error) {
+	return s.CreateHoldInvoiceCtx(context.Background(), params, paymentHash)
+}
+
+// CreateHoldInvoiceCtx creates the invoice with the hold plugin, which sends
+// no events, so it is looked up in the background until it is settled to feed
+// the held and paid invoices streams.
+func (s *SparkoWallet) CreateHoldInvoiceCtx(
+	ctx context.Context,
+	params rp.InvoiceParams,
+	paymentHash string,
+) (rp.InvoiceData, error) {
+	args, err := HoldInvoiceArgs(params, paymentHash)
+	if err != nil {
+		return rp.InvoiceData{}, err
+	}
+
+	res, err := s.call(ctx, "holdinvoice", args)
+	if err != nil {
+		return rp.InvoiceData{}, HoldPluginError("holdinvoice", err)
+	}
+	s.life.Spawn(func() {
+		WatchHoldInvoice(s.ctx, s.call, paymentHash, s.held.Publish, s.invoices.Publish, s.life.ReportError)
+	})
+
+	return rp.InvoiceData{
+		CheckingID: paymentHash,
+		Invoice:    res.Get("bolt11").String(),
 	}, nil
 }
 
+func (s *SparkoWallet) SettleHoldInvoice(preimage string) error {
+	return s.SettleHoldInvoiceCtx(context.Background(), preimage)
+}
+
+func (s *SparkoWallet) SettleHoldInvoiceCtx(ctx context.Context, preimage string) error {
+	_, err := s.call(ctx, "settleholdinvoice", map[string]interface{}{"preimage": preimage})
+	if err != nil {
+		return HoldPluginError("settleholdinvoice", err)
+	}
+	return nil
+}
+
+func (s *SparkoWallet) CancelHoldInvoice(paymentHash string) error {
+	return s.CancelHoldInvoiceCtx(context.Background(), paymentHash)
+}
+
+func (s *SparkoWallet) CancelHoldInvoiceCtx(ctx context.Context, paymentHash string) error {
+	_, err := s.call(ctx, "cancelholdinvoice", map[string]interface{}{"payment_hash": paymentHash})
+	if err != nil {
+		return HoldPluginError("cancelholdinvoice", err)
+	}
+	return nil
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (s *SparkoWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return s.invoices.Stats(), s.payments.Stats()
+}
+
 func (s *SparkoWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
-	listener := make(chan rp.InvoiceStatus)
-	s.invoiceStatusListeners = append(s.invoiceStatusListeners, listener)
-	return listener, nil
+	return s.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (s *SparkoWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return s.invoices.Subscribe(ctx)
+}
+
+// HeldInvoicesStream gets the hold invoices whose payments are accepted.
+func (s *SparkoWallet) HeldInvoicesStream(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return s.held.Subscribe(ctx)
+}
+
+// PaidInvoicesStreamFrom follows waitanyinvoice from the pay index in cursor,
+// independently of the SSE stream.
+func (s *SparkoWallet) PaidInvoicesStreamFrom(ctx context.Context, cursor uint64) (<-chan rp.InvoiceStatus, error) {
+	return InvoicesStreamFrom(ctx, s.life, func(ctx context.Context, emit func(rp.InvoiceStatus)) {
+		WaitInvoices(ctx, s.call, cursor, WaitAnyInvoiceTimeout, backoff.DefaultInitialInterval, emit, s.life.ReportError)
+	})
 }
 
+// WaitAnyInvoiceTimeout is how long a single waitanyinvoice call is left
+// waiting for a payment before it is made again.
+var WaitAnyInvoiceTimeout = time.Minute
+
 func (s *SparkoWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	return s.MakePaymentCtx(context.Background(), params)
+}
+
+func (s *SparkoWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if err := ctx.Err(); err != nil {
+		return rp.PaymentData{}, err
+	}
+
 	inv, err := decodepay.Decodepay(params.Invoice)
 	if err != nil {
-		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w", params.Invoice, err)
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
 	}
 
-	args := map[string]interface{}{
-		"bolt11": params.Invoice,
-	}
-	if params.CustomAmount != 0 {
-		args["msatoshi"] = params.CustomAmount
-	}
-	go func() {
+	args := PayArgs(params, inv.MSatoshi)
+	s.life.Spawn(func() {
 		// I think we need some time here just so the caller can update their DB with
 		// the checkingID we will return
-		time.Sleep(500 * time.Millisecond)
-		s.client.CallWithCustomTimeout(time.Second*1, "pay", args)
-	}()
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-s.ctx.Done():
+			return
+		}
+		// the pay call only returns once the payment is done, we follow it
+		// through the stream instead
+		ctx, cancel := context.WithTimeout(s.ctx, time.Second)
+		defer cancel()
+		s.rpc(ctx, "pay", args)
+	})
 
 	return rp.PaymentData{
 		CheckingID: inv.PaymentHash,
 	}, nil
 }
 
+func (s *SparkoWallet) MakeKeysend(params rp.KeysendParams) (rp.PaymentData, error) {
+	return s.MakeKeysendCtx(context.Background(), params)
+}
+
+// MakeKeysendCtx only returns once the payment is done, since lightningd makes
+// the preimage and its hash, the CheckingID, isn't known before. Its status
+// is published by the stream, like the ones of invoices paid.
+func (s *SparkoWallet) MakeKeysendCtx(ctx context.Context, params rp.KeysendParams) (rp.PaymentData, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, KeysendTimeout)
+		defer cancel()
+	}
+
+	res, err := s.call(ctx, "keysend", KeysendArgs(params))
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("error calling keysend to %s: %w",
+			params.Destination, err)
+	}
+
+	return rp.PaymentData{
+		CheckingID: res.Get("payment_hash").String(),
+	}, nil
+}
+
 func (s *SparkoWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
-	res, err := s.client.Call("listpays", map[string]interface{}{
+	return s.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+func (s *SparkoWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	res, err := s.call(ctx, "listpays", map[string]interface{}{
 		"payment_hash": checkingID,
 	})
 	if err != nil {
@@ -213,8 +500,8 @@ func (s *SparkoWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, er
 	switch res.Get("pays.0.status").String() {
 	case "complete":
 		status.Status = rp.Complete
-		needed, _ := strconv.ParseInt(res.Get("pays.0.amount_msat").String(), 10, 64)
-		sent, _ := strconv.ParseInt(res.Get("pays.0.amount_sent_msat").String(), 10, 64)
+		needed := Msatoshi(res.Get("pays.0.amount_msat"))
+		sent := Msatoshi(res.Get("pays.0.amount_sent_msat"))
 		status.FeePaid = sent - needed
 		status.Preimage = res.Get("pays.0.preimage").String()
 	case "failed":
@@ -230,7 +517,9 @@ func (s *SparkoWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, er
 }
 
 func (s *SparkoWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
-	listener := make(chan rp.PaymentStatus)
-	s.paymentStatusListeners = append(s.paymentStatusListeners, listener)
-	return listener, nil
+	return s.PaymentsStreamCtx(context.Background())
+}
+
+func (s *SparkoWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return s.payments.Subscribe(ctx)
 }
@@ -0,0 +1,426 @@
+package sparko
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/socks5test"
+	"github.com/tidwall/gjson"
+)
+
+func TestClose(t *testing.T) {
+	server, connections := setupSSEServer(nil)
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+
+	// start, use and close the wallet twice to be sure it can be restarted
+	for i := 0; i < 2; i++ {
+		s, err := Start(Params{Host: server.URL, Key: "key"})
+		if err != nil {
+			t.Fatalf("got %v, wanted %v", err, nil)
+		}
+
+		invoices, err := s.PaidInvoicesStream()
+		if err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+		payments, err := s.PaymentsStream()
+		if err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+
+		events := <-connections
+		events <- `event: sendpay_success
+data: {"sendpay_success":{"payment_hash":"ff","msatoshi":1000,"msatoshi_sent":1001,"payment_preimage":"00"}}`
+		want := rp.PaymentStatus{
+			CheckingID: "ff",
+			Status:     rp.Complete,
+			FeePaid:    1,
+			Preimage:   "00",
+		}
+		if got := <-payments; got != want {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Errorf("got %v, wanted %v", err, nil)
+		}
+		if _, ok := <-invoices; ok {
+			t.Errorf("invoices stream wasn't closed")
+		}
+		if _, ok := <-payments; ok {
+			t.Errorf("payments stream wasn't closed")
+		}
+		if _, err := s.PaidInvoicesStream(); err != rp.ErrClosed {
+			t.Errorf("got %v, wanted %v", err, rp.ErrClosed)
+		}
+	}
+
+	// every goroutine started by the wallets should be gone by now
+	server.CloseClientConnections()
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("got %v goroutines, wanted %v", got, before)
+	}
+}
+
+func TestPaidInvoicesStreamFrom(t *testing.T) {
+	requested := make(chan int64, 2)
+	server, _ := setupSSEServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		call := gjson.ParseBytes(body)
+		if call.Get("method").String() != "waitanyinvoice" {
+			w.WriteHeader(400)
+			return
+		}
+
+		switch call.Get("params.0").Int() {
+		case 7:
+			requested <- 7
+			if len(requested) == 1 {
+				w.WriteHeader(500)
+				fmt.Fprint(w, `{"code":904,"message":"Timed out"}`)
+				return
+			}
+			fmt.Fprint(w, `{"label":"relampago/1","status":"paid","pay_index":8,"msatoshi_received":2000}`)
+		default:
+			// nothing else gets paid
+			<-r.Context().Done()
+		}
+	})
+	defer server.Close()
+
+	s, err := Start(Params{Host: server.URL, Key: "key"})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := s.PaidInvoicesStreamFrom(ctx, 7)
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	want := rp.InvoiceStatus{
+		CheckingID:       "relampago/1",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 2000,
+		State:            rp.InvoiceSettled,
+		Cursor:           8,
+	}
+	if got := <-stream; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	// waiting again after the timeout, from the same pay index
+	for i := 0; i < 2; i++ {
+		if got := <-requested; got != 7 {
+			t.Errorf("got %v, wanted %v", got, 7)
+		}
+	}
+
+	cancel()
+	for range stream {
+	}
+}
+
+func TestInvoiceToInvoiceStatus(t *testing.T) {
+	for _, tc := range []struct {
+		invoice string
+		want    rp.InvoiceStatus
+	}{
+		{
+			`{"label":"relampago/1","status":"unpaid"}`,
+			rp.InvoiceStatus{CheckingID: "relampago/1", Exists: true, State: rp.InvoiceOpen},
+		},
+		{
+			`{"label":"relampago/2","status":"expired","bolt12":"lno1qcp4256ypq","expires_at":1650003600}`,
+			rp.InvoiceStatus{
+				CheckingID: "relampago/2",
+				Exists:     true,
+				State:      rp.InvoiceExpired,
+				Invoice:    "lno1qcp4256ypq",
+				ExpiresAt:  time.Unix(1650003600, 0),
+			},
+		},
+		{
+			`{"label":"keysend-1650000000.123456789","status":"paid","pay_index":3,"msatoshi_received":1000,"paid_at":1650000000}`,
+			rp.InvoiceStatus{
+				CheckingID:       "keysend-1650000000.123456789",
+				Exists:           true,
+				Paid:             true,
+				MSatoshiReceived: 1000,
+				State:            rp.InvoiceSettled,
+				SettledAt:        time.Unix(1650000000, 0),
+				Cursor:           3,
+				Keysend:          true,
+			},
+		},
+	} {
+		got := InvoiceToInvoiceStatus(gjson.Parse(tc.invoice))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got %v, wanted %v", got, tc.want)
+		}
+	}
+}
+
+func TestGetInfo(t *testing.T) {
+	server, _ := setupSSEServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch gjson.GetBytes(body, "method").String() {
+		case "getinfo":
+			fmt.Fprint(w, `{"id":"02aa","alias":"alice","network":"bitcoin","blockheight":800,"version":"v0.11.2"}`)
+		case "listfunds":
+			fmt.Fprint(w, `{
+  "outputs": [
+    {"amount_msat": "3000msat", "status": "confirmed"},
+    {"amount_msat": 4000, "status": "unconfirmed"}
+  ],
+  "channels": [
+    {"our_amount_msat": "10000msat", "amount_msat": "30000msat", "state": "CHANNELD_NORMAL"},
+    {"our_amount_msat": 5000, "amount_msat": 5000, "state": "CHANNELD_AWAITING_LOCKIN"},
+    {"our_amount_msat": 7000, "amount_msat": 7000, "state": "ONCHAIN"}
+  ]
+}`)
+		}
+	})
+	defer server.Close()
+
+	s, err := Start(Params{Host: server.URL, Key: "key"})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer s.Close()
+
+	want := rp.WalletInfo{
+		Balance:      10000,
+		Pubkey:       "02aa",
+		Alias:        "alice",
+		Network:      rp.Mainnet,
+		BlockHeight:  800,
+		Synced:       true,
+		Version:      "v0.11.2",
+		OutboundMsat: 10000,
+		InboundMsat:  20000,
+		PendingMsat:  5000,
+		OnchainMsat:  3000,
+	}
+	got, err := s.GetInfo()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	response := make(chan string, 1)
+	server, _ := setupSSEServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		fmt.Fprint(w, <-response)
+	})
+	defer server.Close()
+
+	s, err := Start(Params{Host: server.URL, Key: "key"})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		response string
+		want     error
+	}{
+		{`{"code":201,"message":"Already paid"}`, rp.ErrAlreadyPaid},
+		{`{"code":205,"message":"Could not find a route"}`, rp.ErrNoRoute},
+		{`{"code":207,"message":"Invoice expired"}`, rp.ErrInvoiceExpired},
+		{`{"code":208,"message":"No such payment"}`, rp.ErrInvoiceNotFound},
+		{`{"code":301,"message":"Cannot afford transaction"}`, rp.ErrInsufficientBalance},
+		{`{"code":-32602,"message":"Invalid bolt11: Bad bech32 string"}`, rp.ErrInvalidInvoice},
+	}
+	for _, test := range tests {
+		response <- test.response
+		_, err := s.call(context.Background(), "pay", "lnbc1")
+		if !errors.Is(err, test.want) {
+			t.Errorf("got %v, wanted %v", err, test.want)
+		}
+	}
+
+	// the lightningd error is still there too
+	response <- `{"code":904,"message":"Timed out"}`
+	_, err = s.call(context.Background(), "waitanyinvoice", 0)
+	var cmderr lightning.ErrorCommand
+	if !errors.As(err, &cmderr) || cmderr.Code != 904 {
+		t.Errorf("got %v, wanted code %v", err, 904)
+	}
+
+	_, err = s.MakePayment(rp.PaymentParams{Invoice: "lnbc1garbage"})
+	if !errors.Is(err, rp.ErrInvalidInvoice) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrInvalidInvoice)
+	}
+
+	// nothing listens there
+	down, err := Start(Params{Host: "http://127.0.0.1:1", Key: "key"})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer down.Close()
+	_, err = down.GetInfo()
+	if !errors.Is(err, rp.ErrBackendUnavailable) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrBackendUnavailable)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	paidAt := time.Now().Unix()
+	server, connections := setupSSEServer(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if gjson.GetBytes(body, "method").String() != "listinvoices" {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprintf(w, `{"invoices":[
+			{"label":"relampago/old","status":"paid","pay_index":1,"msatoshi_received":1000,"paid_at":1},
+			{"label":"relampago/open","status":"unpaid"},
+			{"label":"relampago/gap","status":"paid","pay_index":2,"msatoshi_received":2000,"paid_at":%d}
+		]}`, paidAt)
+	})
+	defer server.Close()
+
+	errs := make(chan error, 10)
+	onError := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	s, err := Start(Params{Host: server.URL, Key: "key", OnError: onError})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer s.Close()
+
+	invoices, err := s.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	// drop the first subscription
+	close(<-connections)
+	<-connections
+
+	// the invoice paid while it was down is found
+	want := rp.InvoiceStatus{
+		CheckingID:       "relampago/gap",
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 2000,
+		State:            rp.InvoiceSettled,
+		SettledAt:        time.Unix(paidAt, 0),
+		Cursor:           2,
+	}
+	if got := <-invoices; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+
+	health := s.Health()
+	if !health.Connected || health.Reconnects != 1 || health.LastError == nil {
+		t.Errorf("got %+v, wanted a connection that was reconnected once", health)
+	}
+	if len(errs) == 0 {
+		t.Errorf("got no errors, wanted the disconnection reported")
+	}
+}
+
+func TestStart_Proxy(t *testing.T) {
+	server, connections := setupSSEServer(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Access"); got != "key" {
+			t.Errorf("got %v, wanted %v", got, "key")
+		}
+		fmt.Fprint(w, `{"id":"02aa"}`)
+	})
+	defer server.Close()
+
+	proxy := socks5test.NewServer(t, "", "")
+	proxy.AddHost("sparko.onion:9737", server.Listener.Addr().String())
+
+	s, err := Start(Params{Host: "http://sparko.onion:9737", Key: "key", Proxy: proxy.URL()})
+	if err != nil {
+		t.Fatalf("got %v, wanted %v", err, nil)
+	}
+	defer s.Close()
+	<-connections
+
+	res, err := s.call(context.Background(), "getinfo")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got := res.Get("id").String(); got != "02aa" {
+		t.Errorf("got %v, wanted %v", got, "02aa")
+	}
+	// the stream and the call
+	want := []string{"sparko.onion:9737", "sparko.onion:9737"}
+	if got := proxy.Targets(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+// setupSSEServer returns a fake sparko that, for every /stream subscription,
+// hands out a channel whose messages are written to that subscription, closing
+// it ends the subscription. Calls to /rpc are given to rpc.
+func setupSSEServer(rpc http.HandlerFunc) (*httptest.Server, chan chan string) {
+	connections := make(chan chan string)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rpc" && rpc != nil {
+			rpc(w, r)
+			return
+		}
+		if r.URL.Path != "/stream" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+
+		events := make(chan string)
+		select {
+		case connections <- events:
+		case <-r.Context().Done():
+			return
+		}
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(w, "%s\n\n", event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+
+	return server, connections
+}
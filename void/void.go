@@ -1,6 +1,10 @@
 package void
 
-import rp "github.com/lnbits/relampago"
+import (
+	"context"
+
+	rp "github.com/lnbits/relampago"
+)
 
 type VoidWallet struct{}
 
@@ -8,13 +12,22 @@ func Start() (VoidWallet, error) {
 	return VoidWallet{}, nil
 }
 
-// Compile time check to ensure that VoidWallet fully implements rp.Wallet
-var _ rp.Wallet = (*VoidWallet)(nil)
+// Compile time check to ensure that VoidWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*VoidWallet)(nil)
 
 func (v VoidWallet) Kind() string {
 	return "void"
 }
 
+// Capabilities of the void wallet are none, it doesn't do anything.
+func (v VoidWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{}
+}
+
+func (v VoidWallet) Close() error {
+	return nil
+}
+
 func (v VoidWallet) GetInfo() (rp.WalletInfo, error) {
 	return rp.WalletInfo{
 		Balance: 0,
@@ -35,6 +48,7 @@ func (v VoidWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error
 		Exists:           true,
 		Paid:             false,
 		MSatoshiReceived: 0,
+		State:            rp.InvoiceOpen,
 	}, nil
 }
 
@@ -60,3 +74,46 @@ func (v VoidWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error
 func (v VoidWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
 	return make(chan rp.PaymentStatus), nil
 }
+
+func (v VoidWallet) GetInfoCtx(context.Context) (rp.WalletInfo, error) {
+	return v.GetInfo()
+}
+
+func (v VoidWallet) CreateInvoiceCtx(_ context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return v.CreateInvoice(params)
+}
+
+func (v VoidWallet) GetInvoiceStatusCtx(_ context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	return v.GetInvoiceStatus(checkingID)
+}
+
+func (v VoidWallet) MakePaymentCtx(_ context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	return v.MakePayment(params)
+}
+
+func (v VoidWallet) GetPaymentStatusCtx(_ context.Context, checkingID string) (rp.PaymentStatus, error) {
+	return v.GetPaymentStatus(checkingID)
+}
+
+func (v VoidWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	listener := make(chan rp.InvoiceStatus)
+	closeWhenDone(ctx, func() { close(listener) })
+	return listener, nil
+}
+
+func (v VoidWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	listener := make(chan rp.PaymentStatus)
+	closeWhenDone(ctx, func() { close(listener) })
+	return listener, nil
+}
+
+// closeWhenDone calls closeFn once ctx is done, if it can ever be.
+func closeWhenDone(ctx context.Context, closeFn func()) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		closeFn()
+	}()
+}
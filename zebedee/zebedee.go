@@ -0,0 +1,426 @@
+package zebedee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/httpjson"
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/tidwall/gjson"
+)
+
+// DefaultHost is where the ZEBEDEE API is, unless Params says otherwise.
+const DefaultHost = "https://api.zebedee.io/v0"
+
+// PaymentPollInterval is how often the charges made by this wallet, and the
+// payments that are still pending, are checked.
+var PaymentPollInterval = 5 * time.Second
+
+// TrackPaymentRetryLimit is for how long a payment is followed before it is
+// published with an Unknown status.
+var TrackPaymentRetryLimit = 15 * time.Minute
+
+// PayTimeout is how long the call that pays an invoice is waited for.
+var PayTimeout = time.Minute
+
+type Params struct {
+	Host           string // optional, defaults to DefaultHost
+	APIKey         string
+	ConnectTimeout time.Duration
+	Proxy          string // optional, a SOCKS5 proxy every connection goes through
+
+	Streams rp.BroadcastOptions // optional, how streams treat slow listeners
+	OnError func(error)         // optional, gets errors from the background streams
+}
+
+type ZebedeeWallet struct {
+	Params
+	api *httpjson.Client
+
+	// life runs every background goroutine until Close, when ctx is done
+	life *rp.Lifecycle
+	ctx  context.Context
+
+	open rp.InvoicePoller // the charges made by this wallet
+
+	mu         sync.Mutex
+	paymentIDs map[string]string // of the payments made, by hash, empty while paying
+
+	invoices *rp.Broadcaster[rp.InvoiceStatus]
+	payments *rp.Broadcaster[rp.PaymentStatus]
+}
+
+func Start(params Params) (*ZebedeeWallet, error) {
+	if params.Host == "" {
+		params.Host = DefaultHost
+	}
+	params.Host = strings.TrimSuffix(params.Host, "/")
+
+	client, err := rp.HTTPClient(params.Proxy, params.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	z := newZebedeeWallet(params, client)
+	if _, err := z.GetInfo(); err != nil {
+		z.Close()
+		return nil, fmt.Errorf("failed to get wallet: %w", err)
+	}
+	z.life.Spawn(z.pollCharges)
+
+	return z, nil
+}
+
+func newZebedeeWallet(params Params, client *http.Client) *ZebedeeWallet {
+	life := rp.NewLifecycle("zebedee", params.OnError)
+	return &ZebedeeWallet{
+		Params: params,
+		api: &httpjson.Client{
+			HTTP:         client,
+			Host:         params.Host,
+			Name:         "zebedee",
+			Header:       "apikey",
+			MessageField: "message",
+			Errors:       zebedeeErrors,
+			Timeout:      params.ConnectTimeout,
+		},
+		life:       life,
+		ctx:        life.Context(),
+		paymentIDs: make(map[string]string),
+		invoices:   rp.NewBroadcaster[rp.InvoiceStatus](params.Streams),
+		payments:   rp.NewBroadcaster[rp.PaymentStatus](params.Streams),
+	}
+}
+
+// Compile time check to ensure that ZebedeeWallet fully implements rp.ContextWallet
+var _ rp.ContextWallet = (*ZebedeeWallet)(nil)
+var _ rp.StreamStatsReporter = (*ZebedeeWallet)(nil)
+
+func (z *ZebedeeWallet) Kind() string {
+	return "zebedee"
+}
+
+func (z *ZebedeeWallet) Capabilities() rp.Capabilities {
+	return rp.Capabilities{
+		CustomExpiry:          true,
+		InvoicePaymentHashIDs: false, // invoices are checked by their charge id
+		PaymentPaymentHashIDs: true,
+		Streaming:             true,
+	}
+}
+
+// Close stops polling and closes every listener channel. It is safe to call
+// more than once.
+func (z *ZebedeeWallet) Close() error {
+	z.life.Close(z.invoices.Close, z.payments.Close)
+	return nil
+}
+
+// zebedeeErrors are the messages ZEBEDEE uses for the errors in the root
+// package, checked in order.
+var zebedeeErrors = httpjson.Errors{
+	{"enough funds", rp.ErrInsufficientBalance},
+	{"insufficient", rp.ErrInsufficientBalance},
+	{"already paid", rp.ErrAlreadyPaid},
+	{"expired", rp.ErrInvoiceExpired},
+	{"no route", rp.ErrNoRoute},
+	{"invalid invoice", rp.ErrInvalidInvoice},
+	{"could not decode", rp.ErrInvalidInvoice},
+	{"not found", rp.ErrInvoiceNotFound},
+}
+
+// call makes a request to the ZEBEDEE API, bounded by ctx or by
+// ConnectTimeout when ctx has no deadline, and gives the data in the reply.
+// body is sent as JSON.
+func (z *ZebedeeWallet) call(ctx context.Context, method, path string, body interface{}) (gjson.Result, error) {
+	res, err := z.api.Call(ctx, method, path, z.APIKey, body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if !res.Get("success").Bool() {
+		return gjson.Result{}, z.api.MapError(200,
+			fmt.Errorf("zebedee said (200): %s", res.Get("message").String()))
+	}
+
+	return res.Get("data"), nil
+}
+
+// msats reads amounts, which ZEBEDEE gives as strings.
+func msats(amount gjson.Result) int64 {
+	msat, _ := strconv.ParseInt(amount.String(), 10, 64)
+	return msat
+}
+
+func (z *ZebedeeWallet) GetInfo() (rp.WalletInfo, error) {
+	return z.GetInfoCtx(context.Background())
+}
+
+func (z *ZebedeeWallet) GetInfoCtx(ctx context.Context) (rp.WalletInfo, error) {
+	wallet, err := z.call(ctx, "GET", "/wallet", nil)
+	if err != nil {
+		return rp.WalletInfo{}, fmt.Errorf("error getting wallet: %w", err)
+	}
+
+	// ZEBEDEE runs the node, all we know is the balance of this wallet on it
+	balance := msats(wallet.Get("balance"))
+	return rp.WalletInfo{
+		Balance:      balance,
+		Network:      rp.Mainnet,
+		Synced:       true,
+		OutboundMsat: balance,
+	}, nil
+}
+
+func (z *ZebedeeWallet) CreateInvoice(params rp.InvoiceParams) (rp.InvoiceData, error) {
+	return z.CreateInvoiceCtx(context.Background(), params)
+}
+
+// CreateInvoiceCtx makes a charge, for which ZEBEDEE doesn't say what the
+// preimage is, so it is left empty.
+func (z *ZebedeeWallet) CreateInvoiceCtx(ctx context.Context, params rp.InvoiceParams) (rp.InvoiceData, error) {
+	if params.DescriptionHash != nil {
+		return rp.InvoiceData{}, errors.New("zebedee can't make invoices with a description hash")
+	}
+
+	args := map[string]interface{}{
+		"amount":      strconv.FormatInt(params.Msatoshi, 10),
+		"description": params.Description,
+	}
+	if params.Expiry != nil {
+		args["expiresIn"] = int64(params.Expiry.Seconds())
+	}
+
+	charge, err := z.call(ctx, "POST", "/charges", args)
+	if err != nil {
+		return rp.InvoiceData{}, fmt.Errorf("error creating charge: %w", err)
+	}
+
+	id := charge.Get("id").String()
+	expiry, _ := time.Parse(time.RFC3339, charge.Get("expiresAt").String())
+	z.open.Add(id, expiry)
+
+	return rp.InvoiceData{
+		CheckingID: id,
+		Invoice:    charge.Get("invoice.request").String(),
+	}, nil
+}
+
+func (z *ZebedeeWallet) GetInvoiceStatus(checkingID string) (rp.InvoiceStatus, error) {
+	return z.GetInvoiceStatusCtx(context.Background(), checkingID)
+}
+
+func (z *ZebedeeWallet) GetInvoiceStatusCtx(ctx context.Context, checkingID string) (rp.InvoiceStatus, error) {
+	charge, err := z.call(ctx, "GET", "/charges/"+checkingID, nil)
+	if err != nil {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.InvoiceStatus{CheckingID: checkingID, Exists: false}, nil
+		}
+		return rp.InvoiceStatus{}, fmt.Errorf("error getting charge %s: %w", checkingID, err)
+	}
+
+	status := rp.InvoiceStatus{
+		CheckingID: checkingID,
+		Exists:     true,
+		Paid:       charge.Get("status").String() == "completed",
+		Invoice:    charge.Get("invoice.request").String(),
+		CreatedAt:  isoTime(charge.Get("createdAt")),
+		ExpiresAt:  isoTime(charge.Get("expiresAt")),
+	}
+	switch charge.Get("status").String() {
+	case "completed":
+		status.State = rp.InvoiceSettled
+		status.MSatoshiReceived = msats(charge.Get("amount"))
+		status.SettledAt = isoTime(charge.Get("confirmedAt"))
+	case "expired":
+		status.State = rp.InvoiceExpired
+	default:
+		status.State = rp.UnpaidState(status.ExpiresAt)
+	}
+	return status, nil
+}
+
+// isoTime reads the dates of charges, which are zero when not set.
+func isoTime(ts gjson.Result) time.Time {
+	t, _ := time.Parse(time.RFC3339, ts.String())
+	return t
+}
+
+// pollCharges checks the charges made by this wallet every
+// PaymentPollInterval, publishing them when they are paid.
+func (z *ZebedeeWallet) pollCharges() {
+	z.open.Run(z.ctx, PaymentPollInterval,
+		z.GetInvoiceStatusCtx, z.invoices.Publish, z.life.ReportError)
+}
+
+// StreamStats reports how the invoice and payment streams are doing.
+func (z *ZebedeeWallet) StreamStats() (invoices, payments rp.BroadcastStats) {
+	return z.invoices.Stats(), z.payments.Stats()
+}
+
+// PaidInvoicesStream only has the charges made by this wallet since it was
+// started, as they are found by polling them.
+func (z *ZebedeeWallet) PaidInvoicesStream() (<-chan rp.InvoiceStatus, error) {
+	return z.PaidInvoicesStreamCtx(context.Background())
+}
+
+func (z *ZebedeeWallet) PaidInvoicesStreamCtx(ctx context.Context) (<-chan rp.InvoiceStatus, error) {
+	return z.invoices.Subscribe(ctx)
+}
+
+func (z *ZebedeeWallet) MakePayment(params rp.PaymentParams) (rp.PaymentData, error) {
+	return z.MakePaymentCtx(context.Background(), params)
+}
+
+// MakePaymentCtx starts paying the invoice in the background, so a slow reply
+// from ZEBEDEE doesn't leave the payment without a CheckingID. It is the
+// payment hash, which GetPaymentStatus only knows for the payments made since
+// Start.
+func (z *ZebedeeWallet) MakePaymentCtx(ctx context.Context, params rp.PaymentParams) (rp.PaymentData, error) {
+	if err := ctx.Err(); err != nil {
+		return rp.PaymentData{}, err
+	}
+	if params.CustomAmount != 0 {
+		return rp.PaymentData{}, errors.New("zebedee can't pay a custom amount")
+	}
+	if params.MaxFeeMsat != 0 || params.MaxFeePercent != 0 || params.Timeout != 0 {
+		return rp.PaymentData{}, errors.New("zebedee can't limit the fees or time of a payment")
+	}
+
+	inv, err := decodepay.Decodepay(params.Invoice)
+	if err != nil {
+		return rp.PaymentData{}, fmt.Errorf("failed to decode invoice '%s': %w",
+			params.Invoice, rp.WrapError(rp.ErrInvalidInvoice, err))
+	}
+
+	z.mu.Lock()
+	z.paymentIDs[inv.PaymentHash] = ""
+	z.mu.Unlock()
+	if !z.life.Spawn(func() { z.pay(inv.PaymentHash, params.Invoice) }) {
+		return rp.PaymentData{}, rp.ErrClosed
+	}
+
+	return rp.PaymentData{
+		CheckingID: inv.PaymentHash,
+	}, nil
+}
+
+// pay pays invoice and publishes how it went.
+func (z *ZebedeeWallet) pay(hash, invoice string) {
+	ctx, cancel := context.WithTimeout(z.ctx, PayTimeout)
+	payment, err := z.call(ctx, "POST", "/payments", map[string]interface{}{
+		"invoice": invoice,
+	})
+	timedOut := ctx.Err() != nil
+	cancel()
+	if z.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		status := rp.PaymentStatus{CheckingID: hash, Status: rp.Failed}
+		if errors.Is(err, rp.ErrBackendUnavailable) || timedOut {
+			// it may be paid, but without its id there is no following it
+			status.Status = rp.Unknown
+		}
+		z.life.ReportError(fmt.Errorf("payment %s failed: %w", hash, err))
+		z.payments.Publish(status)
+		return
+	}
+
+	status := paymentToPaymentStatus(payment)
+	z.mu.Lock()
+	z.paymentIDs[hash] = status.CheckingID
+	z.mu.Unlock()
+
+	status.CheckingID = hash
+	z.trackPayment(status)
+}
+
+// trackPayment polls status every PaymentPollInterval while it is pending and
+// publishes it once it isn't, or after TrackPaymentRetryLimit, when it is
+// published as Unknown.
+func (z *ZebedeeWallet) trackPayment(status rp.PaymentStatus) {
+	if status.Status == rp.Pending {
+		ctx, cancel := context.WithTimeout(z.ctx, TrackPaymentRetryLimit)
+		defer cancel()
+
+		done := rp.Poll(ctx, PaymentPollInterval, func() (bool, error) {
+			current, err := z.GetPaymentStatusCtx(ctx, status.CheckingID)
+			if err != nil {
+				return false, err
+			}
+			status = current
+			return status.Status != rp.Pending, nil
+		}, z.life.ReportError)
+		if z.ctx.Err() != nil {
+			return
+		}
+		if !done {
+			status.Status = rp.Unknown
+		}
+	}
+
+	z.payments.Publish(status)
+}
+
+func (z *ZebedeeWallet) GetPaymentStatus(checkingID string) (rp.PaymentStatus, error) {
+	return z.GetPaymentStatusCtx(context.Background(), checkingID)
+}
+
+// GetPaymentStatusCtx looks up the payment by its id, found from the payment
+// hash in checkingID. The payments made before Start aren't known.
+func (z *ZebedeeWallet) GetPaymentStatusCtx(ctx context.Context, checkingID string) (rp.PaymentStatus, error) {
+	z.mu.Lock()
+	id, ok := z.paymentIDs[checkingID]
+	z.mu.Unlock()
+	switch {
+	case !ok:
+		return rp.PaymentStatus{CheckingID: checkingID, Status: rp.Unknown}, nil
+	case id == "":
+		// still waiting for ZEBEDEE to reply
+		return rp.PaymentStatus{CheckingID: checkingID, Status: rp.Pending}, nil
+	}
+
+	payment, err := z.call(ctx, "GET", "/payments/"+id, nil)
+	if err != nil {
+		if errors.Is(err, rp.ErrInvoiceNotFound) {
+			return rp.PaymentStatus{CheckingID: checkingID, Status: rp.NeverTried}, nil
+		}
+		return rp.PaymentStatus{}, fmt.Errorf("error getting payment %s: %w", checkingID, err)
+	}
+
+	status := paymentToPaymentStatus(payment)
+	status.CheckingID = checkingID
+	return status, nil
+}
+
+func paymentToPaymentStatus(payment gjson.Result) rp.PaymentStatus {
+	status := rp.PaymentStatus{CheckingID: payment.Get("id").String()}
+	switch payment.Get("status").String() {
+	case "completed":
+		status.Status = rp.Complete
+		status.FeePaid = msats(payment.Get("fee"))
+		status.Preimage = payment.Get("preimage").String()
+	case "failed", "error":
+		status.Status = rp.Failed
+	case "pending", "processing":
+		status.Status = rp.Pending
+	default:
+		status.Status = rp.Unknown
+	}
+	return status
+}
+
+func (z *ZebedeeWallet) PaymentsStream() (<-chan rp.PaymentStatus, error) {
+	return z.PaymentsStreamCtx(context.Background())
+}
+
+func (z *ZebedeeWallet) PaymentsStreamCtx(ctx context.Context) (<-chan rp.PaymentStatus, error) {
+	return z.payments.Subscribe(ctx)
+}
@@ -0,0 +1,220 @@
+package zebedee
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	rp "github.com/lnbits/relampago"
+	"github.com/lnbits/relampago/internal/replaytest"
+)
+
+const (
+	chargeID  = "c4e9ab0e-2ff5-4a51-8a4a-4b1d4e7a0f1c"
+	paymentID = "7f1c0a6e-7d5b-4e3e-9a0e-3b4f2c1d0e9f"
+
+	invoice     = "lnbc175001ps6e5udpp58ur2s8s2ps4dxnhfmu4rpkr6syx6nc7r3q0hsp644nj7tejdxznsdq5w3jhxapqd9h8vmmfvdjscqzpgxqyz5vqsp50cs6gww9y96g84635a7apkwmmmlv69a2sah89qq03ngdgrvdf4ts9qyyssqs9kx2rngh4ty3h5t9hkrx4dxhfrne2jccluw6eq42hutaejvh474wvfg8untkk484v77043aus92mfshmq6psp487r34c5huglpnf0cq24eqg3"
+	paymentHash = "3f06a81e0a0c2ad34ee9df2a30d87a810da9e3c3881f780755ace5e5e64d30a7"
+)
+
+func TestGetInfo(t *testing.T) {
+	z := setupServer(t, replaytest.Responses{
+		"GET /wallet": {200, "wallet.json"},
+	})
+
+	want := rp.WalletInfo{
+		Balance:      1234000,
+		Network:      rp.Mainnet,
+		Synced:       true,
+		OutboundMsat: 1234000,
+	}
+	got, err := z.GetInfo()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got != want {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestPaidInvoicesStream(t *testing.T) {
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = 10 * time.Millisecond
+
+	z := setupServer(t, replaytest.Responses{
+		"POST /charges":            {201, "charge.json"},
+		"GET /charges/" + chargeID: {200, "charge_completed.json"},
+	})
+
+	invoices, err := z.PaidInvoicesStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	z.life.Spawn(z.pollCharges)
+
+	data, err := z.CreateInvoice(rp.InvoiceParams{Msatoshi: 2000, Description: "relampago test"})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if data.CheckingID != chargeID {
+		t.Errorf("got %v, wanted %v", data.CheckingID, chargeID)
+	}
+
+	want := rp.InvoiceStatus{
+		CheckingID:       chargeID,
+		Exists:           true,
+		Paid:             true,
+		MSatoshiReceived: 2000,
+		State:            rp.InvoiceSettled,
+		Invoice:          "lnbc20n1p3ml9kepp5ehhtpmvxq7mg3pxkj5gklk0yuzvk9rxq2uq2sm6zqq9kxpqxnwdsdqjwfjkcctpd9c8qctdvdjscqzpgxqrrss",
+		CreatedAt:        time.Date(2022, 10, 12, 18, 20, 33, 126e6, time.UTC),
+		ExpiresAt:        time.Date(2099, 10, 12, 18, 30, 33, 118e6, time.UTC),
+		SettledAt:        time.Date(2022, 10, 12, 18, 21, 2, 541e6, time.UTC),
+	}
+	select {
+	case got := <-invoices:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("invoice wasn't published")
+	}
+}
+
+func TestGetInvoiceStatus_NotFound(t *testing.T) {
+	z := setupServer(t, replaytest.Responses{
+		"GET /charges/nope": {404, "not_found.json"},
+	})
+
+	want := rp.InvoiceStatus{CheckingID: "nope", Exists: false}
+	got, err := z.GetInvoiceStatus("nope")
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+}
+
+func TestMakePayment(t *testing.T) {
+	interval := PaymentPollInterval
+	t.Cleanup(func() { PaymentPollInterval = interval })
+	PaymentPollInterval = 10 * time.Millisecond
+
+	z := setupServer(t, replaytest.Responses{
+		"POST /payments":             {200, "payment_pending.json"},
+		"GET /payments/" + paymentID: {200, "payment_completed.json"},
+	})
+
+	payments, err := z.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	got, err := z.MakePayment(rp.PaymentParams{Invoice: invoice})
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if got.CheckingID != paymentHash {
+		t.Errorf("got %v, wanted %v", got.CheckingID, paymentHash)
+	}
+
+	want := rp.PaymentStatus{
+		CheckingID: paymentHash,
+		Status:     rp.Complete,
+		FeePaid:    4000,
+		Preimage:   "e5cc4a6ee3b1e1f0f1b8d2bdc4e0ee2b4b1bd5f6e7d8c9b0a1f2e3d4c5b6a798",
+	}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_RetryLimit(t *testing.T) {
+	interval, limit := PaymentPollInterval, TrackPaymentRetryLimit
+	t.Cleanup(func() { PaymentPollInterval, TrackPaymentRetryLimit = interval, limit })
+	PaymentPollInterval = 10 * time.Millisecond
+	TrackPaymentRetryLimit = 50 * time.Millisecond
+
+	z := setupServer(t, replaytest.Responses{
+		"POST /payments":             {200, "payment_pending.json"},
+		"GET /payments/" + paymentID: {200, "payment_pending.json"},
+	})
+
+	payments, err := z.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+	if _, err := z.MakePayment(rp.PaymentParams{Invoice: invoice}); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	// listeners aren't left waiting on a payment that stays pending
+	want := rp.PaymentStatus{CheckingID: paymentHash, Status: rp.Unknown}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_InsufficientBalance(t *testing.T) {
+	z := setupServer(t, replaytest.Responses{
+		"POST /payments": {400, "insufficient.json"},
+	})
+
+	payments, err := z.PaymentsStream()
+	if err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	// it is only known once ZEBEDEE replies, in the background
+	if _, err := z.MakePayment(rp.PaymentParams{Invoice: invoice}); err != nil {
+		t.Errorf("got %v, wanted %v", err, nil)
+	}
+
+	want := rp.PaymentStatus{CheckingID: paymentHash, Status: rp.Failed}
+	select {
+	case status := <-payments:
+		if status != want {
+			t.Errorf("got %v, wanted %v", status, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("payment wasn't published")
+	}
+}
+
+func TestMakePayment_InvalidInvoice(t *testing.T) {
+	z := setupServer(t, replaytest.Responses{})
+
+	_, err := z.MakePayment(rp.PaymentParams{Invoice: "lnbc175001..."})
+	if !errors.Is(err, rp.ErrInvalidInvoice) {
+		t.Errorf("got %v, wanted %v", err, rp.ErrInvalidInvoice)
+	}
+}
+
+// setupServer starts a server replaying the recorded responses, by method and
+// path, and a wallet that talks to it. Charges aren't polled, tests that want
+// that spawn it.
+func setupServer(t *testing.T, responses replaytest.Responses) *ZebedeeWallet {
+	server := replaytest.Server(t, "apikey", "testkey", responses)
+
+	z := newZebedeeWallet(Params{
+		Host:    server.URL,
+		APIKey:  "testkey",
+		OnError: func(error) {},
+	}, http.DefaultClient)
+	t.Cleanup(func() { z.Close() })
+	return z
+}